@@ -6,8 +6,8 @@
 package visor
 
 import (
+	"context"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
 	"path"
 	"strings"
 	"time"
@@ -17,7 +17,7 @@ const appsPath = "apps"
 const DeployLXC = "lxc"
 
 type App struct {
-	dir        *cp.Dir
+	dir        *dir
 	Name       string
 	RepoUrl    string
 	Stack      string
@@ -30,12 +30,12 @@ type App struct {
 // NewApp returns a new App given a name, repository url and stack.
 func (s *Store) NewApp(name string, repourl string, stack string) (app *App) {
 	app = &App{Name: name, RepoUrl: repourl, Stack: stack, Env: map[string]string{}}
-	app.dir = cp.NewDir(path.Join(appsPath, app.Name), s.GetSnapshot())
+	app.dir = newDir(path.Join(appsPath, app.Name), s.GetSnapshot())
 
 	return
 }
 
-func (a *App) GetSnapshot() cp.Snapshot {
+func (a *App) GetSnapshot() Snapshot {
 	return a.dir.Snapshot
 }
 
@@ -63,30 +63,21 @@ func (a *App) Register() (*App, error) {
 		"stack":       a.Stack,
 		"deploy-type": a.DeployType,
 	}
-	attrs := cp.NewFile(a.dir.Prefix("attrs"), v, new(cp.JsonCodec), sp)
+	reg := time.Now()
 
-	attrs, err = attrs.Save()
-	if err != nil {
-		return nil, err
+	txn := sp.Txn().setValue(a.dir.Prefix("attrs"), v, new(jsonCodec))
+	for k, val := range a.Env {
+		txn.Set(a.dir.Prefix("env", strings.Replace(k, "_", "-", -1)), val)
 	}
-
-	a.dir = a.dir.Join(sp)
-
-	for k, v := range a.Env {
-		_, err = a.SetEnvironmentVar(k, v)
-		if err != nil {
-			return nil, err
-		}
+	sp, err = txn.Set(a.dir.Prefix(registeredPath), formatTime(reg)).Commit()
+	if IsErrRevMismatch(err) {
+		return nil, errorf(ErrConflict, `app "%s" already exists`, a.Name)
 	}
-
-	reg := time.Now()
-	d, err := a.dir.Set(registeredPath, formatTime(reg))
 	if err != nil {
 		return nil, err
 	}
 	a.Registered = reg
-
-	a.dir = d
+	a.dir = a.dir.Join(sp)
 
 	return a, err
 }
@@ -129,7 +120,7 @@ func (a *App) EnvironmentVars() (vars map[string]string, err error) {
 	}
 	names, err := sp.Getdir(a.dir.Prefix("env"))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = nil
 		}
 		return
@@ -143,7 +134,7 @@ func (a *App) EnvironmentVars() (vars map[string]string, err error) {
 	ch := make(chan resp, len(names))
 
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			return vars, nil
 		} else {
 			return
@@ -176,7 +167,7 @@ func (a *App) GetEnvironmentVar(k string) (value string, err error) {
 	k = strings.Replace(k, "_", "-", -1)
 	val, _, err := a.dir.Get("env/" + k)
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, `"%s" not found in %s's environment`, k, a.Name)
 		}
 		return
@@ -226,7 +217,7 @@ func (a *App) GetRevisions() ([]*Revision, error) {
 	}
 
 	revisions := []*Revision{}
-	ch, errch := cp.GetSnapshotables(revs, func(name string) (cp.Snapshotable, error) {
+	ch, errch := getSnapshotables(revs, func(name string) (Snapshotable, error) {
 		return getRevision(a, name, sp)
 	})
 	for i := 0; i < len(revs); i++ {
@@ -248,12 +239,12 @@ func (a *App) GetProcs() (procs []*Proc, err error) {
 	}
 	names, err := sp.Getdir(a.dir.Prefix(procsPath))
 	if err != nil || len(names) == 0 {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = nil
 		}
 		return
 	}
-	ch, errch := cp.GetSnapshotables(names, func(name string) (cp.Snapshotable, error) {
+	ch, errch := getSnapshotables(names, func(name string) (Snapshotable, error) {
 		return getProc(a, name, sp)
 	})
 	for i := 0; i < len(names); i++ {
@@ -269,18 +260,14 @@ func (a *App) GetProcs() (procs []*Proc, err error) {
 
 // WatchEvent watches for events related to the app
 func (a *App) WatchEvent(listener chan *Event) {
-	ch := make(chan *Event)
-
-	go storeFromSnapshotable(a).WatchEvent(ch)
+	watchEvent(context.Background(), a.GetSnapshot(), listener, &EventFilter{App: a.Name})
+}
 
-	for e := range ch {
-		if e.Path.App != nil && *e.Path.App == a.Name {
-			listener <- e
-		}
-		if i, ok := e.Source.(*Instance); ok && i.AppName == a.Name {
-			listener <- e
-		}
-	}
+// WatchEventContext is like WatchEvent, but returns once ctx is done, see
+// Store.WatchEventRawContext.
+func (a *App) WatchEventContext(ctx context.Context, listener chan *Event) (int64, error) {
+	defer close(listener)
+	return watchEvent(ctx, a.GetSnapshot(), listener, &EventFilter{App: a.Name})
 }
 
 func (a *App) String() string {
@@ -312,7 +299,7 @@ func (s *Store) GetApps() ([]*App, error) {
 	}
 
 	apps := []*App{}
-	ch, errch := cp.GetSnapshotables(names, func(name string) (cp.Snapshotable, error) {
+	ch, errch := getSnapshotables(names, func(name string) (Snapshotable, error) {
 		return getApp(name, sp)
 	})
 	for i := 0; i < len(names); i++ {
@@ -326,13 +313,13 @@ func (s *Store) GetApps() ([]*App, error) {
 	return apps, nil
 }
 
-func getApp(name string, s cp.Snapshotable) (*App, error) {
+func getApp(name string, s Snapshotable) (*App, error) {
 	sp := s.GetSnapshot()
 	app := storeFromSnapshotable(s).NewApp(name, "", "")
 
-	f, err := sp.GetFile(app.dir.Prefix("attrs"), new(cp.JsonCodec))
+	f, err := sp.getFile(app.dir.Prefix("attrs"), new(jsonCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, `app "%s" not found`, name)
 		}
 		return nil, err
@@ -344,16 +331,16 @@ func getApp(name string, s cp.Snapshotable) (*App, error) {
 	app.Stack = value["stack"].(string)
 	app.DeployType = value["deploy-type"].(string)
 
-	f, err = sp.GetFile(app.dir.Prefix("head"), new(cp.StringCodec))
+	f, err = sp.getFile(app.dir.Prefix("head"), new(stringCodec))
 	if err == nil {
 		app.Head = f.Value.(string)
-	} else if cp.IsErrNoEnt(err) {
+	} else if IsErrNoEnt(err) {
 		err = nil
 	}
 
-	f, err = app.dir.GetFile(registeredPath, new(cp.StringCodec))
+	f, err = app.dir.GetFile(registeredPath, new(stringCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, "registered not found for %s", app.Name)
 		}
 		return nil, err
@@ -0,0 +1,115 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+const (
+	RevClobber int64 = -1 // Set or Del regardless of the current file revision
+	RevMissing int64 = 0  // File revision reported for files which don't exist
+	RevDir     int64 = -2 // File revision reported for directories
+)
+
+// Backend is the interface implemented by coordinators which can hold
+// the visor registry. All paths passed to a Backend are absolute and
+// already include the root the Store was dialed with.
+//
+// Every read takes the revision of the coordinator at which it should be
+// performed. Writes take the revision the caller based its decision on and
+// must fail with ErrRevMismatch if the file was changed after it, unless
+// RevClobber is given. Errors for missing files or directories must be
+// reported as ErrNoEnt. Reads and waits at revisions whose history the
+// coordinator has discarded must fail with ErrCompacted.
+type Backend interface {
+	// Rev returns the current revision of the coordinator.
+	Rev() (int64, error)
+
+	// Get returns the body and file revision of the file at path.
+	Get(path string, rev int64) ([]byte, int64, error)
+
+	// Getdir returns the entry names of the directory at path.
+	Getdir(path string, rev int64) ([]string, error)
+
+	// Stat returns the body length of the file, or the number of entries
+	// of the directory at path, together with its file revision.
+	Stat(path string, rev int64) (int, int64, error)
+
+	// Set writes body to the file at path and returns the new revision.
+	Set(path string, rev int64, body []byte) (int64, error)
+
+	// Del removes the file or the whole directory tree at path. Removing
+	// a path which doesn't exist is not an error.
+	Del(path string, rev int64) error
+
+	// Commit applies all ops at a single revision, given none of the
+	// files they touch was changed after rev, and returns the new
+	// revision. Either all ops are applied or none of them.
+	Commit(ops []TxnOp, rev int64) (int64, error)
+
+	// Wait blocks until files matching glob change at or after rev and
+	// returns all matching changes of the first such revision. A single
+	// '*' matches one path segment, '**' matches any number of segments.
+	// Wait returns ctx.Err() as soon as ctx is done.
+	Wait(ctx context.Context, glob string, rev int64) ([]RawEvent, error)
+
+	// Getuid returns an id which is unique for the lifetime of the
+	// coordinator.
+	Getuid() (int64, error)
+
+	// Close releases all resources held by the backend.
+	Close() error
+}
+
+// A TxnOp is a single write of a transaction passed to Backend.Commit.
+// Del ops remove the whole directory tree at Path.
+type TxnOp struct {
+	Op   Op
+	Path string
+	Body []byte
+}
+
+// A BackendDialer creates a Backend from a coordinator uri.
+type BackendDialer func(uri string) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendDialer{}
+)
+
+// RegisterBackend makes a Backend available to DialUri for uris with
+// the given scheme, e.g. "doozer" for "doozer:?ca=localhost:8046". The
+// backends of the doozer and etcd packages register themselves when the
+// package is imported, the mem backend is always available.
+func RegisterBackend(scheme string, dial BackendDialer) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if dial == nil {
+		panic("visor: RegisterBackend dialer is nil")
+	}
+	if _, dup := backends[scheme]; dup {
+		panic("visor: RegisterBackend called twice for " + scheme)
+	}
+	backends[scheme] = dial
+}
+
+// DialBackend returns the Backend for uri, chosen by the uri scheme.
+func DialBackend(uri string) (Backend, error) {
+	scheme := strings.SplitN(uri, ":", 2)[0]
+
+	backendsMu.RLock()
+	dial, ok := backends[scheme]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, errorf(ErrInvalidArgument, "unknown backend scheme '%s' in %s", scheme, uri)
+	}
+	return dial(uri)
+}
@@ -0,0 +1,12 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor_test
+
+// The coordinators VISOR_TEST_URI can point at, see TestMain.
+import (
+	_ "github.com/soundcloud/visor/doozer"
+	_ "github.com/soundcloud/visor/etcd"
+)
@@ -0,0 +1,241 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Package backendtest checks implementations of visor.Backend.
+package backendtest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// Run checks the semantics every visor.Backend has to provide, using only
+// paths below root.
+func Run(t *testing.T, b visor.Backend, root string) {
+	p := root + "/apps/cat/attrs"
+
+	rev, err := b.Rev()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set & Get
+	rev1, err := b.Set(p, visor.RevMissing, []byte("meow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev1 <= rev {
+		t.Errorf("expected revision to increase: %d <= %d", rev1, rev)
+	}
+	body, frev, err := b.Get(p, rev1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "meow" || frev != rev1 {
+		t.Errorf("expected meow@%d, got %s@%d", rev1, body, frev)
+	}
+	_, _, err = b.Get(p, rev)
+	if !visor.IsErrNoEnt(err) {
+		t.Errorf("expected file to be missing before it was set, got %v", err)
+	}
+
+	// Compare-and-set
+	_, err = b.Set(p, visor.RevMissing, []byte("purr"))
+	if !visor.IsErrRevMismatch(err) {
+		t.Errorf("expected rev mismatch setting an existing file as missing, got %v", err)
+	}
+	rev2, err := b.Set(p, rev1, []byte("purr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Set(p, rev1, []byte("hiss"))
+	if !visor.IsErrRevMismatch(err) {
+		t.Errorf("expected rev mismatch for stale revision, got %v", err)
+	}
+	rev3, err := b.Set(p, visor.RevClobber, []byte("hiss"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err = b.Get(p, rev2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "purr" {
+		t.Errorf("expected purr at %d, got %s", rev2, body)
+	}
+
+	// Directories
+	_, err = b.Set(root+"/apps/dog/attrs", visor.RevClobber, []byte("woof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev4, err := b.Rev()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := b.Getdir(root+"/apps", rev4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"cat", "dog"}) {
+		t.Errorf("expected [cat dog], got %v", names)
+	}
+	names, err = b.Getdir(root+"/apps", rev3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"cat"}) {
+		t.Errorf("expected [cat] at %d, got %v", rev3, names)
+	}
+	n, frev, err := b.Stat(root+"/apps", rev4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || frev != visor.RevDir {
+		t.Errorf("expected dir with 2 entries, got %d entries and rev %d", n, frev)
+	}
+	_, _, err = b.Stat(root+"/apps/bird", rev4)
+	if !visor.IsErrNoEnt(err) {
+		t.Errorf("expected missing path, got %v", err)
+	}
+
+	// Wait
+	evch := make(chan visor.RawEvent, 1)
+	errch := make(chan error, 1)
+	go func() {
+		evs, err := b.Wait(context.Background(), root+"/apps/*/head", rev4+1)
+		if err != nil {
+			errch <- err
+			return
+		}
+		evch <- evs[0]
+	}()
+
+	_, err = b.Set(root+"/apps/cat/env/HOME", visor.RevClobber, []byte("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev5, err := b.Set(root+"/apps/cat/head", visor.RevClobber, []byte("128af9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-evch:
+		if !ev.IsSet() || ev.Path != root+"/apps/cat/head" || string(ev.Body) != "128af9" || ev.Rev != rev5 {
+			t.Errorf("unexpected event %s", ev)
+		}
+	case err := <-errch:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("expected event, got timeout")
+	}
+
+	evs, err := b.Wait(context.Background(), root+"/**", rev4+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := evs[0]; ev.Path != root+"/apps/cat/env/HOME" {
+		t.Errorf("expected ** to match nested path, got %s", ev)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = b.Wait(ctx, root+"/apps/fish/**", rev4+1)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected wait to end with its context, got %v", err)
+	}
+
+	// Del
+	err = b.Del(root+"/apps/cat", rev1)
+	if !visor.IsErrRevMismatch(err) {
+		t.Errorf("expected rev mismatch deleting a changed tree, got %v", err)
+	}
+	err = b.Del(root+"/apps/cat", visor.RevClobber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev6, err := b.Rev()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err = b.Getdir(root+"/apps", rev6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"dog"}) {
+		t.Errorf("expected [dog], got %v", names)
+	}
+	evs, err = b.Wait(context.Background(), root+"/apps/cat/attrs", rev5+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := evs[0]; !ev.IsDel() {
+		t.Errorf("expected delete event, got %s", ev)
+	}
+	err = b.Del(root+"/apps/cat", visor.RevClobber)
+	if err != nil {
+		t.Errorf("expected deleting a missing path to succeed, got %v", err)
+	}
+
+	// Commit
+	ops := []visor.TxnOp{
+		{Op: visor.OpSet, Path: root + "/apps/bird/attrs", Body: []byte("tweet")},
+		{Op: visor.OpSet, Path: root + "/apps/bird/registered", Body: []byte("now")},
+		{Op: visor.OpDel, Path: root + "/apps/dog"},
+	}
+	_, err = b.Commit(ops, rev3)
+	if !visor.IsErrRevMismatch(err) {
+		t.Errorf("expected rev mismatch committing over a changed tree, got %v", err)
+	}
+	rev7, err := b.Rev()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = b.Get(root+"/apps/bird/attrs", rev7)
+	if !visor.IsErrNoEnt(err) {
+		t.Errorf("expected failed commit not to write anything, got %v", err)
+	}
+	rev8, err := b.Commit(ops, rev7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err = b.Getdir(root+"/apps", rev8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"bird"}) {
+		t.Errorf("expected [bird], got %v", names)
+	}
+	evs, err = b.Wait(context.Background(), root+"/apps/**", rev7+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 3 {
+		t.Fatalf("expected all 3 changes of the commit, got %v", evs)
+	}
+	for _, ev := range evs {
+		if ev.Rev != rev8 {
+			t.Errorf("expected change at %d, got %s", rev8, ev)
+		}
+	}
+
+	// Getuid
+	id1, err := b.Getuid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := b.Getuid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 {
+		t.Errorf("expected unique ids, got %d twice", id1)
+	}
+}
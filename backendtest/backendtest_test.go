@@ -0,0 +1,16 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/soundcloud/visor"
+)
+
+func TestMemBackend(t *testing.T) {
+	Run(t, visor.NewMemBackend(), "/mem-test")
+}
@@ -0,0 +1,680 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Command visor inspects and operates the registry kept by visor in a
+// coordinator.
+//
+//	visor [-uri <uri>] [-root <root>] [-json] <command> [<args>]
+//
+// The uri and root default to $VISOR_URI and $VISOR_ROOT, or
+// visor.DefaultUri and visor.DefaultRoot. Results are printed as tables,
+// or with -json in the JSON encoding of the visor package. Run visor
+// without a command for the list of commands.
+//
+// Only the public API of the visor package is used, the commands double
+// as examples of it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/soundcloud/visor"
+	_ "github.com/soundcloud/visor/doozer"
+	_ "github.com/soundcloud/visor/etcd"
+)
+
+type command struct {
+	name string
+	args string
+	help string
+	run  func(c *cli, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "apps", args: "[<app>]", help: "list apps, or show one", run: (*cli).apps},
+		{name: "revs", args: "<app>", help: "list the revisions of an app", run: (*cli).revs},
+		{name: "envs", args: "<app>", help: "list the envs of an app", run: (*cli).envs},
+		{name: "procs", args: "<app>", help: "list the procs of an app", run: (*cli).procs},
+		{name: "instances", args: "[-status <status>,...] [-app <app>] [-proc <proc>] [-rev <rev>] [-env <env>] [-host <host>] [-claimer <host>] [-locked <bool>] [-min-restarts <n>] [-sort id|registered|restarts] [-reverse] [-offset <n>] [-limit <n>]", help: "list instances", run: (*cli).instances},
+		{name: "history", args: "<id>", help: "show the history of an instance", run: (*cli).history},
+		{name: "scale", args: "<app> <rev> <proc> [<env> <factor>]", help: "show the scale of a proc, or scale it", run: (*cli).scale},
+		{name: "runners", args: "[-host <host>]", help: "list runners", run: (*cli).runners},
+		{name: "services", args: "", help: "list loggers, proxies and pms", run: (*cli).services},
+		{name: "watch", args: "[-type <type>,...] [-app <app>] [-proc <proc>] [-rev <rev>] [-env <env>] [-instance <id>] [-since <rev>]", help: "print events until interrupted", run: (*cli).watch},
+		{name: "export", args: "[<file>]", help: "export the registry", run: (*cli).export},
+		{name: "import", args: "[<file>]", help: "import an export into an empty root", run: (*cli).importExport},
+		{name: "fsck", args: "[-repair]", help: "check the instances, and repair them", run: (*cli).fsck},
+		{name: "gc", args: "[-max-age <duration>] [-max-count <n>]", help: "remove finished instances of each proc", run: (*cli).gc},
+	}
+}
+
+var errUsage = errors.New("usage")
+
+type cli struct {
+	store  *visor.Store
+	ctx    context.Context
+	in     io.Reader
+	out    io.Writer
+	errOut io.Writer
+	json   bool
+}
+
+func main() {
+	uri := flag.String("uri", envOr("VISOR_URI", visor.DefaultUri), "coordinator uri")
+	root := flag.String("root", envOr("VISOR_ROOT", visor.DefaultRoot), "root of the registry")
+	jsonOut := flag.Bool("json", false, "print JSON instead of tables")
+	flag.Usage = func() {
+		usage(os.Stderr)
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	store, err := visor.DialUri(*uri, *root)
+	if err != nil {
+		fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := &cli{store: store, ctx: ctx, in: os.Stdin, out: os.Stdout, errOut: os.Stderr, json: *jsonOut}
+	err = c.run(flag.Args())
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: visor [-uri <uri>] [-root <root>] [-json] <command> [<args>]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.help)
+	}
+	tw.Flush()
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "visor: %s\n", err)
+	os.Exit(1)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// run runs the command named by args[0] on the latest revision of the
+// Store.
+func (c *cli) run(args []string) error {
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		store, err := c.store.FastForward()
+		if err != nil {
+			return err
+		}
+		c.store = store
+
+		err = cmd.run(c, args[1:])
+		if err == errUsage {
+			fmt.Fprintf(c.errOut, "usage: visor %s %s\n", cmd.name, cmd.args)
+		}
+		return err
+	}
+	fmt.Fprintf(c.errOut, "visor: unknown command %s\n", args[0])
+	usage(c.errOut)
+	return errUsage
+}
+
+// parse parses the flags of a command and checks the number of remaining
+// arguments.
+func parse(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// Apps
+
+func (c *cli) apps(args []string) error {
+	args, err := parse(flag.NewFlagSet("apps", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		app, err := c.store.GetApp(args[0])
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(app)
+		}
+		rows := [][]string{
+			{"name", app.Name},
+			{"repo", app.RepoUrl},
+			{"stack", app.Stack},
+			{"head", app.Head},
+			{"deploy-type", app.DeployType},
+			{"registered", formatTime(app.Registered)},
+		}
+		for _, k := range sortedKeys(app.Env) {
+			rows = append(rows, []string{"env", k + "=" + app.Env[k]})
+		}
+		return c.table(nil, rows)
+	}
+
+	apps, err := c.store.GetApps()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(apps)
+	}
+	rows := [][]string{}
+	for _, app := range apps {
+		rows = append(rows, []string{app.Name, app.Stack, app.DeployType, app.Head, app.RepoUrl})
+	}
+	return c.table([]string{"NAME", "STACK", "DEPLOY", "HEAD", "REPO"}, rows)
+}
+
+func (c *cli) getApp(args []string, name string) (*visor.App, error) {
+	args, err := parse(flag.NewFlagSet(name, flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.store.GetApp(args[0])
+}
+
+func (c *cli) revs(args []string) error {
+	app, err := c.getApp(args, "revs")
+	if err != nil {
+		return err
+	}
+	revs, err := app.GetRevisions()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(revs)
+	}
+	rows := [][]string{}
+	for _, rev := range revs {
+		rows = append(rows, []string{rev.Ref, rev.ArchiveUrl, formatTime(rev.Registered)})
+	}
+	return c.table([]string{"REF", "ARCHIVE", "REGISTERED"}, rows)
+}
+
+func (c *cli) envs(args []string) error {
+	app, err := c.getApp(args, "envs")
+	if err != nil {
+		return err
+	}
+	envs, err := app.GetEnvs()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(envs)
+	}
+	rows := [][]string{}
+	for _, env := range envs {
+		vars := []string{}
+		for _, k := range sortedKeys(env.Vars) {
+			vars = append(vars, k+"="+env.Vars[k])
+		}
+		rows = append(rows, []string{env.Ref, strings.Join(vars, " "), formatTime(env.Registered)})
+	}
+	return c.table([]string{"REF", "VARS", "REGISTERED"}, rows)
+}
+
+func (c *cli) procs(args []string) error {
+	app, err := c.getApp(args, "procs")
+	if err != nil {
+		return err
+	}
+	procs, err := app.GetProcs()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(procs)
+	}
+	rows := [][]string{}
+	for _, proc := range procs {
+		mem := "-"
+		if limit := proc.Attrs.Limits.MemoryLimitMb; limit != nil {
+			mem = strconv.Itoa(*limit) + "M"
+		}
+		rows = append(rows, []string{proc.Name, strconv.Itoa(proc.Port), mem, formatTime(proc.Registered)})
+	}
+	return c.table([]string{"NAME", "PORT", "MEMORY", "REGISTERED"}, rows)
+}
+
+// Instances
+
+func (c *cli) instances(args []string) error {
+	fs := flag.NewFlagSet("instances", flag.ContinueOnError)
+	q := visor.Query{}
+	status := fs.String("status", "", "")
+	fs.StringVar(&q.App, "app", "", "")
+	fs.StringVar(&q.Proc, "proc", "", "")
+	fs.StringVar(&q.Revision, "rev", "", "")
+	fs.StringVar(&q.Env, "env", "", "")
+	fs.StringVar(&q.Host, "host", "", "")
+	fs.StringVar(&q.Claimer, "claimer", "", "")
+	locked := fs.String("locked", "", "")
+	minRestarts := fs.Int("min-restarts", 0, "")
+	order := fs.String("sort", "", "")
+	fs.BoolVar(&q.Reverse, "reverse", false, "")
+	fs.IntVar(&q.Offset, "offset", 0, "")
+	fs.IntVar(&q.Limit, "limit", 0, "")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	for _, s := range strings.Split(*status, ",") {
+		if s != "" {
+			q.Status = append(q.Status, visor.InsStatus(s))
+		}
+	}
+	if *locked != "" {
+		l, err := strconv.ParseBool(*locked)
+		if err != nil {
+			return errUsage
+		}
+		q.Locked = &l
+	}
+	if *minRestarts > 0 {
+		q.MinRestarts = minRestarts
+	}
+	q.Sort = visor.SortOrder(*order)
+
+	instances, err := c.store.FindInstances(q)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(instances)
+	}
+	rows := [][]string{}
+	for _, ins := range instances {
+		port := ""
+		if ins.Port != 0 {
+			port = strconv.Itoa(ins.Port)
+		}
+		rows = append(rows, []string{
+			ins.IdString(), ins.AppName, ins.RevisionName, ins.ProcessName, ins.Env,
+			string(ins.Status), ins.Ip, port, ins.Host,
+		})
+	}
+	return c.table([]string{"ID", "APP", "REV", "PROC", "ENV", "STATUS", "IP", "PORT", "HOST"}, rows)
+}
+
+func (c *cli) scale(args []string) error {
+	args, err := parse(flag.NewFlagSet("scale", flag.ContinueOnError), args, 3, 5)
+	if err != nil {
+		return err
+	}
+	app, rev, proc := args[0], args[1], args[2]
+
+	if len(args) == 3 {
+		factor, _, err := c.store.GetScale(app, rev, proc)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(map[string]int{"factor": factor})
+		}
+		fmt.Fprintln(c.out, factor)
+		return nil
+	}
+	if len(args) != 5 {
+		return errUsage
+	}
+	factor, err := strconv.Atoi(args[4])
+	if err != nil || factor < 0 {
+		return fmt.Errorf("invalid factor '%s'", args[4])
+	}
+	instances, current, err := c.store.Scale(app, rev, proc, args[3], factor)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{"factor": factor, "previous": current, "instances": instances})
+	}
+	fmt.Fprintf(c.out, "%s %s %s scaled from %d to %d\n", app, rev, proc, current, factor)
+	return nil
+}
+
+func (c *cli) history(args []string) error {
+	args, err := parse(flag.NewFlagSet("history", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	history, err := c.store.GetInstanceHistory(id)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(history)
+	}
+	rows := [][]string{}
+	for _, e := range history {
+		addr := e.Ip
+		if e.Port != 0 {
+			addr = fmt.Sprintf("%s:%d", e.Ip, e.Port)
+		}
+		count := ""
+		if e.Count != 0 {
+			count = strconv.Itoa(e.Count)
+		}
+		rows = append(rows, []string{e.Time.Format(time.RFC3339), string(e.Event), e.Host, addr, count, e.Reason})
+	}
+	return c.table([]string{"TIME", "EVENT", "HOST", "ADDR", "COUNT", "REASON"}, rows)
+}
+
+// Runners and services
+
+func (c *cli) runners(args []string) error {
+	fs := flag.NewFlagSet("runners", flag.ContinueOnError)
+	host := fs.String("host", "", "")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	var (
+		runners []*visor.Runner
+		err     error
+	)
+	if *host != "" {
+		runners, err = c.store.RunnersByHost(*host)
+	} else {
+		runners, err = c.store.Runners()
+	}
+	if visor.IsErrNoEnt(err) {
+		runners, err = []*visor.Runner{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(runners)
+	}
+	rows := [][]string{}
+	for _, r := range runners {
+		rows = append(rows, []string{r.Addr, strconv.FormatInt(r.InstanceId, 10)})
+	}
+	return c.table([]string{"ADDR", "INSTANCE"}, rows)
+}
+
+func (c *cli) services(args []string) error {
+	if _, err := parse(flag.NewFlagSet("services", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	services := map[visor.ServiceType][]string{}
+	for t, get := range map[visor.ServiceType]func() ([]string, error){
+		visor.ServiceLogger: c.store.GetLoggers,
+		visor.ServiceProxy:  c.store.GetProxies,
+		visor.ServicePm:     c.store.GetPms,
+	} {
+		addrs, err := get()
+		if err != nil && !visor.IsErrNoEnt(err) {
+			return err
+		}
+		sort.Strings(addrs)
+		services[t] = addrs
+	}
+	if c.json {
+		return c.printJSON(services)
+	}
+	rows := [][]string{}
+	for _, t := range []visor.ServiceType{visor.ServiceLogger, visor.ServiceProxy, visor.ServicePm} {
+		for _, addr := range services[t] {
+			rows = append(rows, []string{string(t), addr})
+		}
+	}
+	return c.table([]string{"TYPE", "ADDR"}, rows)
+}
+
+// Events
+
+func (c *cli) watch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	types := fs.String("type", "", "")
+	f := &visor.EventFilter{}
+	fs.StringVar(&f.App, "app", "", "")
+	fs.StringVar(&f.Proc, "proc", "", "")
+	fs.StringVar(&f.Revision, "rev", "", "")
+	fs.StringVar(&f.Env, "env", "", "")
+	fs.Int64Var(&f.InstanceId, "instance", 0, "")
+	since := fs.Int64("since", 0, "")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	for _, t := range strings.Split(*types, ",") {
+		if t != "" {
+			f.Types = append(f.Types, visor.EventType(t))
+		}
+	}
+
+	l := make(chan *visor.Event)
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		if *since > 0 {
+			_, err = c.store.WatchEventFilterSince(c.ctx, *since, f, l)
+		} else {
+			_, err = c.store.WatchEventFilter(c.ctx, f, l)
+		}
+		errc <- err
+	}()
+
+	enc := json.NewEncoder(c.out)
+	for ev := range l {
+		if c.json {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(c.out, "%d %s %s %s\n", ev.Rev, ev.Type, ev.Path, ev.Body)
+	}
+	err := <-errc
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// Maintenance
+
+func (c *cli) export(args []string) error {
+	args, err := parse(flag.NewFlagSet("export", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return c.store.Export(c.out)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.store.Export(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *cli) importExport(args []string) error {
+	args, err := parse(flag.NewFlagSet("import", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	r := c.in
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	store, err := c.store.Import(r)
+	if err != nil {
+		return err
+	}
+	c.store = store
+	if c.json {
+		return c.printJSON(map[string]int64{"rev": store.GetSnapshot().Rev})
+	}
+	fmt.Fprintf(c.out, "imported at revision %d\n", store.GetSnapshot().Rev)
+	return nil
+}
+
+func (c *cli) fsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	findings, err := c.store.Fsck(*repair)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		if err := c.printJSON(findings); err != nil {
+			return err
+		}
+	} else {
+		rows := [][]string{}
+		for _, f := range findings {
+			repaired := "no"
+			if f.Repaired {
+				repaired = "yes"
+			}
+			rows = append(rows, []string{string(f.Kind), f.Path, f.Message, repaired})
+		}
+		if err := c.table([]string{"KIND", "PATH", "MESSAGE", "REPAIRED"}, rows); err != nil {
+			return err
+		}
+	}
+	left := 0
+	for _, f := range findings {
+		if !f.Repaired {
+			left++
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d inconsistencies left", left)
+	}
+	return nil
+}
+
+func (c *cli) gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	policy := visor.GCPolicy{}
+	fs.DurationVar(&policy.MaxAge, "max-age", 0, "")
+	fs.IntVar(&policy.MaxCount, "max-count", 0, "")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	// What was collected before a failure is listed all the same.
+	collected, err := c.store.GC(policy)
+	if len(collected) == 0 && err != nil {
+		return err
+	}
+	if c.json {
+		if perr := c.printJSON(collected); perr != nil {
+			return perr
+		}
+		return err
+	}
+	rows := [][]string{}
+	for _, col := range collected {
+		finished := ""
+		if !col.Finished.IsZero() {
+			finished = col.Finished.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{strconv.FormatInt(col.Id, 10), col.App, col.Proc, string(col.Status), finished})
+	}
+	if perr := c.table([]string{"ID", "APP", "PROC", "STATUS", "FINISHED"}, rows); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// Output
+
+func (c *cli) printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s\n", b)
+	return err
+}
+
+// table prints rows aligned in columns, below header if it's given.
+func (c *cli) table(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
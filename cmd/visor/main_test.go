@@ -0,0 +1,170 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+func cliSetup(t *testing.T) (*cli, *bytes.Buffer) {
+	s, err := visor.NewStore(visor.NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	return &cli{store: s, ctx: context.Background(), out: out, errOut: &bytes.Buffer{}}, out
+}
+
+func registrySetup(t *testing.T, s *visor.Store) *visor.Instance {
+	app := s.NewApp("cat", "git://cat.git", "whiskers")
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.NewRevision(app, "128af9", "http://archive/cat.tar.gz").Register(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.NewEnv("prod", map[string]string{"PORT": "80"}).Register(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.NewProc(app, "web").Register(); err != nil {
+		t.Fatal(err)
+	}
+	ins, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Started("10.0.0.1", "box", 9000, 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RegisterInstance("cat", "128af9", "web", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	return ins
+}
+
+func expectOutput(t *testing.T, c *cli, out *bytes.Buffer, args string, want ...string) {
+	out.Reset()
+	if err := c.run(strings.Fields(args)); err != nil {
+		t.Fatalf("visor %s: %s", args, err)
+	}
+	for _, w := range want {
+		if !strings.Contains(out.String(), w) {
+			t.Errorf("expected visor %s to print %q, got\n%s", args, w, out)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c, out := cliSetup(t)
+	ins := registrySetup(t, c.store)
+
+	expectOutput(t, c, out, "apps", "NAME", "cat", "whiskers", "git://cat.git")
+	expectOutput(t, c, out, "apps cat", "deploy-type", "lxc")
+	expectOutput(t, c, out, "revs cat", "128af9", "http://archive/cat.tar.gz")
+	expectOutput(t, c, out, "envs cat", "prod", "PORT=80")
+	expectOutput(t, c, out, "procs cat", "web")
+	expectOutput(t, c, out, "instances", ins.IdString(), "running", "pending")
+	expectOutput(t, c, out, "services", "TYPE")
+	expectOutput(t, c, out, "runners", "ADDR")
+	expectOutput(t, c, out, "history "+strconv.FormatInt(ins.Id, 10), "registered", "claimed", "started", "box", ":9000")
+
+	expectOutput(t, c, out, "instances -status running -host box")
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], ins.IdString()) {
+		t.Errorf("expected only instance %d, got\n%s", ins.Id, out)
+	}
+
+	expectOutput(t, c, out, "instances -app cat -proc web -status pending,running -sort id -reverse -limit 1")
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || strings.HasPrefix(lines[1], ins.IdString()) {
+		t.Errorf("expected only the newest instance, got\n%s", out)
+	}
+
+	expectOutput(t, c, out, "scale cat 128af9 web prod 3", "scaled from 2 to 3")
+	expectOutput(t, c, out, "scale cat 128af9 web", "3")
+
+	if err := c.run([]string{"revs"}); err != errUsage {
+		t.Errorf("expected missing app to be a usage error, got %v", err)
+	}
+	if err := c.run([]string{"apps", "dog"}); !visor.IsErrNotFound(err) {
+		t.Errorf("expected unknown app to be reported, got %v", err)
+	}
+	if err := c.run([]string{"bark"}); err != errUsage {
+		t.Errorf("expected unknown command to be a usage error, got %v", err)
+	}
+}
+
+func TestCommandsJSON(t *testing.T) {
+	c, out := cliSetup(t)
+	ins := registrySetup(t, c.store)
+	c.json = true
+
+	expectOutput(t, c, out, "instances -status running")
+	instances := []*visor.Instance{}
+	if err := json.Unmarshal(out.Bytes(), &instances); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Id != ins.Id || instances[0].Port != 9000 {
+		t.Errorf("expected instance %d, got %v", ins.Id, instances)
+	}
+
+	expectOutput(t, c, out, "apps")
+	apps := []*visor.App{}
+	if err := json.Unmarshal(out.Bytes(), &apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Name != "cat" {
+		t.Errorf("expected app cat, got %v", apps)
+	}
+}
+
+func TestExportImportFsck(t *testing.T) {
+	c, out := cliSetup(t)
+	registrySetup(t, c.store)
+
+	expectOutput(t, c, out, "export", `"name": "cat"`)
+	export := out.String()
+
+	s, err := visor.NewStore(visor.NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &cli{store: s, ctx: context.Background(), out: out, errOut: out, in: strings.NewReader(export)}
+	expectOutput(t, other, out, "import", "imported at revision")
+	expectOutput(t, other, out, "apps", "cat")
+	expectOutput(t, other, out, "fsck", "KIND")
+	expectOutput(t, other, out, "gc -max-age 24h -max-count 10", "ID")
+}
+
+func TestWatch(t *testing.T) {
+	c, out := cliSetup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx = ctx
+
+	since := c.store.GetSnapshot().Rev
+	if _, err := c.store.NewApp("cat", "git://cat.git", "whiskers").Register(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	expectOutput(t, c, out, "watch -type app-register -since "+strconv.FormatInt(since, 10), "app-register", "cat")
+}
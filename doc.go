@@ -16,6 +16,7 @@ With the new snapshot, we can perform an operation on this new state, and so on
   package main
 
   import "github.com/soundcloud/visor"
+  import _ "github.com/soundcloud/visor/doozer"
   import "log"
 
   func main() {
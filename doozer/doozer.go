@@ -0,0 +1,213 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Package doozer is the visor.Backend for doozerd clusters. Importing it
+// makes "doozer:" uris available to visor.DialUri.
+package doozer
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/soundcloud/doozer"
+	"github.com/soundcloud/visor"
+)
+
+const doozerUidPath = "/uid"
+
+func init() {
+	visor.RegisterBackend("doozer", dialDoozer)
+}
+
+// doozerBackend is the visor.Backend for doozerd clusters.
+type doozerBackend struct {
+	conn *doozer.Conn
+}
+
+func dialDoozer(uri string) (visor.Backend, error) {
+	conn, err := doozer.DialUri(uri, "")
+	if err != nil {
+		return nil, err
+	}
+	return &doozerBackend{conn}, nil
+}
+
+func (b *doozerBackend) Rev() (int64, error) {
+	return b.conn.Rev()
+}
+
+func (b *doozerBackend) Get(path string, rev int64) ([]byte, int64, error) {
+	body, frev, err := b.conn.Get(path, &rev)
+	if err != nil {
+		return nil, frev, doozerError(err, path)
+	}
+	switch frev {
+	case doozer.Missing:
+		return nil, visor.RevMissing, errorf(visor.ErrNoEnt, "%s not found", path)
+	case doozer.Dir:
+		return nil, visor.RevDir, errorf(visor.ErrInvalidFile, "%s is a directory", path)
+	}
+	return body, frev, nil
+}
+
+func (b *doozerBackend) Getdir(path string, rev int64) ([]string, error) {
+	names, err := b.conn.Getdir(path, rev, 0, -1)
+	if err != nil {
+		return nil, doozerError(err, path)
+	}
+	return names, nil
+}
+
+func (b *doozerBackend) Stat(path string, rev int64) (int, int64, error) {
+	n, frev, err := b.conn.Stat(path, &rev)
+	if err != nil {
+		return 0, frev, doozerError(err, path)
+	}
+	if frev == doozer.Missing {
+		return 0, visor.RevMissing, errorf(visor.ErrNoEnt, "%s not found", path)
+	}
+	return n, frev, nil
+}
+
+func (b *doozerBackend) Set(path string, rev int64, body []byte) (int64, error) {
+	newrev, err := b.conn.Set(path, rev, body)
+	if err != nil {
+		return newrev, doozerError(err, path)
+	}
+	return newrev, nil
+}
+
+// Del removes the file at path. Doozer has no notion of removing a
+// directory, so the tree is walked and every file removed on its own.
+func (b *doozerBackend) Del(p string, rev int64) error {
+	cur, err := b.conn.Rev()
+	if err != nil {
+		return err
+	}
+	_, frev, err := b.conn.Stat(p, &cur)
+	if err != nil {
+		return doozerError(err, p)
+	}
+
+	switch frev {
+	case doozer.Missing:
+		return nil
+	case doozer.Dir:
+		names, err := b.conn.Getdir(p, cur, 0, -1)
+		if err != nil {
+			return doozerError(err, p)
+		}
+		for _, name := range names {
+			if err = b.Del(path.Join(p, name), rev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = b.conn.Del(p, rev)
+	if err != nil {
+		return doozerError(err, p)
+	}
+	return nil
+}
+
+// Commit falls back to applying the ops one after another, as doozer has
+// no transactions spanning several files. All files written are checked
+// up front, but a failure half-way still leaves the earlier ops applied.
+func (b *doozerBackend) Commit(ops []visor.TxnOp, rev int64) (int64, error) {
+	cur, err := b.conn.Rev()
+	if err != nil {
+		return 0, err
+	}
+	if rev != visor.RevClobber {
+		for _, op := range ops {
+			if op.Op != visor.OpSet {
+				continue
+			}
+			_, frev, err := b.conn.Stat(op.Path, &cur)
+			if err != nil {
+				return 0, doozerError(err, op.Path)
+			}
+			if frev > rev {
+				return 0, errorf(visor.ErrRevMismatch, "%s has been changed", op.Path)
+			}
+		}
+	}
+
+	for _, op := range ops {
+		switch op.Op {
+		case visor.OpSet:
+			_, err = b.Set(op.Path, rev, op.Body)
+		case visor.OpDel:
+			err = b.Del(op.Path, rev)
+		default:
+			err = errorf(visor.ErrInvalidArgument, "invalid op %d for %s", op.Op, op.Path)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b.conn.Rev()
+}
+
+// Wait can't abort a pending doozer wait. When ctx is done it returns
+// right away, but the request stays open until a matching change happens.
+func (b *doozerBackend) Wait(ctx context.Context, glob string, rev int64) ([]visor.RawEvent, error) {
+	type result struct {
+		ev  doozer.Event
+		err error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		ev, err := b.conn.Wait(glob, rev)
+		ch <- result{ev, err}
+	}()
+
+	var r result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, doozerError(r.err, glob)
+	}
+	op := visor.OpSet
+	if r.ev.IsDel() {
+		op = visor.OpDel
+	}
+	return []visor.RawEvent{{Op: op, Path: r.ev.Path, Body: r.ev.Body, Rev: r.ev.Rev}}, nil
+}
+
+// Getuid uses the store revision of a write as the unique id.
+func (b *doozerBackend) Getuid() (int64, error) {
+	return b.conn.Set(doozerUidPath, doozer.Clobber, []byte{})
+}
+
+func (b *doozerBackend) Close() error {
+	b.conn.Close()
+	return nil
+}
+
+func doozerError(err error, path string) error {
+	if e, ok := err.(*doozer.Error); ok {
+		switch e.Err {
+		case doozer.ErrNoEnt:
+			return errorf(visor.ErrNoEnt, "%s not found", path)
+		case doozer.ErrRevMismatch:
+			return errorf(visor.ErrRevMismatch, "%s has been changed", path)
+		case doozer.ErrTooLate:
+			return errorf(visor.ErrCompacted, "history of %s has been compacted", path)
+		}
+	}
+	return err
+}
+
+func errorf(err error, format string, args ...interface{}) error {
+	return visor.NewError(err, fmt.Sprintf(format, args...))
+}
@@ -6,7 +6,6 @@
 package visor
 
 import (
-	cp "github.com/soundcloud/cotterpin"
 	"strings"
 	"time"
 )
@@ -17,7 +16,7 @@ const (
 )
 
 type Env struct {
-	dir        *cp.Dir
+	dir        *dir
 	App        *App
 	Ref        string
 	Vars       map[string]string
@@ -28,14 +27,14 @@ type Env struct {
 func (a *App) NewEnv(ref string, vars map[string]string) *Env {
 	path := a.dir.Prefix(envsPath, ref)
 	return &Env{
-		dir:  cp.NewDir(path, a.GetSnapshot()),
+		dir:  newDir(path, a.GetSnapshot()),
 		App:  a,
 		Ref:  ref,
 		Vars: vars,
 	}
 }
 
-func (e *Env) GetSnapshot() cp.Snapshot {
+func (e *Env) GetSnapshot() Snapshot {
 	return e.dir.Snapshot
 }
 
@@ -63,20 +62,20 @@ func (e *Env) Register() (*Env, error) {
 		}
 	}
 
-	attrs := cp.NewFile(e.dir.Prefix(varsPath), e.Vars, new(cp.JsonCodec), sp)
-	attrs, err = attrs.Save()
-	if err != nil {
-		return nil, err
-	}
-
 	reg := time.Now()
-	d, err := e.dir.Set(registeredPath, formatTime(reg))
+
+	sp, err = sp.Txn().
+		setValue(e.dir.Prefix(varsPath), e.Vars, new(jsonCodec)).
+		Set(e.dir.Prefix(registeredPath), formatTime(reg)).
+		Commit()
+	if IsErrRevMismatch(err) {
+		return nil, errorf(ErrConflict, `env "%s" can't be overwritten`, e.Ref)
+	}
 	if err != nil {
 		return nil, err
 	}
 	e.Registered = reg
-
-	e.dir = d
+	e.dir = e.dir.Join(sp)
 
 	return e, nil
 }
@@ -94,7 +93,8 @@ func (e *Env) Unregister() error {
 	if !exists {
 		return errorf(ErrNotFound, `env "%s" not found`, e.Ref)
 	}
-	return e.dir.Join(sp).Del("/")
+	_, err = sp.Txn().Del(e.dir.Name).Commit()
+	return err
 }
 
 // GetEnv retrieves the Env for the passed ref.
@@ -119,7 +119,7 @@ func (a *App) GetEnvs() ([]*Env, error) {
 	}
 
 	envs := []*Env{}
-	ch, errch := cp.GetSnapshotables(refs, func(ref string) (cp.Snapshotable, error) {
+	ch, errch := getSnapshotables(refs, func(ref string) (Snapshotable, error) {
 		return getEnv(a, ref, sp)
 	})
 	for i := 0; i < len(refs); i++ {
@@ -133,24 +133,24 @@ func (a *App) GetEnvs() ([]*Env, error) {
 	return envs, nil
 }
 
-func getEnv(app *App, ref string, s cp.Snapshotable) (*Env, error) {
+func getEnv(app *App, ref string, s Snapshotable) (*Env, error) {
 	e := &Env{
-		dir: cp.NewDir(app.dir.Prefix(envsPath, ref), s.GetSnapshot()),
+		dir: newDir(app.dir.Prefix(envsPath, ref), s.GetSnapshot()),
 		App: app,
 		Ref: ref,
 	}
 
-	_, err := e.dir.GetFile(varsPath, &cp.JsonCodec{DecodedVal: &e.Vars})
+	_, err := e.dir.GetFile(varsPath, &jsonCodec{DecodedVal: &e.Vars})
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, `vars not found for "%s"`, ref)
 		}
 		return nil, err
 	}
 
-	f, err := e.dir.GetFile(registeredPath, new(cp.StringCodec))
+	f, err := e.dir.GetFile(registeredPath, new(stringCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, `registered not found for %s`, ref)
 		}
 		return nil, err
@@ -8,7 +8,8 @@ package visor
 import (
 	"errors"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
+	"sort"
+	"strings"
 )
 
 var (
@@ -21,6 +22,10 @@ var (
 	ErrBadProcName     = errors.New("invalid proc type name: only alphanumeric chars allowed")
 	ErrUnauthorized    = errors.New("operation is not permitted")
 	ErrNotFound        = errors.New("object not found")
+	ErrNoEnt           = errors.New("file not found")
+	ErrRevMismatch     = errors.New("revision mismatch")
+	ErrSchemaMism      = errors.New("schema mismatch")
+	ErrCompacted       = errors.New("revision has been compacted")
 )
 
 type Error struct {
@@ -36,48 +41,103 @@ func (e *Error) Error() string {
 	return e.Message
 }
 
-func IsErrConflict(e error) bool {
-	return e.(*Error).Err == ErrConflict
+// A StateError is returned for a change of an instance which its status
+// doesn't allow, see InsStatus.CanTransition. Its cause is ErrInvalidState.
+type StateError struct {
+	Id   int64
+	From InsStatus
+	To   InsStatus
 }
 
-func IsErrUnauthorized(err error) bool {
-	switch pe := err.(type) {
-	case nil:
-		return false
-	case *Error:
-		err = pe.Err
+func (e *StateError) Error() string {
+	return fmt.Sprintf("instance %d can't go from %s to %s", e.Id, e.From, e.To)
+}
+
+// InstancesError is returned by GetInstances with the errors of all
+// instances which couldn't be read, keyed by instance id.
+type InstancesError map[int64]error
+
+func (e InstancesError) Error() string {
+	ids := Int64Slice{}
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+
+	msgs := []string{}
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("instance %d: %s", id, e[id]))
 	}
-	return err == ErrUnauthorized
+	return strings.Join(msgs, "\n")
 }
 
-func IsErrNotFound(e error) bool {
-	switch e.(type) {
-	case *cp.Error:
-		return e.(*cp.Error).Err == cp.ErrNoEnt
-	case *Error:
-		return e.(*Error).Err == ErrNotFound
+func IsErrConflict(err error) bool {
+	return errCause(err) == ErrConflict
+}
+
+func IsErrUnauthorized(err error) bool {
+	return errCause(err) == ErrUnauthorized
+}
+
+func IsErrNotFound(err error) bool {
+	if _, ok := err.(InstancesError); ok {
+		return true
 	}
-	return false
+	cause := errCause(err)
+	return cause == ErrNotFound || cause == ErrNoEnt
 }
 
-func IsErrInsClaimed(e error) bool {
-	return e.(*Error).Err == ErrInsClaimed
+// IsErrNoEnt checks if the backend reported a missing file or directory.
+func IsErrNoEnt(err error) bool {
+	return errCause(err) == ErrNoEnt
 }
 
-func IsErrInvalidState(e error) bool {
-	return e == ErrInvalidState
+// IsErrRevMismatch checks if a write failed because the file was changed
+// after the revision it was based on.
+func IsErrRevMismatch(err error) bool {
+	return errCause(err) == ErrRevMismatch
 }
 
-func IsErrInvalidFile(e error) bool {
-	return e.(*Error).Err == ErrInvalidFile
+// IsErrCompacted checks if a read or wait failed because the coordinator
+// doesn't retain the history of the requested revision anymore.
+func IsErrCompacted(err error) bool {
+	return errCause(err) == ErrCompacted
 }
 
-func IsErrInvalidArgument(e error) bool {
-	return e.(*Error).Err == ErrInvalidArgument
+func IsErrSchemaMism(err error) bool {
+	return errCause(err) == ErrSchemaMism
 }
 
-func IsErrInvalidKey(e error) bool {
-	return e.(*Error).Err == ErrInvalidKey
+func IsErrInsClaimed(err error) bool {
+	return errCause(err) == ErrInsClaimed
+}
+
+func IsErrInvalidState(err error) bool {
+	return errCause(err) == ErrInvalidState
+}
+
+func IsErrInvalidFile(err error) bool {
+	return errCause(err) == ErrInvalidFile
+}
+
+func IsErrInvalidArgument(err error) bool {
+	return errCause(err) == ErrInvalidArgument
+}
+
+func IsErrInvalidKey(err error) bool {
+	return errCause(err) == ErrInvalidKey
+}
+
+// errCause returns the error err stands for, which the IsErr functions
+// compare against.
+func errCause(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return e.Err
+	case *StateError:
+		return ErrInvalidState
+	}
+	return err
 }
 
 func errorf(err error, format string, args ...interface{}) *Error {
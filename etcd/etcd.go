@@ -0,0 +1,334 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Package etcd is the visor.Backend for etcd v3 clusters. Importing it
+// makes "etcd://" uris available to visor.DialUri.
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/visor"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	etcdUidPath        = "/uid"
+	etcdDefaultAddr    = "localhost:2379"
+	etcdDialTimeout    = 5 * time.Second
+	etcdRequestTimeout = 10 * time.Second
+)
+
+func init() {
+	visor.RegisterBackend("etcd", dialEtcd)
+}
+
+// etcdBackend is the visor.Backend for etcd v3 clusters. Visor paths are used
+// as etcd keys as they are, directories only exist implicitly through the
+// keys below them. File revisions are the mod revisions of the keys.
+type etcdBackend struct {
+	client *clientv3.Client
+}
+
+// dialEtcd connects to the endpoints given in the uri, which has the form
+// "etcd://host:port[,host:port...]". Without endpoints localhost:2379 is
+// used.
+func dialEtcd(uri string) (visor.Backend, error) {
+	addrs := strings.TrimPrefix(strings.TrimPrefix(uri, "etcd:"), "//")
+	addrs = strings.SplitN(addrs, "?", 2)[0]
+
+	endpoints := []string{}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr != "" {
+			endpoints = append(endpoints, addr)
+		}
+	}
+	if len(endpoints) == 0 {
+		endpoints = []string{etcdDefaultAddr}
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdBackend{client}, nil
+}
+
+func (b *etcdBackend) Rev() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := b.client.Get(ctx, etcdUidPath, clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func (b *etcdBackend) Get(path string, rev int64) ([]byte, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := b.client.Get(ctx, path, clientv3.WithRev(rev))
+	if err != nil {
+		return nil, visor.RevMissing, etcdError(err)
+	}
+	if len(resp.Kvs) > 0 {
+		kv := resp.Kvs[0]
+		return kv.Value, kv.ModRevision, nil
+	}
+
+	resp, err = b.client.Get(ctx, etcdDirPrefix(path), clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithCountOnly())
+	if err != nil {
+		return nil, visor.RevMissing, etcdError(err)
+	}
+	if resp.Count > 0 {
+		return nil, visor.RevDir, errorf(visor.ErrInvalidFile, "%s is a directory", path)
+	}
+	return nil, visor.RevMissing, errorf(visor.ErrNoEnt, "%s not found", path)
+}
+
+func (b *etcdBackend) Getdir(path string, rev int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	prefix := etcdDirPrefix(path)
+
+	resp, err := b.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, etcdError(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errorf(visor.ErrNoEnt, "%s not found", path)
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+
+	for _, kv := range resp.Kvs {
+		name := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (b *etcdBackend) Stat(path string, rev int64) (int, int64, error) {
+	body, frev, err := b.Get(path, rev)
+	if err == nil {
+		return len(body), frev, nil
+	}
+	if frev != visor.RevDir {
+		return 0, frev, err
+	}
+	names, err := b.Getdir(path, rev)
+	if err != nil {
+		return 0, visor.RevMissing, err
+	}
+	return len(names), visor.RevDir, nil
+}
+
+func (b *etcdBackend) Set(path string, rev int64, body []byte) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	txn := b.client.Txn(ctx)
+	if rev != visor.RevClobber {
+		txn = txn.If(clientv3.Compare(clientv3.ModRevision(path), "<", rev+1))
+	}
+	resp, err := txn.Then(clientv3.OpPut(path, string(body))).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, errorf(visor.ErrRevMismatch, "%s has been changed", path)
+	}
+	return resp.Header.Revision, nil
+}
+
+// Del removes the key at path and all keys below it. Every key is removed
+// on its own, so that watchers see a change per file like they do with
+// the other backends.
+func (b *etcdBackend) Del(path string, rev int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := b.client.Get(ctx, path, clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	kvs := resp.Kvs
+
+	resp, err = b.client.Get(ctx, etcdDirPrefix(path), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	kvs = append(kvs, resp.Kvs...)
+
+	if rev != visor.RevClobber {
+		for _, kv := range kvs {
+			if kv.ModRevision > rev {
+				return errorf(visor.ErrRevMismatch, "%s has been changed", kv.Key)
+			}
+		}
+	}
+
+	for _, kv := range kvs {
+		key := string(kv.Key)
+
+		txn := b.client.Txn(ctx)
+		if rev != visor.RevClobber {
+			txn = txn.If(clientv3.Compare(clientv3.ModRevision(key), "<", rev+1))
+		}
+		resp, err := txn.Then(clientv3.OpDelete(key)).Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			return errorf(visor.ErrRevMismatch, "%s has been changed", key)
+		}
+	}
+	return nil
+}
+
+// Commit runs all ops in a single etcd transaction. Del ops remove the
+// key at their path and all keys below it.
+func (b *etcdBackend) Commit(ops []visor.TxnOp, rev int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	cmps := []clientv3.Cmp{}
+	puts := []clientv3.Op{}
+
+	for _, op := range ops {
+		switch op.Op {
+		case visor.OpSet:
+			if rev != visor.RevClobber {
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(op.Path), "<", rev+1))
+			}
+			puts = append(puts, clientv3.OpPut(op.Path, string(op.Body)))
+		case visor.OpDel:
+			prefix := etcdDirPrefix(op.Path)
+			if rev != visor.RevClobber {
+				cmps = append(cmps,
+					clientv3.Compare(clientv3.ModRevision(op.Path), "<", rev+1),
+					clientv3.Compare(clientv3.ModRevision(prefix), "<", rev+1).WithPrefix(),
+				)
+			}
+			puts = append(puts,
+				clientv3.OpDelete(op.Path),
+				clientv3.OpDelete(prefix, clientv3.WithPrefix()),
+			)
+		default:
+			return 0, errorf(visor.ErrInvalidArgument, "invalid op %d for %s", op.Op, op.Path)
+		}
+	}
+
+	resp, err := b.client.Txn(ctx).If(cmps...).Then(puts...).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, errorf(visor.ErrRevMismatch, "files changed after revision %d", rev)
+	}
+	return resp.Header.Revision, nil
+}
+
+// Wait watches the longest prefix of glob without wildcards and returns
+// the changes matching the whole glob. etcd delivers all changes of a
+// revision in the same watch response.
+func (b *etcdBackend) Wait(ctx context.Context, glob string, rev int64) ([]visor.RawEvent, error) {
+	re, err := visor.GlobRegexp(glob)
+	if err != nil {
+		return nil, err
+	}
+	if rev < 1 {
+		rev = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	prefix := glob
+	if i := strings.Index(glob, "*"); i >= 0 {
+		prefix = glob[:i]
+	}
+
+	for resp := range b.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev)) {
+		if err := resp.Err(); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, etcdError(err)
+		}
+		evs := []visor.RawEvent{}
+
+		for _, ev := range resp.Events {
+			path := string(ev.Kv.Key)
+			if !re.MatchString(path) {
+				continue
+			}
+			if len(evs) > 0 && ev.Kv.ModRevision != evs[0].Rev {
+				break
+			}
+			if ev.Type == clientv3.EventTypeDelete {
+				evs = append(evs, visor.RawEvent{Op: visor.OpDel, Path: path, Rev: ev.Kv.ModRevision})
+			} else {
+				evs = append(evs, visor.RawEvent{Op: visor.OpSet, Path: path, Body: ev.Kv.Value, Rev: ev.Kv.ModRevision})
+			}
+		}
+		if len(evs) > 0 {
+			return evs, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errorf(visor.ErrInvalidState, "watch on %s was closed", glob)
+}
+
+// Getuid uses the revision of a write as the unique id.
+func (b *etcdBackend) Getuid() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := b.client.Put(ctx, etcdUidPath, "")
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func (b *etcdBackend) Close() error {
+	return b.client.Close()
+}
+
+// etcdError maps etcd errors with a visor equivalent.
+func etcdError(err error) error {
+	if err == rpctypes.ErrCompacted {
+		return errorf(visor.ErrCompacted, "%s", err)
+	}
+	return err
+}
+
+func etcdDirPrefix(path string) string {
+	return strings.TrimSuffix(path, "/") + "/"
+}
+
+func errorf(err error, format string, args ...interface{}) error {
+	return visor.NewError(err, fmt.Sprintf(format, args...))
+}
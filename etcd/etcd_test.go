@@ -0,0 +1,179 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+	"github.com/soundcloud/visor/backendtest"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// etcdSetup starts an embedded etcd server and returns its uri.
+func etcdSetup(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+
+	clientUrl := url.URL{Scheme: "http", Host: freeAddr(t)}
+	peerUrl := url.URL{Scheme: "http", Host: freeAddr(t)}
+
+	cfg.ListenClientUrls = []url.URL{clientUrl}
+	cfg.AdvertiseClientUrls = []url.URL{clientUrl}
+	cfg.ListenPeerUrls = []url.URL{peerUrl}
+	cfg.AdvertisePeerUrls = []url.URL{peerUrl}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerUrl.String())
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd didn't start")
+	}
+
+	return "etcd://" + clientUrl.Host
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestEtcdBackend(t *testing.T) {
+	b, err := visor.DialBackend(etcdSetup(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	backendtest.Run(t, b, "/etcd-test")
+}
+
+func TestEtcdStore(t *testing.T) {
+	s, err := visor.DialUri(etcdSetup(t), "/etcd-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := s.NewApp("cat", "git://cat.git", "my-stack").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := s.NewRevision(app, "master", "foo.img").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := s.NewProc(app, "web").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := app.NewEnv("default", map[string]string{}).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc2, err := s.NewProc(app, "worker").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proc2.Port != proc.Port+1 {
+		t.Errorf("expected port %d to be claimed, got %d", proc.Port+1, proc2.Port)
+	}
+
+	l := make(chan *visor.Instance)
+	errch := make(chan error)
+	go s.WatchInstanceStart(l, errch)
+
+	tickets, _, err := s.Scale(app.Name, rev.Ref, proc.Name, env.Ref, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 2 {
+		t.Fatalf("expected 2 tickets, got %d", len(tickets))
+	}
+
+	for range tickets {
+		select {
+		case ins := <-l:
+			if ins.AppName != app.Name {
+				t.Errorf("expected instance of %s, got %s", app.Name, ins)
+			}
+		case err := <-errch:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("expected instance start, got timeout")
+		}
+	}
+
+	ins := tickets[0]
+
+	_, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Claim("10.0.0.2")
+	if err == nil || !visor.IsErrInsClaimed(err) {
+		t.Errorf("expected second claim to fail, got %v", err)
+	}
+
+	scale, _, err := s.GetScale(app.Name, rev.Ref, proc.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale != 2 {
+		t.Errorf("expected scale 2, got %d", scale)
+	}
+}
+
+func TestEtcdBackendCompacted(t *testing.T) {
+	b, err := visor.DialBackend(etcdSetup(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	rev1, err := b.Set("/cat", visor.RevMissing, []byte("meow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := b.Set("/cat", rev1, []byte("purr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.(*etcdBackend).client.Compact(context.Background(), rev2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = b.Get("/cat", rev1)
+	if !visor.IsErrCompacted(err) {
+		t.Errorf("expected read before compaction to fail, got %v", err)
+	}
+	_, err = b.Wait(context.Background(), "/**", rev1)
+	if !visor.IsErrCompacted(err) {
+		t.Errorf("expected wait before compaction to fail, got %v", err)
+	}
+}
@@ -6,8 +6,9 @@
 package visor
 
 import (
+	"context"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
+	"path"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -16,12 +17,17 @@ import (
 
 const charPat = `[-.[:alnum:]]`
 
+// EventData holds the parts of the path of an event. Only the fields the
+// path carries are set, and only those are encoded as JSON.
 type EventData struct {
-	App      *string
-	Instance *string
-	Proc     *string
-	Revision *string
-	Service  *string
+	App      *string `json:"app,omitempty"`
+	Env      *string `json:"env,omitempty"`
+	Host     *string `json:"host,omitempty"`
+	Instance *string `json:"instance,omitempty"`
+	Proc     *string `json:"proc,omitempty"`
+	Revision *string `json:"rev,omitempty"`
+	Runner   *string `json:"runner,omitempty"`
+	Service  *string `json:"service,omitempty"`
 }
 
 func (d EventData) String() string {
@@ -43,28 +49,50 @@ func (d EventData) String() string {
 type Event struct {
 	Type   EventType // Type of event
 	Body   string    // Body of the changed file
-	Source cp.Snapshotable
+	Source Snapshotable
 	Path   EventData
-	raw    *cp.Event // Original event returned by cotterpin
+	raw    *RawEvent // Original event returned by the backend
 	Rev    int64
 }
 
+// EventType classifies an Event. The Source of an event is the entity it
+// changed, as of the revision of the event. The Source of the removals
+// EvEnvUnreg, EvInsUnlock, EvRunnerUnreg and the service leaves is the
+// entity right before its removal, or nil if it was removed along with
+// its owner. The app, rev, proc and instance unregistrations carry no
+// Source.
 type EventType string
 
 const (
-	EvAppReg    = EventType("app-register")
-	EvAppUnreg  = EventType("app-unregister")
-	EvRevReg    = EventType("rev-register")
-	EvRevUnreg  = EventType("rev-unregister")
-	EvProcReg   = EventType("proc-register")
-	EvProcUnreg = EventType("proc-unregister")
-	EvInsReg    = EventType("instance-register")
-	EvInsUnreg  = EventType("instance-unregister")
-	EvInsStart  = EventType("instance-start")
-	EvInsFail   = EventType("instance-fail")
-	EvInsExit   = EventType("instance-exit")
-	EvInsLost   = EventType("instance-lost")
-	EvUnknown   = EventType("UNKNOWN")
+	EvAppReg      = EventType("app-register")
+	EvAppUnreg    = EventType("app-unregister")
+	EvRevReg      = EventType("rev-register")
+	EvRevUnreg    = EventType("rev-unregister")
+	EvProcReg     = EventType("proc-register")
+	EvProcUnreg   = EventType("proc-unregister")
+	EvEnvReg      = EventType("env-register")
+	EvEnvUnreg    = EventType("env-unregister")
+	EvInsReg      = EventType("instance-register")
+	EvInsUnreg    = EventType("instance-unregister")
+	EvInsClaim    = EventType("instance-claim")
+	EvInsUnclaim  = EventType("instance-unclaim")
+	EvInsStart    = EventType("instance-start")
+	EvInsStop     = EventType("instance-stop")
+	EvInsRestart  = EventType("instance-restart")
+	EvInsFail     = EventType("instance-fail")
+	EvInsExit     = EventType("instance-exit")
+	EvInsLost     = EventType("instance-lost")
+	EvInsLock     = EventType("instance-lock")
+	EvInsUnlock   = EventType("instance-unlock")
+	EvRunnerReg   = EventType("runner-register")
+	EvRunnerUnreg = EventType("runner-unregister")
+	EvLoggerJoin  = EventType("logger-join")
+	EvLoggerLeave = EventType("logger-leave")
+	EvProxyJoin   = EventType("proxy-join")
+	EvProxyLeave  = EventType("proxy-leave")
+	EvPmJoin      = EventType("pm-join")
+	EvPmLeave     = EventType("pm-leave")
+	EvUnknown     = EventType("UNKNOWN")
 )
 
 const (
@@ -77,20 +105,36 @@ const (
 	pathApp eventPath = iota
 	pathRev
 	pathProc
+	pathEnv
 	pathIns
 	pathInsStatus
 	pathInsStart
 	pathInsStop
+	pathInsClaim
+	pathInsRestarts
+	pathInsLock
+	pathRunner
+	pathLogger
+	pathProxy
+	pathPm
 )
 
 var eventPatterns = map[*regexp.Regexp]eventPath{
 	regexp.MustCompile("^/apps/(" + charPat + "+)/registered$"):                          pathApp,
 	regexp.MustCompile("^/apps/(" + charPat + "+)/revs/(" + charPat + "+)/registered$"):  pathRev,
 	regexp.MustCompile("^/apps/(" + charPat + "+)/procs/(" + charPat + "+)/registered$"): pathProc,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/envs/(" + charPat + "+)/registered$"):  pathEnv,
 	regexp.MustCompile("^/instances/([-0-9]+)/object$"):                                  pathIns,
 	regexp.MustCompile("^/instances/([-0-9]+)/status$"):                                  pathInsStatus,
 	regexp.MustCompile("^/instances/([-0-9]+)/start$"):                                   pathInsStart,
 	regexp.MustCompile("^/instances/([-0-9]+)/stop$"):                                    pathInsStop,
+	regexp.MustCompile("^/instances/([-0-9]+)/claims/(" + charPat + "+)$"):               pathInsClaim,
+	regexp.MustCompile("^/instances/([-0-9]+)/restarts$"):                                pathInsRestarts,
+	regexp.MustCompile("^/instances/([-0-9]+)/lock$"):                                    pathInsLock,
+	regexp.MustCompile("^/runners/(" + charPat + "+)/([0-9]+)$"):                         pathRunner,
+	regexp.MustCompile("^/loggers/(" + charPat + "+)$"):                                  pathLogger,
+	regexp.MustCompile("^/proxies/(" + charPat + "+)$"):                                  pathProxy,
+	regexp.MustCompile("^/pms/(" + charPat + "+)$"):                                      pathPm,
 }
 
 func (ev *Event) String() string {
@@ -100,54 +144,108 @@ func (ev *Event) String() string {
 // WatchEventRaw watches for changes to the registry and sends
 // them as *Event objects to the provided channel.
 func (s *Store) WatchEventRaw(listener chan *Event) error {
-	sp := s.GetSnapshot()
-	for {
-		ev, err := sp.Wait(globPlural)
-		if err != nil {
-			return err
-		}
-		sp = sp.Join(ev)
-
-		event, err := enrichEvent(&ev, ev)
-		if err != nil {
-			return err
-		}
+	_, err := watchEvent(context.Background(), s.GetSnapshot(), listener, nil)
+	return err
+}
 
-		listener <- event
-	}
-	return nil
+// WatchEventRawContext is like WatchEventRaw, but returns once ctx is done.
+// The listener is closed on return. The returned revision is the last one
+// whose events were all delivered; watching from there on misses nothing.
+func (s *Store) WatchEventRawContext(ctx context.Context, listener chan *Event) (int64, error) {
+	defer close(listener)
+	return watchEvent(ctx, s.GetSnapshot(), listener, nil)
 }
 
 // WatchEvent wraps WatchEventRaw with additional information.
 func (s *Store) WatchEvent(listener chan *Event) error {
-	sp := s.GetSnapshot()
-	for {
-		ev, err := sp.Wait(globPlural)
-		if err != nil {
-			return err
-		}
-		sp = sp.Join(ev)
+	_, err := watchEvent(context.Background(), s.GetSnapshot(), listener, &EventFilter{})
+	return err
+}
+
+// WatchEventContext is like WatchEvent, but returns once ctx is done, see
+// WatchEventRawContext.
+func (s *Store) WatchEventContext(ctx context.Context, listener chan *Event) (int64, error) {
+	defer close(listener)
+	return watchEvent(ctx, s.GetSnapshot(), listener, &EventFilter{})
+}
 
-		event, err := enrichEvent(&ev, ev)
+// WatchEventSince is like WatchEventContext, but starts right after rev
+// instead of the revision of the Store, replaying the events the
+// coordinator still retains. Pass the revision returned by the previous
+// watch, or the Rev of the last event processed. Events written by the
+// same transaction share their Rev; resuming after it skips the ones not
+// processed yet. If the history after rev has been discarded the watch
+// fails with ErrCompacted and the caller has to resync from the current
+// state of the registry.
+func (s *Store) WatchEventSince(ctx context.Context, rev int64, listener chan *Event) (int64, error) {
+	defer close(listener)
+	return watchEvent(ctx, Snapshot{rev, s.GetSnapshot().conn}, listener, &EventFilter{})
+}
+
+// WatchEventFilter is like WatchEventContext, but only delivers the events
+// matching f. Events are matched before they are canonicalized, so
+// discarded events cost at most a single read.
+func (s *Store) WatchEventFilter(ctx context.Context, f *EventFilter, listener chan *Event) (int64, error) {
+	defer close(listener)
+	return watchEvent(ctx, s.GetSnapshot(), listener, f)
+}
+
+// WatchEventFilterSince combines WatchEventFilter and WatchEventSince.
+func (s *Store) WatchEventFilterSince(ctx context.Context, rev int64, f *EventFilter, listener chan *Event) (int64, error) {
+	defer close(listener)
+	return watchEvent(ctx, Snapshot{rev, s.GetSnapshot().conn}, listener, f)
+}
+
+// watchEvent sends all events after sp matching f to listener, or all
+// events if f is nil.
+func watchEvent(ctx context.Context, sp Snapshot, listener chan *Event, f *EventFilter) (int64, error) {
+	glob := globPlural
+	if f != nil {
+		glob = f.glob()
+	}
+	for {
+		evs, err := sp.waitAll(ctx, glob)
 		if err != nil {
-			return err
+			return sp.Rev, err
 		}
+		for _, ev := range evs {
+			etype, data, err := classifyEvent(&ev)
+			if err != nil {
+				return sp.Rev, err
+			}
 
-		if event.Type == EvUnknown {
-			continue
+			if f != nil {
+				ok, err := f.match(&ev, etype, data)
+				if err != nil {
+					return sp.Rev, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			event, err := newEvent(&ev, etype, data, ev)
+			if err != nil {
+				return sp.Rev, err
+			}
+			select {
+			case listener <- event:
+			case <-ctx.Done():
+				return sp.Rev, ctx.Err()
+			}
 		}
-
-		listener <- event
+		sp = sp.Join(evs[0])
 	}
-	return nil
 }
 
-func canonicalizeMetadata(etype EventType, uncanonicalized EventData, s cp.Snapshotable) (source cp.Snapshotable, err error) {
+func canonicalizeMetadata(etype EventType, uncanonicalized EventData, s Snapshotable) (source Snapshotable, err error) {
 	var (
-		app  *App
-		rev  *Revision
-		proc *Proc
-		ins  *Instance
+		app    *App
+		rev    *Revision
+		proc   *Proc
+		env    *Env
+		ins    *Instance
+		runner *Runner
+		svc    *Service
 	)
 
 	if uncanonicalized.App != nil {
@@ -173,6 +271,13 @@ func canonicalizeMetadata(etype EventType, uncanonicalized EventData, s cp.Snaps
 		}
 	}
 
+	if uncanonicalized.Env != nil {
+		env, err = getEnv(app, *uncanonicalized.Env, s)
+		if err != nil {
+			return
+		}
+	}
+
 	if uncanonicalized.Instance != nil {
 		var id int64 = -1
 		if id, err = strconv.ParseInt(*uncanonicalized.Instance, 10, 64); err != nil {
@@ -183,6 +288,18 @@ func canonicalizeMetadata(etype EventType, uncanonicalized EventData, s cp.Snaps
 		}
 	}
 
+	if uncanonicalized.Runner != nil {
+		if runner, err = getRunner(*uncanonicalized.Runner, s); err != nil {
+			return
+		}
+	}
+
+	if uncanonicalized.Service != nil {
+		if svc, err = getService(serviceTypes[etype], *uncanonicalized.Service, s); err != nil {
+			return
+		}
+	}
+
 	switch etype {
 	case EvAppReg:
 		source = app
@@ -190,19 +307,45 @@ func canonicalizeMetadata(etype EventType, uncanonicalized EventData, s cp.Snaps
 		source = rev
 	case EvProcReg:
 		source = proc
-	case EvInsReg, EvInsStart, EvInsFail, EvInsExit, EvInsLost:
+	case EvEnvReg, EvEnvUnreg:
+		source = env
+	case EvInsReg, EvInsStart, EvInsFail, EvInsExit, EvInsLost,
+		EvInsClaim, EvInsUnclaim, EvInsStop, EvInsRestart, EvInsLock, EvInsUnlock:
 		source = ins
+	case EvRunnerReg, EvRunnerUnreg:
+		source = runner
+	case EvLoggerJoin, EvLoggerLeave, EvProxyJoin, EvProxyLeave, EvPmJoin, EvPmLeave:
+		source = svc
 	}
 
 	return
 }
 
-func enrichEvent(src *cp.Event, s cp.Snapshotable) (event *Event, err error) {
-	var canonicalized cp.Snapshotable
+// serviceTypes maps the service events to the type of their Source.
+var serviceTypes = map[EventType]ServiceType{
+	EvLoggerJoin:  ServiceLogger,
+	EvLoggerLeave: ServiceLogger,
+	EvProxyJoin:   ServiceProxy,
+	EvProxyLeave:  ServiceProxy,
+	EvPmJoin:      ServicePm,
+	EvPmLeave:     ServicePm,
+}
+
+func enrichEvent(src *RawEvent, s Snapshotable) (event *Event, err error) {
+	etype, uncanonicalized, err := classifyEvent(src)
+	if err != nil {
+		return nil, err
+	}
 
+	return newEvent(src, etype, uncanonicalized, s)
+}
+
+// classifyEvent derives the type and the data of an event from its path
+// and body. Only an emptied start file needs a read from the coordinator,
+// to tell an unclaim from the registration of the instance.
+func classifyEvent(src *RawEvent) (etype EventType, uncanonicalized EventData, err error) {
 	path := src.Path
-	etype := EvUnknown
-	uncanonicalized := EventData{}
+	etype = EvUnknown
 
 	for re, ev := range eventPatterns {
 		if match := re.FindStringSubmatch(path); match != nil {
@@ -233,6 +376,15 @@ func enrichEvent(src *cp.Event, s cp.Snapshotable) (event *Event, err error) {
 				} else if src.IsDel() {
 					etype = EvProcUnreg
 				}
+			case pathEnv:
+				uncanonicalized.App = &match[1]
+				uncanonicalized.Env = &match[2]
+
+				if src.IsSet() {
+					etype = EvEnvReg
+				} else if src.IsDel() {
+					etype = EvEnvUnreg
+				}
 			case pathIns:
 				uncanonicalized.Instance = &match[1]
 
@@ -249,7 +401,14 @@ func enrichEvent(src *cp.Event, s cp.Snapshotable) (event *Event, err error) {
 				}
 				body := string(src.Body)
 				if body == "" {
-					break
+					var claimed bool
+
+					// Registration writes an empty start file as well,
+					// only emptying a claimed one is an unclaim.
+					claimed, err = wasClaimed(src)
+					if claimed {
+						etype = EvInsUnclaim
+					}
 				} else {
 					fields := strings.Fields(body)
 					if len(fields) > 1 {
@@ -273,17 +432,141 @@ func enrichEvent(src *cp.Event, s cp.Snapshotable) (event *Event, err error) {
 				case InsStatusLost:
 					etype = EvInsLost
 				}
+			case pathInsStop:
+				uncanonicalized.Instance = &match[1]
+
+				if src.IsSet() {
+					etype = EvInsStop
+				}
+			case pathInsClaim:
+				uncanonicalized.Instance = &match[1]
+				uncanonicalized.Host = &match[2]
+
+				if !src.IsSet() {
+					break
+				}
+				// The claim is rewritten when it expires as well, only
+				// a claim of the host holding the start file is a claim.
+				var claimed bool
+				claimed, err = isClaimedBy(src, match[1], match[2])
+				if claimed {
+					etype = EvInsClaim
+				}
+			case pathInsRestarts:
+				uncanonicalized.Instance = &match[1]
+
+				if src.IsSet() {
+					etype = EvInsRestart
+				}
+			case pathInsLock:
+				uncanonicalized.Instance = &match[1]
+
+				if src.IsSet() {
+					etype = EvInsLock
+				} else if src.IsDel() {
+					etype = EvInsUnlock
+				}
+			case pathRunner:
+				addr := runnerAddr(match[1], match[2])
+				uncanonicalized.Host = &match[1]
+				uncanonicalized.Runner = &addr
+
+				if src.IsSet() {
+					etype = EvRunnerReg
+				} else if src.IsDel() {
+					etype = EvRunnerUnreg
+				}
+			case pathLogger:
+				uncanonicalized.Service = &match[1]
+
+				if src.IsSet() {
+					etype = EvLoggerJoin
+				} else if src.IsDel() {
+					etype = EvLoggerLeave
+				}
+			case pathProxy:
+				uncanonicalized.Service = &match[1]
+
+				if src.IsSet() {
+					etype = EvProxyJoin
+				} else if src.IsDel() {
+					etype = EvProxyLeave
+				}
+			case pathPm:
+				uncanonicalized.Service = &match[1]
+
+				if src.IsSet() {
+					etype = EvPmJoin
+				} else if src.IsDel() {
+					etype = EvPmLeave
+				}
 			}
 			break
 		}
 	}
+	return
+}
+
+// wasClaimed reports whether the start file changed by src was claimed
+// right before the change.
+func wasClaimed(src *RawEvent) (bool, error) {
+	sp := src.GetSnapshot()
+	sp.Rev = src.Rev - 1
+
+	val, _, err := sp.Get(src.Path)
+	if IsErrNoEnt(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return val != "", nil
+}
 
-	if src.IsSet() {
+// isClaimedBy reports whether the instance with the given id is claimed by
+// host at the revision of src.
+func isClaimedBy(src *RawEvent, id, host string) (bool, error) {
+	sp := src.GetSnapshot()
+
+	val, _, err := sp.Get(path.Join(instancesPath, id, startPath))
+	if IsErrNoEnt(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(val)
+	return len(fields) > 0 && fields[0] == host, nil
+}
+
+// hasPriorSource reports whether the Source of a removal is read right
+// before the removal.
+func hasPriorSource(etype EventType) bool {
+	switch etype {
+	case EvEnvUnreg, EvInsUnlock, EvRunnerUnreg, EvLoggerLeave, EvProxyLeave, EvPmLeave:
+		return true
+	}
+	return false
+}
+
+func newEvent(src *RawEvent, etype EventType, uncanonicalized EventData, s Snapshotable) (event *Event, err error) {
+	var canonicalized Snapshotable
+
+	switch {
+	case src.IsSet():
 		canonicalized, err = canonicalizeMetadata(etype, uncanonicalized, s)
-		if err != nil {
-			return nil, fmt.Errorf("error canonicalizing inputs: %s", err)
+	case hasPriorSource(etype):
+		sp := s.GetSnapshot()
+		sp.Rev = src.Rev - 1
+
+		canonicalized, err = canonicalizeMetadata(etype, uncanonicalized, sp)
+		if IsErrNotFound(err) {
+			canonicalized, err = nil, nil
 		}
 	}
+	if err != nil {
+		return nil, fmt.Errorf("error canonicalizing inputs: %s", err)
+	}
 
 	return &Event{
 		Type:   etype,
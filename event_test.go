@@ -6,8 +6,8 @@
 package visor
 
 import (
+	"context"
 	"errors"
-	cp "github.com/soundcloud/cotterpin"
 	"reflect"
 	"strconv"
 	"testing"
@@ -39,7 +39,7 @@ func eventAppSetup(s *Store, name string) *App {
 	return s.NewApp(name, "git://"+name, name+"stack")
 }
 
-func expectEvent(etype EventType, s cp.Snapshotable, l chan *Event, t *testing.T) (event *Event) {
+func expectEvent(etype EventType, s Snapshotable, l chan *Event, t *testing.T) (event *Event) {
 	for {
 		select {
 		case event = <-l:
@@ -262,8 +262,24 @@ func TestEventInstanceStateChange(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	stopped, err := s.RegisterInstance("statemouse", "stable-state", "web-state", "default-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stopped, err = stopped.Claim(ip); err != nil {
+		t.Fatal(err)
+	}
+	if stopped, err = stopped.Started(ip, host, port+1, tPort+1); err != nil {
+		t.Fatal(err)
+	}
+	if err = stopped.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = s.FastForward(); err != nil {
+		t.Fatal(err)
+	}
 
-	go storeFromSnapshotable(ins).WatchEvent(l)
+	go s.WatchEvent(l)
 
 	ins, err = ins.Started(ip, host, port, tPort)
 	if err != nil {
@@ -286,9 +302,289 @@ func TestEventInstanceStateChange(t *testing.T) {
 	}
 	expectEvent(EvInsFail, ins, l, t)
 
-	ins, err = ins.Exited(ip)
+	stopped, err = stopped.Exited(ip)
 	if err != nil {
 		t.Error(err)
 	}
-	expectEvent(EvInsExit, ins, l, t)
+	expectEvent(EvInsExit, stopped, l, t)
+}
+
+func TestWatchEventContext(t *testing.T) {
+	s, l := eventSetup()
+	app := eventAppSetup(s, "ctxcat")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	var rev int64
+
+	go func() {
+		var err error
+		rev, err = s.WatchEventContext(ctx, l)
+		done <- err
+	}()
+
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvAppReg, app, l, t)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected watch to be canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected watch to return after cancel")
+	}
+	if rev < ev.Rev {
+		t.Errorf("expected last revision to be at least %d, got %d", ev.Rev, rev)
+	}
+	if _, ok := <-l; ok {
+		t.Error("expected listener to be closed")
+	}
+}
+
+func TestWatchEventSince(t *testing.T) {
+	m := NewMemBackend()
+	s, err := NewStore(m, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat, err := eventAppSetup(s, "cat").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := cat.GetSnapshot().Rev
+
+	dog, err := eventAppSetup(s, "dog").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is still at its initial revision, the events are replayed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := make(chan *Event)
+	go s.WatchEventSince(ctx, since, l)
+
+	ev := expectEvent(EvAppReg, dog, l, t)
+	if *ev.Path.App != "dog" || ev.Rev != dog.GetSnapshot().Rev {
+		t.Errorf("expected registration of dog at %d, got %s", dog.GetSnapshot().Rev, ev)
+	}
+	cancel()
+
+	bird, err := eventAppSetup(s, "bird").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Compact(bird.GetSnapshot().Rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.WatchEventSince(context.Background(), since, make(chan *Event))
+	if !IsErrCompacted(err) {
+		t.Errorf("expected watch from compacted revision to fail, got %v", err)
+	}
+}
+
+func TestEventEnv(t *testing.T) {
+	s, l := eventSetup()
+	app, err := eventAppSetup(s, "envcat").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go storeFromSnapshotable(app).WatchEventContext(ctx, l)
+
+	env, err := app.NewEnv("prod", map[string]string{"HOME": "/home/cat"}).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvEnvReg, env, l, t)
+	if ev.Path.Env == nil || *ev.Path.Env != env.Ref {
+		t.Errorf("expected event for env %s, got %s", env.Ref, ev.Path)
+	}
+
+	err = env.Unregister()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = expectEvent(EvEnvUnreg, env, l, t)
+	if e, ok := ev.Source.(*Env); ok && e.Vars["HOME"] != "/home/cat" {
+		t.Errorf("expected env before its removal, got %#v", e)
+	}
+
+	_, err = app.NewEnv("dev", map[string]string{}).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvEnvReg, env, l, t)
+
+	// Envs removed along with their app may come without a Source.
+	err = app.Unregister()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, etype := range []EventType{EvEnvUnreg, EvAppUnreg} {
+		select {
+		case ev := <-l:
+			if ev.Type != etype {
+				t.Errorf("expected event %s, got %s", etype, ev.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %s, got timeout", etype)
+		}
+	}
+}
+
+func TestEventInstanceTransitions(t *testing.T) {
+	s, l := eventSetup()
+	host := "10.0.0.1"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchEventContext(ctx, l)
+
+	ins, err := s.RegisterInstance("transmouse", "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsReg, ins, l, t)
+
+	ins, err = ins.Claim(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvInsClaim, ins, l, t)
+	if ev.Path.Host == nil || *ev.Path.Host != host {
+		t.Errorf("expected claim by %s, got %s", host, ev.Path)
+	}
+
+	ins, err = ins.Unclaim(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = expectEvent(EvInsUnclaim, ins, l, t)
+	if i, ok := ev.Source.(*Instance); ok && i.Status != InsStatusPending {
+		t.Errorf("expected unclaimed instance to be pending, got %s", i.Status)
+	}
+
+	ins, err = ins.Claim(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsClaim, ins, l, t)
+
+	ins, err = ins.Started(host, "mouse.org", 9999, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsStart, ins, l, t)
+
+	ins, err = ins.Restarted(RestartFail, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsRestart, ins, l, t)
+
+	err = ins.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsStop, ins, l, t)
+
+	ins, err = ins.Lock("deploy", errors.New("rollout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsLock, ins, l, t)
+
+	ins, err = ins.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsUnlock, ins, l, t)
+}
+
+func TestEventRunner(t *testing.T) {
+	s, l := eventSetup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchEventContext(ctx, l)
+
+	r, err := s.NewRunner("10.0.0.1:5000", 42, nil).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvRunnerReg, r, l, t)
+	if ev.Path.Runner == nil || *ev.Path.Runner != r.Addr {
+		t.Errorf("expected event for runner %s, got %s", r.Addr, ev.Path)
+	}
+
+	err = r.Unregister()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = expectEvent(EvRunnerUnreg, r, l, t)
+	if runner, ok := ev.Source.(*Runner); ok && runner.InstanceId != 42 {
+		t.Errorf("expected runner of instance 42, got %d", runner.InstanceId)
+	}
+}
+
+func TestEventServices(t *testing.T) {
+	s, l := eventSetup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go storeFromSnapshotable(s).WatchEventContext(ctx, l)
+
+	expectService := func(etype EventType, st ServiceType, addr string) {
+		ev := expectEvent(etype, &Service{}, l, t)
+		svc, ok := ev.Source.(*Service)
+		if ok && (svc.Type != st || svc.Addr != addr) {
+			t.Errorf("expected %s %s, got %s", st, addr, svc)
+		}
+	}
+
+	_, err := s.RegisterLogger("10.0.0.3:9000", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectService(EvLoggerJoin, ServiceLogger, "10.0.0.3:9000")
+	if err = s.UnregisterLogger("10.0.0.3:9000"); err != nil {
+		t.Fatal(err)
+	}
+	expectService(EvLoggerLeave, ServiceLogger, "10.0.0.3:9000")
+
+	_, err = s.RegisterProxy("10.0.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectService(EvProxyJoin, ServiceProxy, "10.0.0.4")
+	if err = s.UnregisterProxy("10.0.0.4"); err != nil {
+		t.Fatal(err)
+	}
+	expectService(EvProxyLeave, ServiceProxy, "10.0.0.4")
+
+	_, err = s.RegisterPm("10.0.0.1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectService(EvPmJoin, ServicePm, "10.0.0.1")
+	if err = s.UnregisterPm("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	expectService(EvPmLeave, ServicePm, "10.0.0.1")
 }
@@ -0,0 +1,639 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExportVersion is the version of the document written by Export. Version
+// 2 adds the history of instances, version 3 the raw files of invalid
+// entries. Import reads all of them.
+const ExportVersion = 3
+
+// An Export is the whole registry managed by a Store at one revision.
+// File bodies are kept as they are stored, so that an Import restores
+// them unchanged.
+type Export struct {
+	Version       int               `json:"version"`
+	SchemaVersion int               `json:"schema-version"`
+	Rev           int64             `json:"rev"`
+	NextPort      int               `json:"next-port"`
+	Apps          []*ExportApp      `json:"apps"`
+	Instances     []*ExportInstance `json:"instances"`
+	Runners       []*ExportRunner   `json:"runners"`
+	Loggers       map[string]string `json:"loggers"`
+	Proxies       map[string]string `json:"proxies"`
+	Pms           map[string]string `json:"pms"`
+	// History holds the history entries by instance id, see
+	// Instance.History.
+	History map[string]map[string]string `json:"history,omitempty"`
+	// Raw holds the files of apps and instances which can't be read, such
+	// as an instance without object, by path.
+	Raw map[string]string `json:"raw,omitempty"`
+}
+
+type ExportApp struct {
+	Name       string            `json:"name"`
+	Attrs      json.RawMessage   `json:"attrs"`
+	Head       *string           `json:"head,omitempty"`
+	Registered string            `json:"registered"`
+	Env        map[string]string `json:"env,omitempty"`
+	Revisions  []*ExportRevision `json:"revisions"`
+	Envs       []*ExportEnv      `json:"envs"`
+	Procs      []*ExportProc     `json:"procs"`
+}
+
+type ExportRevision struct {
+	Ref        string `json:"ref"`
+	ArchiveUrl string `json:"archive-url"`
+	Registered string `json:"registered"`
+}
+
+type ExportEnv struct {
+	Ref        string          `json:"ref"`
+	Vars       json.RawMessage `json:"vars"`
+	Registered string          `json:"registered"`
+}
+
+type ExportProc struct {
+	Name       string                       `json:"name"`
+	Port       int                          `json:"port"`
+	Attrs      json.RawMessage              `json:"attrs,omitempty"`
+	Registered string                       `json:"registered"`
+	Instances  map[string]map[string]string `json:"instances,omitempty"`
+	Failed     map[string]string            `json:"failed,omitempty"`
+	Lost       map[string]string            `json:"lost,omitempty"`
+	Done       map[string]string            `json:"done,omitempty"`
+}
+
+type ExportInstance struct {
+	Id         int64             `json:"id"`
+	Object     string            `json:"object"`
+	Start      *string           `json:"start,omitempty"`
+	Status     *string           `json:"status,omitempty"`
+	Stop       *string           `json:"stop,omitempty"`
+	Restarts   *string           `json:"restarts,omitempty"`
+	Registered *string           `json:"registered,omitempty"`
+	Lock       *string           `json:"lock,omitempty"`
+	Lease      *string           `json:"lease,omitempty"`
+	Heartbeat  *string           `json:"heartbeat,omitempty"`
+	Claims     map[string]string `json:"claims,omitempty"`
+}
+
+type ExportRunner struct {
+	Addr       string `json:"addr"`
+	InstanceId string `json:"instance-id"`
+}
+
+// Export writes the registry as a JSON document to w.
+func (s *Store) Export(w io.Writer) error {
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return err
+	}
+	e, err := exportTree(sp)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(e)
+}
+
+// Import restores a document written by Export into the root of the
+// Store, which must be empty.
+func (s *Store) Import(r io.Reader) (*Store, error) {
+	e := &Export{}
+
+	if err := json.NewDecoder(r).Decode(e); err != nil {
+		return nil, errorf(ErrInvalidArgument, "invalid export: %s", err)
+	}
+	if e.Version < 1 || e.Version > ExportVersion {
+		return nil, errorf(ErrInvalidArgument, "unsupported export version %d", e.Version)
+	}
+
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	names, err := sp.Getdir("/")
+	if err != nil && !IsErrNoEnt(err) {
+		return nil, err
+	}
+	if len(names) > 0 {
+		return nil, errorf(ErrConflict, "can't import into non-empty root")
+	}
+
+	sp, err = importTree(sp, e)
+	if err != nil {
+		return nil, err
+	}
+	s.snapshot = sp
+
+	return s, nil
+}
+
+func exportTree(sp Snapshot) (*Export, error) {
+	var err error
+
+	e := &Export{Version: ExportVersion, Rev: sp.Rev}
+
+	e.SchemaVersion, err = getSchemaVersion(sp)
+	if err != nil {
+		return nil, err
+	}
+	f, err := sp.getFile(nextPortPath, new(intCodec))
+	if err != nil {
+		return nil, err
+	}
+	e.NextPort = f.Value.(int)
+
+	apps, err := getdirSorted(sp, appsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range apps {
+		app, err := exportApp(sp, name)
+		if isInvalidEntry(err) {
+			if err = e.addRaw(sp, path.Join(appsPath, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.Apps = append(e.Apps, app)
+	}
+
+	ids, err := getdirSorted(sp, instancesPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, idstr := range ids {
+		ins, err := exportInstance(sp, idstr)
+		if isInvalidEntry(err) {
+			if err = e.addRaw(sp, path.Join(instancesPath, idstr)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.Instances = append(e.Instances, ins)
+	}
+
+	hosts, err := getdirSorted(sp, runnersPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		files, err := getFiles(sp, path.Join(runnersPath, host))
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range sortedKeys(files) {
+			e.Runners = append(e.Runners, &ExportRunner{runnerAddr(host, port), files[port]})
+		}
+	}
+
+	if e.Loggers, err = getFiles(sp, loggerDir); err != nil {
+		return nil, err
+	}
+	if e.Proxies, err = getFiles(sp, proxyDir); err != nil {
+		return nil, err
+	}
+	if e.Pms, err = getFiles(sp, pmDir); err != nil {
+		return nil, err
+	}
+
+	ids, err = getdirSorted(sp, historyPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, idstr := range ids {
+		entries, err := getFiles(sp, path.Join(historyPath, idstr))
+		if err != nil {
+			return nil, err
+		}
+		if e.History == nil {
+			e.History = map[string]map[string]string{}
+		}
+		e.History[idstr] = entries
+	}
+
+	return e, nil
+}
+
+// isInvalidEntry checks if an entry couldn't be exported because of its
+// files, rather than because of the coordinator.
+func isInvalidEntry(err error) bool {
+	return IsErrNoEnt(err) || IsErrInvalidFile(err)
+}
+
+// addRaw adds the files of the tree at p to the raw files of e.
+func (e *Export) addRaw(sp Snapshot, p string) error {
+	body, rev, err := sp.Get(p)
+	if err == nil {
+		if e.Raw == nil {
+			e.Raw = map[string]string{}
+		}
+		e.Raw[p] = body
+		return nil
+	}
+	if rev != RevDir {
+		return err
+	}
+	names, err := getdirSorted(sp, p)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := e.addRaw(sp, path.Join(p, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportApp(sp Snapshot, name string) (*ExportApp, error) {
+	var err error
+
+	d := newDir(path.Join(appsPath, name), sp)
+	app := &ExportApp{Name: name}
+
+	attrs, _, err := d.Get("attrs")
+	if err != nil {
+		return nil, err
+	}
+	app.Attrs = json.RawMessage(attrs)
+
+	if app.Head, err = getOptional(sp, d.Prefix("head")); err != nil {
+		return nil, err
+	}
+	if app.Registered, _, err = d.Get(registeredPath); err != nil {
+		return nil, err
+	}
+	if app.Env, err = getFiles(sp, d.Prefix("env")); err != nil {
+		return nil, err
+	}
+
+	revs, err := getdirSorted(sp, d.Prefix(revsPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range revs {
+		rd := newDir(d.Prefix(revsPath, ref), sp)
+		rev := &ExportRevision{Ref: ref}
+
+		if rev.ArchiveUrl, _, err = rd.Get(archiveUrlPath); err != nil {
+			return nil, err
+		}
+		if rev.Registered, _, err = rd.Get(registeredPath); err != nil {
+			return nil, err
+		}
+		app.Revisions = append(app.Revisions, rev)
+	}
+
+	envs, err := getdirSorted(sp, d.Prefix(envsPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range envs {
+		ed := newDir(d.Prefix(envsPath, ref), sp)
+		env := &ExportEnv{Ref: ref}
+
+		vars, _, err := ed.Get(varsPath)
+		if err != nil {
+			return nil, err
+		}
+		env.Vars = json.RawMessage(vars)
+
+		if env.Registered, _, err = ed.Get(registeredPath); err != nil {
+			return nil, err
+		}
+		app.Envs = append(app.Envs, env)
+	}
+
+	procs, err := getdirSorted(sp, d.Prefix(procsPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range procs {
+		proc, err := exportProc(sp, newDir(d.Prefix(procsPath, name), sp))
+		if err != nil {
+			return nil, err
+		}
+		app.Procs = append(app.Procs, proc)
+	}
+
+	return app, nil
+}
+
+func exportProc(sp Snapshot, d *dir) (*ExportProc, error) {
+	var err error
+
+	proc := &ExportProc{Name: path.Base(d.Name)}
+
+	f, err := d.GetFile(procsPortPath, new(intCodec))
+	if err != nil {
+		return nil, err
+	}
+	proc.Port = f.Value.(int)
+
+	attrs, err := getOptional(sp, d.Prefix(procsAttrsPath))
+	if err != nil {
+		return nil, err
+	}
+	if attrs != nil {
+		proc.Attrs = json.RawMessage(*attrs)
+	}
+	if proc.Registered, _, err = d.Get(registeredPath); err != nil {
+		return nil, err
+	}
+
+	revs, err := getdirSorted(sp, d.Prefix(instancesPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, rev := range revs {
+		files, err := getFiles(sp, d.Prefix(instancesPath, rev))
+		if err != nil {
+			return nil, err
+		}
+		if proc.Instances == nil {
+			proc.Instances = map[string]map[string]string{}
+		}
+		proc.Instances[rev] = files
+	}
+
+	if proc.Failed, err = getFiles(sp, d.Prefix(failedPath)); err != nil {
+		return nil, err
+	}
+	if proc.Lost, err = getFiles(sp, d.Prefix(lostPath)); err != nil {
+		return nil, err
+	}
+	if proc.Done, err = getFiles(sp, d.Prefix(donePath)); err != nil {
+		return nil, err
+	}
+
+	return proc, nil
+}
+
+func exportInstance(sp Snapshot, idstr string) (*ExportInstance, error) {
+	id, err := parseInstanceId(idstr)
+	if err != nil {
+		return nil, errorf(ErrInvalidFile, "invalid instance id '%s'", idstr)
+	}
+	d := newDir(instancePath(id), sp)
+	ins := &ExportInstance{Id: id}
+
+	if ins.Object, _, err = d.Get(objectPath); err != nil {
+		return nil, err
+	}
+
+	optional := map[string]**string{
+		startPath:      &ins.Start,
+		statusPath:     &ins.Status,
+		stopPath:       &ins.Stop,
+		restartsPath:   &ins.Restarts,
+		registeredPath: &ins.Registered,
+		lockPath:       &ins.Lock,
+		leasePath:      &ins.Lease,
+		heartbeatPath:  &ins.Heartbeat,
+	}
+	for name, field := range optional {
+		if *field, err = getOptional(sp, d.Prefix(name)); err != nil {
+			return nil, err
+		}
+	}
+	if ins.Claims, err = getFiles(sp, d.Prefix(claimsPath)); err != nil {
+		return nil, err
+	}
+
+	return ins, nil
+}
+
+func importTree(sp Snapshot, e *Export) (Snapshot, error) {
+	w := &treeWriter{sp: sp}
+
+	w.set(nextPortPath, strconv.Itoa(e.NextPort))
+	w.set(schemaPath, strconv.Itoa(e.SchemaVersion))
+	w.set(uidBasePath, strconv.FormatInt(e.maxId(), 10))
+
+	for _, app := range e.Apps {
+		d := newDir(path.Join(appsPath, app.Name), sp)
+
+		w.set(d.Prefix("attrs"), string(app.Attrs))
+		w.setOptional(d.Prefix("head"), app.Head)
+		w.set(d.Prefix(registeredPath), app.Registered)
+		w.setFiles(d.Prefix("env"), app.Env)
+
+		for _, rev := range app.Revisions {
+			w.set(d.Prefix(revsPath, rev.Ref, archiveUrlPath), rev.ArchiveUrl)
+			w.set(d.Prefix(revsPath, rev.Ref, registeredPath), rev.Registered)
+		}
+		for _, env := range app.Envs {
+			w.set(d.Prefix(envsPath, env.Ref, varsPath), string(env.Vars))
+			w.set(d.Prefix(envsPath, env.Ref, registeredPath), env.Registered)
+		}
+		for _, proc := range app.Procs {
+			pd := newDir(d.Prefix(procsPath, proc.Name), sp)
+
+			w.set(pd.Prefix(procsPortPath), strconv.Itoa(proc.Port))
+			if proc.Attrs != nil {
+				w.set(pd.Prefix(procsAttrsPath), string(proc.Attrs))
+			}
+			w.set(pd.Prefix(registeredPath), proc.Registered)
+
+			revs := []string{}
+			for rev := range proc.Instances {
+				revs = append(revs, rev)
+			}
+			sort.Strings(revs)
+			for _, rev := range revs {
+				w.setFiles(pd.Prefix(instancesPath, rev), proc.Instances[rev])
+			}
+			w.setFiles(pd.Prefix(failedPath), proc.Failed)
+			w.setFiles(pd.Prefix(lostPath), proc.Lost)
+			w.setFiles(pd.Prefix(donePath), proc.Done)
+		}
+	}
+
+	for _, ins := range e.Instances {
+		d := newDir(instancePath(ins.Id), sp)
+
+		w.set(d.Prefix(objectPath), ins.Object)
+		w.setOptional(d.Prefix(statusPath), ins.Status)
+		w.setOptional(d.Prefix(stopPath), ins.Stop)
+		w.setOptional(d.Prefix(restartsPath), ins.Restarts)
+		w.setOptional(d.Prefix(registeredPath), ins.Registered)
+		w.setOptional(d.Prefix(lockPath), ins.Lock)
+		w.setOptional(d.Prefix(leasePath), ins.Lease)
+		w.setOptional(d.Prefix(heartbeatPath), ins.Heartbeat)
+		w.setFiles(d.Prefix(claimsPath), ins.Claims)
+		w.setOptional(d.Prefix(startPath), ins.Start)
+	}
+
+	for _, r := range e.Runners {
+		w.set(runnerPath(r.Addr), r.InstanceId)
+	}
+
+	w.setFiles(loggerDir, e.Loggers)
+	w.setFiles(proxyDir, e.Proxies)
+	w.setFiles(pmDir, e.Pms)
+
+	ids := []string{}
+	for id := range e.History {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		w.setFiles(path.Join(historyPath, id), e.History[id])
+	}
+	for _, p := range sortedKeys(e.Raw) {
+		w.set(p, e.Raw[p])
+	}
+
+	return w.sp, w.err
+}
+
+// maxId returns the largest id handed out by the coordinator exported,
+// which is at least the largest id found in the export. Ids of instances
+// are uids, which are revisions of their coordinator.
+func (e *Export) maxId() int64 {
+	max := e.Rev
+	note := func(name string) {
+		if id, err := parseInstanceId(name); err == nil && id > max {
+			max = id
+		}
+	}
+	for _, app := range e.Apps {
+		for _, proc := range app.Procs {
+			for _, ids := range proc.Instances {
+				for name := range ids {
+					note(name)
+				}
+			}
+			for _, lookup := range []map[string]string{proc.Failed, proc.Lost, proc.Done} {
+				for name := range lookup {
+					note(name)
+				}
+			}
+		}
+	}
+	for _, ins := range e.Instances {
+		if ins.Id > max {
+			max = ins.Id
+		}
+	}
+	for _, r := range e.Runners {
+		note(r.InstanceId)
+	}
+	for name := range e.History {
+		note(name)
+	}
+	for p := range e.Raw {
+		// instances/<id>/... and the lookups of procs, which end with
+		// the id.
+		parts := strings.Split(p, "/")
+		switch {
+		case parts[0] == instancesPath && len(parts) > 1:
+			note(parts[1])
+		case parts[0] == appsPath && len(parts) >= 6 && parts[2] == procsPath:
+			note(parts[len(parts)-1])
+		}
+	}
+	return max
+}
+
+// treeWriter writes files one after another, stopping at the first error.
+type treeWriter struct {
+	sp  Snapshot
+	err error
+}
+
+func (w *treeWriter) set(p, body string) {
+	if w.err != nil {
+		return
+	}
+	w.sp, w.err = w.sp.Set(p, body)
+}
+
+func (w *treeWriter) setOptional(p string, body *string) {
+	if body != nil {
+		w.set(p, *body)
+	}
+}
+
+func (w *treeWriter) setFiles(dir string, files map[string]string) {
+	for _, name := range sortedKeys(files) {
+		w.set(path.Join(dir, name), files[name])
+	}
+}
+
+// getdirSorted returns the sorted entries of the directory at p, or none
+// if it doesn't exist.
+func getdirSorted(sp Snapshot, p string) ([]string, error) {
+	names, err := sp.Getdir(p)
+	if IsErrNoEnt(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// getFiles returns the bodies of all files in the directory at p, or nil
+// if it doesn't exist.
+func getFiles(sp Snapshot, p string) (map[string]string, error) {
+	names, err := getdirSorted(sp, p)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, name := range names {
+		body, _, err := sp.Get(path.Join(p, name))
+		if err != nil {
+			return nil, err
+		}
+		files[name] = body
+	}
+	return files, nil
+}
+
+func getOptional(sp Snapshot, p string) (*string, error) {
+	body, _, err := sp.Get(p)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	s := visorSetup("/export-test")
+
+	app := genApp(s)
+	app, err := app.SetHead("128af9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := genRevision(app)
+	proc := genProc(app, "web")
+	env := genEnv(app, "default", map[string]string{"HOME": "/home/app"})
+
+	limit := 512
+	proc.Attrs.Limits.MemoryLimitMb = &limit
+	proc, err = proc.StoreAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets, _, err := s.Scale(app.Name, rev.Ref, proc.Name, env.Ref, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setInstancesToStarted(tickets[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := tickets[1].Claim("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Failed("10.0.0.2", errors.New("no space left"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.NewRunner("10.0.0.1:5000", tickets[0].Id, nil).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RegisterPm("10.0.0.1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RegisterLogger("10.0.0.3:9000", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RegisterProxy("10.0.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = s.Export(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported := &Export{}
+	if err := json.Unmarshal(buf.Bytes(), exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Apps) != 1 || len(exported.Instances) != 3 || len(exported.Runners) != 1 || len(exported.History) != 3 {
+		t.Fatalf("unexpected export: %s", buf)
+	}
+	if exported.NextPort != startPort+1 {
+		t.Errorf("expected next-port %d, got %d", startPort+1, exported.NextPort)
+	}
+
+	dst, err := DialUri(DefaultUri, "/import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dst.reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err = dst.Import(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf2 := &bytes.Buffer{}
+	err = dst.Export(buf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Export{}
+	if err := json.Unmarshal(buf2.Bytes(), imported); err != nil {
+		t.Fatal(err)
+	}
+	imported.Rev = exported.Rev
+	if !reflect.DeepEqual(exported, imported) {
+		t.Errorf("expected import to restore the export\nexported: %s\nimported: %s", buf, buf2)
+	}
+
+	v, err := dst.VerifySchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != SchemaVersion {
+		t.Errorf("expected schema version %d, got %d", SchemaVersion, v)
+	}
+	ins1, err := dst.GetInstance(tickets[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins1.Status != InsStatusRunning || ins1.Env != env.Ref {
+		t.Errorf("unexpected imported instance %s (%s)", ins1, ins1.Status)
+	}
+	history, err := dst.GetInstanceHistory(tickets[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[2].Event != HistFailed || history[2].Reason != "no space left" {
+		t.Errorf("expected the history of the failed instance to be imported, got %v", history)
+	}
+	proc1, err := app.GetProc(proc.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *proc1.Attrs.Limits.MemoryLimitMb != limit {
+		t.Errorf("expected memory limit %d", limit)
+	}
+
+	_, err = dst.Import(bytes.NewReader(buf.Bytes()))
+	if err == nil || !IsErrConflict(err) {
+		t.Errorf("expected import into non-empty root to fail, got %v", err)
+	}
+}
+
+func TestImportRegisterInstance(t *testing.T) {
+	src, err := NewStore(NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, err = src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	app, err := src.NewApp("cat", "git://cat.git", "whiskers").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.NewProc(app, "web").Register(); err != nil {
+		t.Fatal(err)
+	}
+	// Ids handed out by a busy coordinator are well past the revisions of
+	// the new tree.
+	for i := 0; i < 500; i++ {
+		if _, err = src.GetSnapshot().Getuid(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imported := map[int64]bool{}
+	done := map[int64]bool{}
+	for i := 0; i < 20; i++ {
+		ins, err := src.RegisterInstance("cat", "128af9", "web", "prod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			imported[ins.Id] = true
+			continue
+		}
+		// Only the done lookup is left of these.
+		if err = ins.Unregister("test", nil); err != nil {
+			t.Fatal(err)
+		}
+		done[ins.Id] = true
+	}
+	buf := &bytes.Buffer{}
+	if err = src.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+	// Exports of version 1 have no history.
+	exported := &Export{}
+	if err = json.NewDecoder(buf).Decode(exported); err != nil {
+		t.Fatal(err)
+	}
+	exported.Version, exported.History = 1, nil
+	if err = json.NewEncoder(buf).Encode(exported); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewStore(NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst, err = dst.Import(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		ins, err := dst.RegisterInstance("cat", "128af9", "worker", "prod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported[ins.Id] || done[ins.Id] {
+			t.Fatalf("expected a new id, got imported id %d", ins.Id)
+		}
+		if ins.Id <= exported.Rev {
+			t.Fatalf("expected id %d to be past the exported revision %d", ins.Id, exported.Rev)
+		}
+		if ins, err = ins.Claim("10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := range imported {
+		ins, err := dst.GetInstance(id)
+		if err != nil || ins.ProcessName != "web" {
+			t.Errorf("expected imported instance %d to be kept, got %v (%v)", id, ins, err)
+		}
+	}
+}
+
+func TestExportInvalidEntries(t *testing.T) {
+	src, err := NewStore(NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, err = src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	app, err := src.NewApp("cat", "git://cat.git", "whiskers").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.NewProc(app, "web").Register(); err != nil {
+		t.Fatal(err)
+	}
+	ins, err := src.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries which the other parts of visor skip or report.
+	sp := ins.GetSnapshot()
+	invalid := map[string]string{
+		"instances/bogus/object":     "cat 128af9 web prod",
+		"instances/4242/start":       "",
+		"apps/broken/registered":     "2012-07-19 16:41:00 +0000 UTC",
+		"apps/broken/procs/web/port": "8000",
+	}
+	for p, body := range invalid {
+		if sp, err = sp.Set(p, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err = src.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := &Export{}
+	if err = json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(exported); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exported.Raw, invalid) {
+		t.Errorf("expected raw files %v, got %v", invalid, exported.Raw)
+	}
+	if len(exported.Instances) != 1 || exported.Instances[0].Id != ins.Id {
+		t.Errorf("expected instance %d to be exported, got %v", ins.Id, exported.Instances)
+	}
+
+	dst, err := NewStore(NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst, err = dst.Import(buf); err != nil {
+		t.Fatal(err)
+	}
+	for p, body := range invalid {
+		if got, _, err := dst.GetSnapshot().Get(p); err != nil || got != body {
+			t.Errorf("expected %s to be imported, got %q (%v)", p, got, err)
+		}
+	}
+	if _, err = dst.GetInstance(ins.Id); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultExporterInterval = time.Minute
+
+// DefaultClaimBuckets are the upper bounds in seconds of the buckets of the
+// claim latency histogram.
+var DefaultClaimBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// An Exporter serves metrics on the state of a Store in the Prometheus
+// text format:
+//
+//	visor_instances{app,proc,rev,status}          gauge
+//	visor_instance_restarts{app,proc,rev,reason}  gauge, summed over instances
+//	visor_instance_claim_seconds                  histogram of the time from
+//	                                              registration to claim
+//	visor_services{type}                          gauge
+//	visor_events_total{type}                      counter
+//	visor_exporter_errors_total                   counter
+//
+// The state is kept current by the events of the Store and reconciled
+// with a full read of the registry every Interval, which corrects it for
+// anything missed while the watch was interrupted.
+type Exporter struct {
+	store *Store
+
+	Interval time.Duration
+
+	// Errors receives failed reconciliations, if set.
+	Errors chan error
+
+	mu        sync.Mutex
+	rev       int64
+	instances map[int64]*exportedInstance
+	services  map[ServiceType]map[string]bool
+	events    map[EventType]float64
+	claims    *histogram
+	errors    float64
+}
+
+type exportedInstance struct {
+	app, proc, rev string
+	status         InsStatus
+	restarts       InsRestarts
+}
+
+func (s *Store) NewExporter() *Exporter {
+	return &Exporter{
+		store:     s,
+		Interval:  DefaultExporterInterval,
+		instances: map[int64]*exportedInstance{},
+		services:  map[ServiceType]map[string]bool{},
+		events:    map[EventType]float64{},
+		claims:    newHistogram(DefaultClaimBuckets),
+	}
+}
+
+// Run maintains the metrics until ctx is done or the watch fails. The
+// watch starts once the state was reconciled, which is retried every
+// Interval until then.
+func (e *Exporter) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var errc chan error
+	every(ctx, e.Interval, e.Errors, func() error {
+		rev, err := e.reconcile()
+		if _, ok := err.(InstancesError); err == nil || ok {
+			if errc == nil {
+				// The watch starts at the revision reconciled first.
+				errc = make(chan error, 1)
+				go e.watch(ctx, cancel, rev, errc)
+			}
+		}
+		if err != nil {
+			e.mu.Lock()
+			e.errors++
+			e.mu.Unlock()
+		}
+		return err
+	})
+	if errc == nil {
+		return nil
+	}
+	err := <-errc
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
+
+// watch observes the events after rev until ctx is done or the watch
+// fails, which cancels the reconciliation. The error of the watch is sent
+// to errc.
+func (e *Exporter) watch(ctx context.Context, cancel context.CancelFunc, rev int64, errc chan<- error) {
+	defer cancel()
+
+	l := make(chan *Event)
+	werrc := make(chan error, 1)
+	go func() {
+		_, err := e.store.WatchEventSince(ctx, rev, l)
+		werrc <- err
+	}()
+	for ev := range l {
+		e.observe(ev)
+	}
+	errc <- <-werrc
+}
+
+// reconcile replaces the state with the one read at the latest revision,
+// which is returned. Instances which can't be read are left out, and
+// returned as an InstancesError.
+func (e *Exporter) reconcile() (int64, error) {
+	s, err := e.store.FastForward()
+	if err != nil {
+		return 0, err
+	}
+	list, err := s.GetInstances()
+	if IsErrNoEnt(err) {
+		list, err = nil, nil
+	}
+	partial, ok := err.(InstancesError)
+	if err != nil && !ok {
+		return 0, err
+	}
+	instances := map[int64]*exportedInstance{}
+	for _, ins := range list {
+		instances[ins.Id] = newExportedInstance(ins)
+	}
+
+	services := map[ServiceType]map[string]bool{}
+	for t, get := range map[ServiceType]func() ([]string, error){
+		ServiceLogger: s.GetLoggers,
+		ServiceProxy:  s.GetProxies,
+		ServicePm:     s.GetPms,
+	} {
+		names, err := get()
+		if err != nil && !IsErrNoEnt(err) {
+			return 0, err
+		}
+		services[t] = map[string]bool{}
+		for _, name := range names {
+			services[t][name] = true
+		}
+	}
+
+	rev := s.GetSnapshot().Rev
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rev = rev
+	e.instances = instances
+	e.services = services
+
+	if partial != nil {
+		return rev, partial
+	}
+	return rev, nil
+}
+
+// observe applies ev to the state, unless a reconciliation already
+// covered it.
+func (e *Exporter) observe(ev *Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.events[ev.Type]++
+
+	if ev.Type == EvInsClaim {
+		if ins, ok := ev.Source.(*Instance); ok && !ins.Registered.IsZero() && !ins.Claimed.IsZero() {
+			e.claims.observe(ins.Claimed.Sub(ins.Registered).Seconds())
+		}
+	}
+	if ev.Rev <= e.rev {
+		return
+	}
+
+	switch ev.Type {
+	case EvInsUnreg:
+		if id, err := parseInstanceId(*ev.Path.Instance); err == nil {
+			delete(e.instances, id)
+		}
+		return
+	case EvLoggerJoin, EvProxyJoin, EvPmJoin:
+		t := serviceTypes[ev.Type]
+		if e.services[t] == nil {
+			e.services[t] = map[string]bool{}
+		}
+		e.services[t][serviceAddr(t, *ev.Path.Service)] = true
+		return
+	case EvLoggerLeave, EvProxyLeave, EvPmLeave:
+		t := serviceTypes[ev.Type]
+		delete(e.services[t], serviceAddr(t, *ev.Path.Service))
+		return
+	}
+	if ins, ok := ev.Source.(*Instance); ok {
+		e.instances[ins.Id] = newExportedInstance(ins)
+	}
+}
+
+func newExportedInstance(ins *Instance) *exportedInstance {
+	ei := &exportedInstance{
+		app:    ins.AppName,
+		proc:   ins.ProcessName,
+		rev:    ins.RevisionName,
+		status: ins.Status,
+	}
+	if ins.Restarts != nil {
+		ei.restarts = *ins.Restarts
+	}
+	return ei
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	e.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	instances := metricSet{}
+	restarts := metricSet{}
+	for _, ins := range e.instances {
+		labels := []string{"app", ins.app, "proc", ins.proc, "rev", ins.rev}
+		instances.add(1, append(labels, "status", string(ins.status))...)
+		restarts.add(float64(ins.restarts.Fail), append(labels, "reason", "fail")...)
+		restarts.add(float64(ins.restarts.OOM), append(labels, "reason", "oom")...)
+	}
+	services := metricSet{}
+	for _, t := range []ServiceType{ServiceLogger, ServiceProxy, ServicePm} {
+		services.add(float64(len(e.services[t])), "type", string(t))
+	}
+	events := metricSet{}
+	for t, n := range e.events {
+		events.add(n, "type", string(t))
+	}
+
+	bw := &bytes.Buffer{}
+	instances.write(bw, "visor_instances", "gauge", "Instances by status.")
+	restarts.write(bw, "visor_instance_restarts", "gauge", "Restarts of the registered instances.")
+	e.claims.write(bw, "visor_instance_claim_seconds", "Time from the registration of an instance to its claim.")
+	services.write(bw, "visor_services", "gauge", "Registered services.")
+	events.write(bw, "visor_events_total", "counter", "Events observed.")
+	writeMetricHeader(bw, "visor_exporter_errors_total", "counter", "Failed reconciliations.")
+	fmt.Fprintf(bw, "visor_exporter_errors_total %s\n", formatFloat(e.errors))
+
+	return bw.WriteTo(w)
+}
+
+// A metricSet holds the samples of a metric, keyed by their formatted
+// label pairs.
+type metricSet map[string]float64
+
+func (m metricSet) add(v float64, labels ...string) {
+	m[formatLabels(labels...)] += v
+}
+
+func (m metricSet) write(w io.Writer, name, typ, help string) {
+	writeMetricHeader(w, name, typ, help)
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, k, formatFloat(m[k]))
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// histogram is a Prometheus histogram with fixed buckets.
+type histogram struct {
+	bounds []float64
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]float64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string, labels ...string) {
+	writeMetricHeader(w, name, "histogram", help)
+	h.writeSamples(w, name, labels...)
+}
+
+func (h *histogram) writeSamples(w io.Writer, name string, labels ...string) {
+	for i, b := range h.bounds {
+		le := append(labels[:len(labels):len(labels)], "le", formatFloat(b))
+		fmt.Fprintf(w, "%s_bucket%s %s\n", name, formatLabels(le...), formatFloat(h.counts[i]))
+	}
+	le := append(labels[:len(labels):len(labels)], "le", "+Inf")
+	fmt.Fprintf(w, "%s_bucket%s %s\n", name, formatLabels(le...), formatFloat(h.count))
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels...), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %s\n", name, formatLabels(labels...), formatFloat(h.count))
+}
+
+// formatLabels formats name and value pairs as {name="value",...}.
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
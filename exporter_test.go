@@ -0,0 +1,210 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exporterOutput(t *testing.T, e *Exporter) string {
+	buf := &bytes.Buffer{}
+	if _, err := e.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func expectMetrics(t *testing.T, e *Exporter, lines ...string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		out := exporterOutput(t, e)
+		missing := ""
+		for _, l := range lines {
+			if !strings.Contains(out, l+"\n") {
+				missing = l
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected metric %s, got\n%s", missing, out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExporterReconcile(t *testing.T) {
+	s, _ := eventSetup()
+
+	ins, err := s.RegisterInstance("metricscat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Started("10.0.0.1", "box", 9000, 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ins.Restarted(RestartOOM, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RegisterInstance("metricscat", "128af9", "web", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RegisterLogger("10.0.0.3:9000", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	e := s.NewExporter()
+	if _, err := e.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectMetrics(t, e,
+		`visor_instances{app="metricscat",proc="web",rev="128af9",status="pending"} 1`,
+		`visor_instances{app="metricscat",proc="web",rev="128af9",status="running"} 1`,
+		`visor_instance_restarts{app="metricscat",proc="web",rev="128af9",reason="oom"} 2`,
+		`visor_instance_restarts{app="metricscat",proc="web",rev="128af9",reason="fail"} 0`,
+		`visor_services{type="logger"} 1`,
+		`visor_services{type="proxy"} 0`,
+		`visor_instance_claim_seconds_count 0`,
+		`visor_exporter_errors_total 0`,
+	)
+}
+
+func TestExporterReconcileInvalidInstance(t *testing.T) {
+	s, _ := eventSetup()
+
+	if _, err := s.RegisterInstance("metricsfox", "128af9", "web", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := s.RegisterInstance("metricsfox", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = invalid.GetSnapshot().Txn().Set(invalid.dir.Prefix(startPath), "10.0.0.1 port box").Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := s.NewExporter()
+	e.Errors = make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case err := <-e.Errors:
+		if _, ok := err.(InstancesError); !ok {
+			t.Errorf("expected the invalid instance to be reported, got %v", err)
+		}
+	case err := <-done:
+		t.Fatalf("expected exporter to run, got %v", err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the invalid instance to be reported")
+	}
+	expectMetrics(t, e,
+		`visor_instances{app="metricsfox",proc="web",rev="128af9",status="pending"} 1`,
+		`visor_exporter_errors_total 1`,
+	)
+}
+
+func TestExporterEvents(t *testing.T) {
+	s, _ := eventSetup()
+
+	e := s.NewExporter()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	// The watch starts at the revision reconciled first.
+	for {
+		e.mu.Lock()
+		rev := e.rev
+		e.mu.Unlock()
+		if rev != 0 {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("expected exporter to run, got %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	ins, err := s.RegisterInstance("metricsdog", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMetrics(t, e, `visor_instances{app="metricsdog",proc="web",rev="128af9",status="pending"} 1`)
+
+	ins, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Started("10.0.0.1", "box", 9000, 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RegisterPm("10.0.0.1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	expectMetrics(t, e,
+		`visor_instances{app="metricsdog",proc="web",rev="128af9",status="running"} 1`,
+		`visor_instance_claim_seconds_count 1`,
+		`visor_instance_claim_seconds_bucket{le="+Inf"} 1`,
+		`visor_services{type="pm"} 1`,
+		`visor_events_total{type="instance-start"} 1`,
+	)
+
+	if err := ins.Unregister("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UnregisterPm("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	expectMetrics(t, e, `visor_services{type="pm"} 0`, `visor_events_total{type="instance-unregister"} 1`)
+	if out := exporterOutput(t, e); strings.Contains(out, `app="metricsdog"`) {
+		t.Errorf("expected unregistered instance to be gone, got\n%s", out)
+	}
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text format, got %s", ct)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels("app", `c"a\t`, "env", "a\nb")
+	want := `{app="c\"a\\t",env="a\nb"}`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
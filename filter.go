@@ -0,0 +1,151 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// An EventFilter selects the events delivered by WatchEventFilter. Every
+// field which is set has to match, empty fields match all events. Events
+// which don't carry a field, like app events and InstanceId, never match
+// a filter setting it. Unknown events never match.
+type EventFilter struct {
+	Types      []EventType
+	App        string
+	Proc       string
+	Revision   string
+	Env        string
+	InstanceId int64
+}
+
+// glob returns the narrowest glob which covers all events the filter can
+// match.
+func (f *EventFilter) glob() string {
+	all := len(f.Types) == 0
+	appEvents, insEvents, otherEvents := all, all, all
+
+	for _, t := range f.Types {
+		switch {
+		case isInstanceEvent(t):
+			insEvents = true
+		case isAppEvent(t):
+			appEvents = true
+		default:
+			otherEvents = true
+		}
+	}
+	if f.InstanceId != 0 {
+		appEvents = false
+	}
+	if f.InstanceId != 0 || f.App != "" || f.Proc != "" || f.Revision != "" || f.Env != "" {
+		otherEvents = false
+	}
+
+	switch {
+	case insEvents && !appEvents && !otherEvents:
+		if f.InstanceId != 0 {
+			return path.Join(instancePath(f.InstanceId), globPlural)
+		}
+		return path.Join(instancesPath, "*", globPlural)
+	case appEvents && !insEvents && !otherEvents:
+		if f.App != "" {
+			return path.Join(appsPath, f.App, globPlural)
+		}
+		return path.Join(appsPath, globPlural)
+	}
+	return globPlural
+}
+
+// match checks the event against the filter. Apart from instance events,
+// which need their object file to be read for anything but InstanceId,
+// events are matched by their path only.
+func (f *EventFilter) match(src *RawEvent, etype EventType, data EventData) (bool, error) {
+	if etype == EvUnknown {
+		return false, nil
+	}
+	if len(f.Types) > 0 && !containsEventType(f.Types, etype) {
+		return false, nil
+	}
+
+	env := data.Env
+
+	if data.Instance != nil {
+		if f.InstanceId != 0 && *data.Instance != strconv.FormatInt(f.InstanceId, 10) {
+			return false, nil
+		}
+		if f.App != "" || f.Proc != "" || f.Revision != "" || f.Env != "" {
+			fields, err := getEventObject(src, *data.Instance)
+			if IsErrNoEnt(err) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			data.App, data.Revision, data.Proc = &fields[0], &fields[1], &fields[2]
+			if len(fields) > 3 {
+				env = &fields[3]
+			}
+		}
+	} else if f.InstanceId != 0 {
+		return false, nil
+	}
+
+	return matchField(f.App, data.App) &&
+		matchField(f.Revision, data.Revision) &&
+		matchField(f.Proc, data.Proc) &&
+		matchField(f.Env, env), nil
+}
+
+// getEventObject returns the fields of the object file of the instance an
+// event belongs to. For removals it's read right before the event.
+func getEventObject(src *RawEvent, id string) ([]string, error) {
+	sp := src.GetSnapshot()
+	if src.IsDel() {
+		sp.Rev--
+	}
+	val, _, err := sp.Get(path.Join(instancesPath, id, objectPath))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(val)
+	if len(fields) < 3 {
+		return nil, errorf(ErrInvalidFile, "object file for %s has %d instead of %d fields", id, len(fields), 3)
+	}
+	return fields, nil
+}
+
+func isInstanceEvent(t EventType) bool {
+	switch t {
+	case EvInsReg, EvInsUnreg, EvInsClaim, EvInsUnclaim, EvInsStart, EvInsStop,
+		EvInsRestart, EvInsFail, EvInsExit, EvInsLost, EvInsLock, EvInsUnlock:
+		return true
+	}
+	return false
+}
+
+func isAppEvent(t EventType) bool {
+	switch t {
+	case EvAppReg, EvAppUnreg, EvRevReg, EvRevUnreg, EvProcReg, EvProcUnreg, EvEnvReg, EvEnvUnreg:
+		return true
+	}
+	return false
+}
+
+func containsEventType(types []EventType, t EventType) bool {
+	for _, other := range types {
+		if other == t {
+			return true
+		}
+	}
+	return false
+}
+
+func matchField(want string, have *string) bool {
+	return want == "" || (have != nil && *have == want)
+}
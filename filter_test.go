@@ -0,0 +1,91 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventFilterGlob(t *testing.T) {
+	tests := []struct {
+		f    EventFilter
+		glob string
+	}{
+		{EventFilter{}, "**"},
+		{EventFilter{App: "cat"}, "**"},
+		{EventFilter{Types: []EventType{EvAppReg, EvProcReg}}, "apps/**"},
+		{EventFilter{Types: []EventType{EvRevReg}, App: "cat"}, "apps/cat/**"},
+		{EventFilter{Types: []EventType{EvEnvReg}, App: "cat"}, "apps/cat/**"},
+		{EventFilter{Types: []EventType{EvInsStart, EvInsExit}, App: "cat"}, "instances/*/**"},
+		{EventFilter{Types: []EventType{EvInsClaim, EvRunnerReg}, App: "cat"}, "instances/*/**"},
+		{EventFilter{InstanceId: 42}, "instances/42/**"},
+		{EventFilter{Env: "prod"}, "**"},
+		{EventFilter{Types: []EventType{EvAppReg, EvInsReg}}, "**"},
+		{EventFilter{Types: []EventType{EvRunnerReg, EvPmJoin}}, "**"},
+	}
+
+	for _, test := range tests {
+		if glob := test.f.glob(); glob != test.glob {
+			t.Errorf("expected %+v to watch %s, got %s", test.f, test.glob, glob)
+		}
+	}
+}
+
+func TestWatchEventFilter(t *testing.T) {
+	s, _ := eventSetup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := make(chan *Event)
+	f := &EventFilter{
+		Types: []EventType{EvInsStart, EvInsExit},
+		App:   "filtercat",
+		Env:   "prod",
+	}
+	go s.WatchEventFilter(ctx, f, l)
+
+	dog, err := s.RegisterInstance("filterdog", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := s.RegisterInstance("filtercat", "128af9", "web", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat, err := s.RegisterInstance("filtercat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ins := range []*Instance{dog, dev, cat} {
+		ins, err = ins.Claim("10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ins.Started("10.0.0.1", "box", 9000, 9001)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case ev := <-l:
+		ins, ok := ev.Source.(*Instance)
+		if ev.Type != EvInsStart || !ok || ins.Id != cat.Id {
+			t.Errorf("expected start of instance %d, got %s", cat.Id, ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected event, got timeout")
+	}
+
+	select {
+	case ev := <-l:
+		t.Errorf("expected no more events, got %s", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// FindingKind classifies an inconsistency reported by Fsck.
+type FindingKind string
+
+const (
+	// An entry below instances/ which isn't an instance id.
+	FindingInvalidId FindingKind = "invalid-id"
+	// An instance whose object file is missing or can't be decoded.
+	FindingMissingObject FindingKind = "missing-object"
+	// A proc lookup entry for an instance which doesn't exist.
+	FindingOrphanLookup FindingKind = "orphan-lookup"
+	// A proc lookup entry which doesn't match the status of its instance.
+	FindingStaleLookup FindingKind = "stale-lookup"
+	// An instance which is missing from the lookup of its proc.
+	FindingMissingLookup FindingKind = "missing-lookup"
+	// A runner pointing at an instance which doesn't exist.
+	FindingDanglingRunner FindingKind = "dangling-runner"
+)
+
+// A Finding is a single inconsistency reported by Fsck.
+type Finding struct {
+	Kind       FindingKind
+	Path       string
+	InstanceId int64
+	Message    string
+	Repaired   bool
+}
+
+func (f *Finding) String() string {
+	s := fmt.Sprintf("%s %s: %s", f.Kind, f.Path, f.Message)
+	if f.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// lookupDirs are the proc lookups an instance can be listed in, apart from
+// done, which keeps entries of unregistered instances by design.
+var lookupDirs = []string{instancesPath, failedPath, lostPath}
+
+// Fsck checks the instance tree against the proc lookups and the runners
+// and returns every inconsistency found. With repair set, each finding is
+// fixed:
+//
+//	invalid-id, missing-object   the instance directory is removed
+//	orphan-lookup, stale-lookup  the lookup entry is removed
+//	missing-lookup               the lookup entry is added, unless the
+//	                             proc doesn't exist anymore
+//	dangling-runner              the runner is removed
+//
+// Repairs are based on the revision the tree was checked at. Paths which
+// changed in the meantime are left alone and their findings not marked
+// as repaired.
+func (s *Store) Fsck(repair bool) ([]*Finding, error) {
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	findings := []*Finding{}
+
+	// instances/<id>
+	instances, fs, err := fsckInstances(sp)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, fs...)
+
+	// apps/<app>/procs/<proc>/{instances/<rev>,failed,lost}/<id>
+	listed := map[int64]bool{}
+
+	lookups, err := getLookupEntries(sp)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lookups {
+		ins, ok := instances[l.id]
+		switch {
+		case !ok:
+			findings = append(findings, &Finding{
+				Kind:       FindingOrphanLookup,
+				Path:       l.path,
+				InstanceId: l.id,
+				Message:    "instance doesn't exist",
+			})
+		case l.path != ins.procStatusPath(ins.Status) || ins.Status == InsStatusExited:
+			findings = append(findings, &Finding{
+				Kind:       FindingStaleLookup,
+				Path:       l.path,
+				InstanceId: l.id,
+				Message:    fmt.Sprintf("instance is %s", ins.Status),
+			})
+		default:
+			listed[l.id] = true
+		}
+	}
+
+	ids := Int64Slice{}
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+
+	for _, id := range ids {
+		ins := instances[id]
+		if listed[id] || ins.Status == InsStatusExited {
+			continue
+		}
+		findings = append(findings, &Finding{
+			Kind:       FindingMissingLookup,
+			Path:       ins.procStatusPath(ins.Status),
+			InstanceId: id,
+			Message:    fmt.Sprintf("%s instance isn't listed by its proc", ins.Status),
+		})
+	}
+
+	// runners/<host>/<port>
+	fs, err = fsckRunners(sp, instances)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, fs...)
+
+	if repair {
+		for _, f := range findings {
+			f.Repaired, err = repairFinding(sp, f, instances[f.InstanceId])
+			if err != nil {
+				return findings, err
+			}
+		}
+	}
+	return findings, nil
+}
+
+func fsckInstances(sp Snapshot) (map[int64]*Instance, []*Finding, error) {
+	instances := map[int64]*Instance{}
+	findings := []*Finding{}
+
+	names, err := sp.Getdir(instancesPath)
+	if IsErrNoEnt(err) {
+		return instances, findings, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range names {
+		p := path.Join(instancesPath, name)
+
+		id, err := parseInstanceId(name)
+		if err != nil {
+			findings = append(findings, &Finding{
+				Kind:    FindingInvalidId,
+				Path:    p,
+				Message: "not an instance id",
+			})
+			continue
+		}
+
+		exists, _, err := sp.Exists(path.Join(p, objectPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			findings = append(findings, &Finding{
+				Kind:       FindingMissingObject,
+				Path:       p,
+				InstanceId: id,
+				Message:    "object file not found",
+			})
+			continue
+		}
+
+		ins, err := getInstance(id, sp)
+		if errCause(err) == ErrInvalidFile {
+			findings = append(findings, &Finding{
+				Kind:       FindingMissingObject,
+				Path:       p,
+				InstanceId: id,
+				Message:    err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		instances[id] = ins
+	}
+	return instances, findings, nil
+}
+
+type lookupEntry struct {
+	path string
+	id   int64
+}
+
+func getLookupEntries(sp Snapshot) ([]lookupEntry, error) {
+	entries := []lookupEntry{}
+
+	apps, err := getdirSorted(sp, appsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		procs, err := getdirSorted(sp, path.Join(appsPath, app, procsPath))
+		if err != nil {
+			return nil, err
+		}
+		for _, proc := range procs {
+			procPath := path.Join(appsPath, app, procsPath, proc)
+
+			dirs := []string{}
+			for _, d := range lookupDirs {
+				if d != instancesPath {
+					dirs = append(dirs, path.Join(procPath, d))
+					continue
+				}
+				revs, err := getdirSorted(sp, path.Join(procPath, instancesPath))
+				if err != nil {
+					return nil, err
+				}
+				for _, rev := range revs {
+					dirs = append(dirs, path.Join(procPath, instancesPath, rev))
+				}
+			}
+
+			for _, d := range dirs {
+				names, err := getdirSorted(sp, d)
+				if err != nil {
+					return nil, err
+				}
+				for _, name := range names {
+					id, err := parseInstanceId(name)
+					if err != nil {
+						continue
+					}
+					entries = append(entries, lookupEntry{path.Join(d, name), id})
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+func fsckRunners(sp Snapshot, instances map[int64]*Instance) ([]*Finding, error) {
+	findings := []*Finding{}
+
+	hosts, err := getdirSorted(sp, runnersPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		ports, err := getdirSorted(sp, path.Join(runnersPath, host))
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range ports {
+			r, err := getRunner(runnerAddr(host, port), sp)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := instances[r.InstanceId]; ok {
+				continue
+			}
+			findings = append(findings, &Finding{
+				Kind:       FindingDanglingRunner,
+				Path:       r.dir.Name,
+				InstanceId: r.InstanceId,
+				Message:    fmt.Sprintf("instance %d doesn't exist", r.InstanceId),
+			})
+		}
+	}
+	return findings, nil
+}
+
+// repairFinding fixes f and reports whether it did.
+func repairFinding(sp Snapshot, f *Finding, ins *Instance) (bool, error) {
+	var err error
+
+	switch f.Kind {
+	case FindingMissingLookup:
+		var exists bool
+
+		exists, _, err = sp.Exists(path.Join(appsPath, ins.AppName, procsPath, ins.ProcessName))
+		if err != nil || !exists {
+			return false, err
+		}
+		value := timestamp()
+		if f.Path == ins.procInstancesPath() {
+			value = formatTime(ins.Registered)
+		}
+		_, err = sp.Set(f.Path, value)
+	default:
+		err = sp.Del(f.Path)
+	}
+	if IsErrRevMismatch(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
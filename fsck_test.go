@@ -0,0 +1,154 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	s := visorSetup("/fsck-test")
+
+	app := s.NewApp("fsck-cat", "git://cat.git", "whiskers")
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genProc(app, "web")
+
+	healthy, err := s.RegisterInstance(app.Name, "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := s.RegisterInstance(app.Name, "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlisted, err := s.RegisterInstance(app.Name, "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.NewRunner("10.0.0.1:5000", healthy.Id, nil).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []struct{ path, body string }{
+		{"apps/fsck-cat/procs/web/instances/128af9/999", "2013-01-01T00:00:00Z"}, // orphan lookup
+		{"apps/fsck-cat/procs/web/lost/" + stale.idString(), "lost"},             // stale lookup
+		{"instances/998/start", ""},                                              // missing object
+		{"instances/foo/object", "cat 128af9 web"},                               // invalid id
+		{"runners/10.0.0.2/5000", "997"},                                         // dangling runner
+	} {
+		sp, err = sp.Set(f.path, f.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sp.Del(unlisted.procInstancesPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[FindingKind]string{
+		FindingOrphanLookup:   "apps/fsck-cat/procs/web/instances/128af9/999",
+		FindingStaleLookup:    "apps/fsck-cat/procs/web/lost/" + stale.idString(),
+		FindingMissingObject:  "instances/998",
+		FindingInvalidId:      "instances/foo",
+		FindingDanglingRunner: "runners/10.0.0.2/5000",
+		FindingMissingLookup:  unlisted.procInstancesPath(),
+	}
+
+	findings, err := s.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[FindingKind]string{}
+	for _, f := range findings {
+		if f.Repaired {
+			t.Errorf("expected %s not to be repaired", f)
+		}
+		found[f.Kind] = f.Path
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected findings %v, got %v", expected, findings)
+	}
+
+	findings, err = s.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != len(expected) {
+		t.Errorf("expected %d findings, got %v", len(expected), findings)
+	}
+	for _, f := range findings {
+		if !f.Repaired {
+			t.Errorf("expected %s to be repaired", f)
+		}
+	}
+
+	s, err = s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings, err = s.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected no findings after repair, got %v", findings)
+	}
+
+	ids, err := getInstanceIds(app.Name, "128af9", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Int64Slice{healthy.Id, stale.Id, unlisted.Id}
+	sort.Sort(want)
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected instances %v to be listed, got %v", want, ids)
+	}
+}
+
+func TestGetInstancesErrors(t *testing.T) {
+	s := visorSetup("/fsck-test")
+
+	ins, err := s.RegisterInstance("cat", "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := s.GetSnapshot().Set("instances/998/start", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.snapshot = sp
+
+	instances, err := s.GetInstances()
+	errs, ok := err.(InstancesError)
+	if !ok {
+		t.Fatalf("expected InstancesError, got %v", err)
+	}
+	if len(errs) != 1 || !IsErrNotFound(errs[998]) {
+		t.Errorf("expected instance 998 not to be found, got %v", errs)
+	}
+	if !IsErrNotFound(err) {
+		t.Error("expected InstancesError to be a not found error")
+	}
+	if len(instances) != 1 || instances[0].Id != ins.Id {
+		t.Errorf("expected instance %d to be returned, got %v", ins.Id, instances)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A GCPolicy selects the finished instances removed by GC: those which
+// finished longer than MaxAge ago, and those beyond the MaxCount most
+// recently finished of their proc. A limit of 0 doesn't remove anything.
+type GCPolicy struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// A Collected instance was removed by GC, which deleted Paths. Finished is
+// zero if it isn't known when the instance finished.
+type Collected struct {
+	Id       int64     `json:"id"`
+	App      string    `json:"app"`
+	Proc     string    `json:"proc"`
+	Status   InsStatus `json:"status"`
+	Finished time.Time `json:"finished"`
+	Paths    []string  `json:"paths"`
+}
+
+// GC removes the exited, failed, lost and done instances of every proc
+// which policy selects, along with their proc lookups, in a transaction
+// per instance. Instances which a runner still refers to are kept. It
+// returns what it removed, which is also recorded in the history of each
+// instance, even if it fails part way.
+func (s *Store) GC(policy GCPolicy) ([]*Collected, error) {
+	if policy.MaxAge < 0 || policy.MaxCount < 0 {
+		return nil, errorf(ErrInvalidArgument, "gc limits can't be negative")
+	}
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := runnerInstanceIds(sp)
+	if err != nil {
+		return nil, err
+	}
+	finished, err := getFinished(sp)
+	if err != nil {
+		return nil, err
+	}
+
+	procs := map[string][]*Collected{}
+	for _, c := range finished {
+		key := path.Join(c.App, c.Proc)
+		procs[key] = append(procs[key], c)
+	}
+
+	now := time.Now()
+	collected := []*Collected{}
+	for _, list := range procs {
+		// Most recently finished first.
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Finished.Equal(list[j].Finished) {
+				return list[i].Id > list[j].Id
+			}
+			return list[i].Finished.After(list[j].Finished)
+		})
+		kept := 0
+		for _, c := range list {
+			tooMany := policy.MaxCount > 0 && kept >= policy.MaxCount
+			tooOld := policy.MaxAge > 0 && !c.Finished.IsZero() && now.Sub(c.Finished) > policy.MaxAge
+			if referenced[c.Id] || !(tooMany || tooOld) {
+				kept++
+				continue
+			}
+			collected = append(collected, c)
+		}
+	}
+	sort.Slice(collected, func(i, j int) bool { return collected[i].Id < collected[j].Id })
+
+	// Every instance is removed in a transaction of its own, a single one
+	// would go over the limit of operations of etcd.
+	for i, c := range collected {
+		txn := sp.Txn()
+		for _, p := range c.Paths {
+			txn.Del(p)
+		}
+		(&Instance{Id: c.Id}).record(txn, HistoryEntry{Event: HistCollected})
+		if _, err := txn.Commit(); err != nil {
+			return collected[:i], err
+		}
+	}
+	return collected, nil
+}
+
+// getFinished returns the finished instances, from the instance tree for
+// exited instances and from the proc lookups for the others.
+func getFinished(sp Snapshot) ([]*Collected, error) {
+	instances, _, err := fsckInstances(sp)
+	if err != nil {
+		return nil, err
+	}
+	finished := map[int64]*Collected{}
+
+	for id, ins := range instances {
+		switch ins.Status {
+		case InsStatusExited, InsStatusFailed, InsStatusLost:
+		default:
+			continue
+		}
+		c := &Collected{
+			Id:     id,
+			App:    ins.AppName,
+			Proc:   ins.ProcessName,
+			Status: ins.Status,
+			Paths:  []string{ins.dir.Name},
+		}
+		if ins.Status == InsStatusExited {
+			// Exited instances aren't listed, they finished with their
+			// last change.
+			history, err := getHistory(id, sp)
+			if err != nil {
+				return nil, err
+			}
+			c.Finished = ins.Registered
+			if len(history) > 0 {
+				c.Finished = history[len(history)-1].Time
+			}
+		}
+		finished[id] = c
+	}
+
+	apps, err := getdirSorted(sp, appsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		procs, err := getdirSorted(sp, path.Join(appsPath, app, procsPath))
+		if err != nil {
+			return nil, err
+		}
+		for _, proc := range procs {
+			for status, dir := range map[InsStatus]string{
+				InsStatusFailed: failedPath,
+				InsStatusLost:   lostPath,
+				InsStatusDone:   donePath,
+			} {
+				d := path.Join(appsPath, app, procsPath, proc, dir)
+				names, err := getdirSorted(sp, d)
+				if err != nil {
+					return nil, err
+				}
+				for _, name := range names {
+					id, err := parseInstanceId(name)
+					if err != nil {
+						continue
+					}
+					value, _, err := sp.Get(path.Join(d, name))
+					if err != nil {
+						return nil, err
+					}
+					c, ok := finished[id]
+					if !ok {
+						c = &Collected{Id: id, App: app, Proc: proc, Status: status}
+						finished[id] = c
+					}
+					// Entries start with the time the instance finished.
+					if fields := strings.Fields(value); len(fields) > 0 {
+						if t, err := parseTime(fields[0]); err == nil {
+							c.Finished = t
+						}
+					}
+					c.Paths = append(c.Paths, path.Join(d, name))
+				}
+			}
+		}
+	}
+
+	list := []*Collected{}
+	for _, c := range finished {
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// runnerInstanceIds returns the ids of the instances runners refer to.
+func runnerInstanceIds(sp Snapshot) (map[int64]bool, error) {
+	ids := map[int64]bool{}
+
+	hosts, err := getdirSorted(sp, runnersPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		ports, err := getdirSorted(sp, path.Join(runnersPath, host))
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range ports {
+			r, err := getRunner(runnerAddr(host, port), sp)
+			if err != nil {
+				return nil, err
+			}
+			ids[r.InstanceId] = true
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor/net"
+)
+
+func TestGC(t *testing.T) {
+	s := visorSetup("/gc-test")
+
+	old := setupInstance(t, s, "web", "")
+	done := setupInstance(t, s, "web", "")
+	workerDone := setupInstance(t, s, "worker", "")
+	for _, ins := range []*Instance{old, done, workerDone} {
+		if err := ins.Unregister("test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exited := setupInstance(t, s, "web", "10.0.0.1")
+	if err := exited.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exited.Exited("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	failed := setupInstance(t, s, "web", "10.0.0.1")
+	if _, err := failed.Failed("10.0.0.1", errors.New("segfault")); err != nil {
+		t.Fatal(err)
+	}
+	lost := setupInstance(t, s, "web", "")
+	if _, err := lost.Lost("test", errors.New("gone")); err != nil {
+		t.Fatal(err)
+	}
+	referenced := setupInstance(t, s, "web", "10.0.0.1")
+	if _, err := referenced.Failed("10.0.0.1", errors.New("oom")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewRunner("10.0.0.1:5000", referenced.Id, new(net.Net)).Register(); err != nil {
+		t.Fatal(err)
+	}
+	running := setupInstance(t, s, "web", "10.0.0.1")
+
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath := old.procDonePath()
+	if _, err = sp.Set(oldPath, "2012-07-19T16:28:00Z test <nil>"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCollected := func(p GCPolicy, want ...*Instance) {
+		collected, err := s.GC(p)
+		if err != nil {
+			t.Fatalf("%+v: %s", p, err)
+		}
+		if len(collected) != len(want) {
+			t.Fatalf("expected %+v to collect %d instances, got %d: %v", p, len(want), len(collected), collected)
+		}
+		for i, c := range collected {
+			if c.Id != want[i].Id || c.App != "cat" || len(c.Paths) == 0 {
+				t.Errorf("expected %+v to collect instance %d, got %+v", p, want[i].Id, c)
+			}
+		}
+	}
+
+	if _, err = s.GC(GCPolicy{MaxCount: -1}); !IsErrInvalidArgument(err) {
+		t.Errorf("expected a negative count to be invalid, got %v", err)
+	}
+	expectCollected(GCPolicy{})
+	expectCollected(GCPolicy{MaxAge: 24 * time.Hour}, old)
+
+	if sp, err = sp.FastForward(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _, _ := sp.Exists(oldPath); exists {
+		t.Errorf("expected %s to be removed", oldPath)
+	}
+	history, err := s.GetInstanceHistory(old.Id)
+	if err != nil || history[len(history)-1].Event != HistCollected {
+		t.Errorf("expected the collection in the history, got %v (%v)", history, err)
+	}
+
+	// Of the five finished instances of web, the referenced one and the
+	// most recent other one are kept. The single one of worker is kept.
+	collected, err := s.GC(GCPolicy{MaxCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collected) != 3 {
+		t.Fatalf("expected three instances to be collected, got %v", collected)
+	}
+	for _, c := range collected {
+		if c.Proc != "web" || c.Id == referenced.Id {
+			t.Errorf("expected %+v to be kept", c)
+		}
+		if c.Id == failed.Id && (c.Status != InsStatusFailed || len(c.Paths) != 2) {
+			t.Errorf("expected the tree and lookup of the failed instance to be removed, got %+v", c)
+		}
+	}
+	expectCollected(GCPolicy{MaxCount: 1})
+
+	if ins, err := s.GetInstance(referenced.Id); err != nil || ins.Status != InsStatusFailed {
+		t.Errorf("expected the referenced instance to be kept, got %v (%v)", ins, err)
+	}
+	if ins, err := s.GetInstance(running.Id); err != nil || ins.Status != InsStatusRunning {
+		t.Errorf("expected the running instance to be kept, got %v (%v)", ins, err)
+	}
+	findings, err := s.Fsck(false)
+	if err != nil || len(findings) != 0 {
+		t.Errorf("expected a consistent tree, got %v (%v)", findings, err)
+	}
+}
+
+func TestGCBacklog(t *testing.T) {
+	s := visorSetup("/gc-backlog-test")
+
+	// More instances than etcd allows operations in a transaction.
+	ids := map[int64]bool{}
+	for i := 0; i < 40; i++ {
+		ins, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ins, err = ins.Claim("10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ins.Failed("10.0.0.1", errors.New("segfault")); err != nil {
+			t.Fatal(err)
+		}
+		ids[ins.Id] = true
+	}
+
+	collected, err := s.GC(GCPolicy{MaxCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collected) != 39 {
+		t.Fatalf("expected 39 instances to be collected, got %d", len(collected))
+	}
+	for _, c := range collected {
+		if !ids[c.Id] {
+			t.Errorf("expected instance %d not to be collected", c.Id)
+		}
+		if _, err := s.GetInstance(c.Id); !IsErrNotFound(err) {
+			t.Errorf("expected instance %d to be removed, got %v", c.Id, err)
+		}
+	}
+}
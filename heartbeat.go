@@ -0,0 +1,107 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultHeartbeatTimeout is how long a started instance can go without a
+// heartbeat before a LostDetector finds it lost.
+const DefaultHeartbeatTimeout = 2 * time.Minute
+
+const DefaultLostDetectorInterval = 30 * time.Second
+
+// A LostInstance was found lost by a LostDetector. Replacement is the
+// instance registered in its place, if any.
+type LostInstance struct {
+	Instance    *Instance
+	Replacement *Instance
+}
+
+// A LostDetector marks the started instances whose last heartbeat is older
+// than Timeout as lost. Instances which never sent a heartbeat are left
+// alone. Like ReapClaims it skips instances which changed after they were
+// read, so any number of detectors can run at once.
+type LostDetector struct {
+	store  *Store
+	client string
+
+	Timeout  time.Duration
+	Interval time.Duration
+
+	// Reschedule registers a replacement for every lost instance which
+	// wasn't stopping, which restores the scale of its proc.
+	Reschedule bool
+
+	// Lost receives the instances found lost by Run, if set.
+	Lost chan *LostInstance
+	// Errors receives failed detections, if set.
+	Errors chan error
+}
+
+// NewLostDetector returns a LostDetector which reports the instances it
+// finds lost as client.
+func (s *Store) NewLostDetector(client string) *LostDetector {
+	return &LostDetector{
+		store:    s,
+		client:   client,
+		Timeout:  DefaultHeartbeatTimeout,
+		Interval: DefaultLostDetectorInterval,
+	}
+}
+
+// Detect marks the instances with a stale heartbeat as lost, and returns
+// them.
+func (d *LostDetector) Detect() ([]*LostInstance, error) {
+	started, err := d.store.FindInstances(Query{Status: []InsStatus{InsStatusRunning, InsStatusStopping}})
+	if _, ok := err.(InstancesError); err != nil && !ok {
+		return nil, err
+	}
+
+	now := time.Now()
+	lost := []*LostInstance{}
+	for _, ins := range started {
+		stopping := ins.Status == InsStatusStopping
+		expired, err := ins.expireHeartbeat(now, d.Timeout, d.client)
+		if err != nil {
+			return lost, err
+		}
+		if !expired {
+			continue
+		}
+		l := &LostInstance{Instance: ins}
+		lost = append(lost, l)
+
+		if d.Reschedule && !stopping {
+			l.Replacement, err = d.store.RegisterInstance(ins.AppName, ins.RevisionName, ins.ProcessName, ins.Env)
+			if err != nil {
+				return lost, err
+			}
+		}
+	}
+	return lost, nil
+}
+
+// Run detects lost instances every Interval until ctx is done.
+func (d *LostDetector) Run(ctx context.Context) error {
+	every(ctx, d.Interval, d.Errors, func() error {
+		lost, err := d.Detect()
+		for _, l := range lost {
+			if d.Lost == nil {
+				break
+			}
+			select {
+			case d.Lost <- l:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return err
+	})
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstanceHeartbeat(t *testing.T) {
+	s := visorSetup("/heartbeat-test")
+
+	ins := setupInstance(t, s, "web", "10.0.0.1")
+	if ins.LastHeartbeat.IsZero() {
+		t.Error("expected a started instance to have a heartbeat")
+	}
+	ins, err := ins.Heartbeat("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetInstance(ins.Id)
+	if err != nil || !got.LastHeartbeat.Equal(ins.LastHeartbeat) {
+		t.Errorf("expected heartbeat at %s, got %v (%v)", ins.LastHeartbeat, got, err)
+	}
+	if _, err = ins.Heartbeat("10.0.0.2"); !IsErrUnauthorized(err) {
+		t.Errorf("expected heartbeat from another host to be rejected, got %v", err)
+	}
+
+	pending, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pending.Heartbeat("10.0.0.1"); !IsErrInvalidState(err) {
+		t.Errorf("expected heartbeat of a pending instance to fail, got %v", err)
+	}
+}
+
+func TestLostDetector(t *testing.T) {
+	s := visorSetup("/lost-test")
+
+	running := setupInstance(t, s, "web", "10.0.0.1")
+	stopping := setupInstance(t, s, "web", "10.0.0.2")
+	if err := stopping.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	silent := setupInstance(t, s, "web", "10.0.0.3")
+	if _, err := silent.GetSnapshot().Txn().Set(silent.dir.Prefix(heartbeatPath), "").Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := s.NewLostDetector("detector")
+	d.Reschedule = true
+	lost, err := d.Detect()
+	if err != nil || len(lost) != 0 {
+		t.Errorf("expected no instance to be lost yet, got %v (%v)", lost, err)
+	}
+
+	d.Timeout = 0
+	lost, err = d.Detect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lost) != 2 || lost[0].Instance.Id != running.Id || lost[1].Instance.Id != stopping.Id {
+		t.Fatalf("expected instances %d and %d to be lost, got %v", running.Id, stopping.Id, lost)
+	}
+
+	for _, l := range lost {
+		got, err := s.GetInstance(l.Instance.Id)
+		if err != nil || got.Status != InsStatusLost {
+			t.Errorf("expected instance %d to be lost, got %v (%v)", l.Instance.Id, got, err)
+		}
+		history, err := l.Instance.History()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := history[len(history)-1]
+		if last.Event != HistLost || last.Host != "detector" || !strings.HasPrefix(last.Reason, "no heartbeat since") {
+			t.Errorf("expected the loss in the history, got %+v", last)
+		}
+	}
+
+	replacement := lost[0].Replacement
+	if replacement == nil || replacement.Status != InsStatusPending || replacement.ProcessName != "web" || replacement.Env != "prod" {
+		t.Errorf("expected a replacement of the running instance, got %v", replacement)
+	}
+	if lost[1].Replacement != nil {
+		t.Errorf("expected no replacement of the stopping instance, got %v", lost[1].Replacement)
+	}
+	if got, err := s.GetInstance(silent.Id); err != nil || got.Status != InsStatusRunning {
+		t.Errorf("expected instance without heartbeat to be kept, got %v (%v)", got, err)
+	}
+	if _, err = running.Heartbeat("10.0.0.1"); !IsErrInvalidState(err) {
+		t.Errorf("expected heartbeat of a lost instance to fail, got %v", err)
+	}
+}
+
+func TestLostDetectorConflict(t *testing.T) {
+	s := visorSetup("/lost-conflict-test")
+
+	ins := setupInstance(t, s, "web", "10.0.0.1")
+	stale := *ins
+	if _, err := ins.Heartbeat("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := stale.expireHeartbeat(time.Now(), 0, "detector")
+	if err != nil || expired {
+		t.Errorf("expected an instance with a new heartbeat to be kept, got %v (%v)", expired, err)
+	}
+}
+
+func TestLostDetectorRun(t *testing.T) {
+	s := visorSetup("/lost-run-test")
+
+	ins := setupInstance(t, s, "web", "10.0.0.1")
+
+	d := s.NewLostDetector("detector")
+	d.Timeout = 0
+	d.Interval = 10 * time.Millisecond
+	d.Lost = make(chan *LostInstance)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case l := <-d.Lost:
+		if l.Instance.Id != ins.Id || l.Replacement != nil {
+			t.Errorf("expected instance %d to be lost without replacement, got %+v", ins.Id, l)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the instance to be lost")
+	}
+}
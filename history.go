@@ -0,0 +1,153 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const historyPath = "history"
+
+// DefaultHistoryRetention is how long PruneHistory keeps the history of an
+// instance after its last entry, once the instance is gone.
+const DefaultHistoryRetention = 7 * 24 * time.Hour
+
+// A HistoryEvent is a change of an instance recorded in its history.
+type HistoryEvent string
+
+const (
+	HistRegistered HistoryEvent = "registered"
+	HistClaimed    HistoryEvent = "claimed"
+	HistUnclaimed  HistoryEvent = "unclaimed"
+	HistStarted    HistoryEvent = "started"
+	HistRestarted  HistoryEvent = "restarted"
+	HistStop       HistoryEvent = "stop"
+	HistExited     HistoryEvent = "exited"
+	HistFailed     HistoryEvent = "failed"
+	HistLost       HistoryEvent = "lost"
+	HistDone       HistoryEvent = "done"
+	HistCollected  HistoryEvent = "collected"
+)
+
+// A HistoryEntry records a change of an instance. Host is the host which
+// claimed, started, exited or failed the instance, or the client which
+// found it lost or unregistered it. Reason is the reason given for a
+// failure, loss, restart or unregistration.
+type HistoryEntry struct {
+	Time   time.Time    `json:"time"`
+	Event  HistoryEvent `json:"event"`
+	Host   string       `json:"host,omitempty"`
+	Ip     string       `json:"ip,omitempty"`
+	Port   int          `json:"port,omitempty"`
+	Count  int          `json:"count,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+}
+
+// History returns the entries recorded for the instance, oldest first. It
+// stays available after the instance is unregistered, see PruneHistory.
+func (i *Instance) History() ([]*HistoryEntry, error) {
+	sp, err := i.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	return getHistory(i.Id, sp)
+}
+
+// GetInstanceHistory returns the history of the instance with the given id,
+// which doesn't need to exist anymore.
+func (s *Store) GetInstanceHistory(id int64) ([]*HistoryEntry, error) {
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	return getHistory(id, sp)
+}
+
+// PruneHistory removes the histories of instances which are gone and
+// whose last entry is older than retention. It returns the ids of the
+// instances whose history was removed, even if it fails part way.
+func (s *Store) PruneHistory(retention time.Duration) ([]int64, error) {
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	names, err := getdirOptional(sp, historyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []int64{}
+	for _, name := range names {
+		id, err := parseInstanceId(name)
+		if err != nil {
+			continue
+		}
+		exists, _, err := sp.Exists(instancePath(id))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		entries, err := getHistory(id, sp)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 && time.Since(entries[len(entries)-1].Time) < retention {
+			continue
+		}
+		// Like GC, every history is removed in a transaction of its own.
+		if _, err := sp.Txn().Del(historyDirPath(id)).Commit(); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, id)
+	}
+	return pruned, nil
+}
+
+func getHistory(id int64, sp Snapshot) ([]*HistoryEntry, error) {
+	names, err := getdirOptional(sp, historyDirPath(id))
+	if err != nil {
+		return nil, err
+	}
+	// Entries are named by the time they were recorded in nanoseconds.
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := strconv.ParseInt(names[i], 10, 64)
+		b, _ := strconv.ParseInt(names[j], 10, 64)
+		return a < b
+	})
+
+	entries := []*HistoryEntry{}
+	for _, name := range names {
+		e := &HistoryEntry{}
+		if _, err := sp.getFile(path.Join(historyDirPath(id), name), &jsonCodec{DecodedVal: e}); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func historyDirPath(id int64) string {
+	return path.Join(historyPath, strconv.FormatInt(id, 10))
+}
+
+// record adds e to the history of the instance as part of txn.
+func (i *Instance) record(txn *Txn, e HistoryEntry) *Txn {
+	e.Time = time.Now()
+	p := path.Join(historyDirPath(i.Id), strconv.FormatInt(e.Time.UnixNano(), 10))
+	return txn.setValue(p, &e, new(jsonCodec))
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInstanceHistory(t *testing.T) {
+	s := visorSetup("/history-test")
+
+	ins, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Unclaim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Started("10.0.0.2", "box", 9000, 9001); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Restarted(RestartOOM, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = ins.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Failed("10.0.0.2", errors.New("segfault")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ins.Unregister("test", errors.New("cleanup")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []HistoryEntry{
+		{Event: HistRegistered},
+		{Event: HistClaimed, Host: "10.0.0.1"},
+		{Event: HistUnclaimed, Host: "10.0.0.1"},
+		{Event: HistClaimed, Host: "10.0.0.2"},
+		{Event: HistStarted, Host: "box", Ip: "10.0.0.2", Port: 9000},
+		{Event: HistRestarted, Count: 2, Reason: string(RestartOOM)},
+		{Event: HistStop},
+		{Event: HistFailed, Host: "10.0.0.2", Reason: "segfault"},
+		{Event: HistDone, Host: "test", Reason: "cleanup"},
+	}
+	history, err := ins.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != len(want) {
+		t.Fatalf("expected %d entries, got %d: %v", len(want), len(history), history)
+	}
+	for i, e := range history {
+		if e.Time.IsZero() || (i > 0 && e.Time.Before(history[i-1].Time)) {
+			t.Errorf("expected entry %d to be timed in order, got %s", i, e.Time)
+		}
+		e.Time = time.Time{}
+		if *e != want[i] {
+			t.Errorf("expected entry %d to be %+v, got %+v", i, want[i], *e)
+		}
+	}
+
+	byId, err := s.GetInstanceHistory(ins.Id)
+	if err != nil || len(byId) != len(want) {
+		t.Errorf("expected the history by id, got %v (%v)", byId, err)
+	}
+	none, err := s.GetInstanceHistory(ins.Id + 1000)
+	if err != nil || len(none) != 0 {
+		t.Errorf("expected no history of an unknown instance, got %v (%v)", none, err)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	s := visorSetup("/history-prune-test")
+
+	live, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More histories than etcd allows operations in a transaction.
+	gone := map[int64]bool{}
+	for i := 0; i < 70; i++ {
+		ins, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ins.Unregister("test", nil); err != nil {
+			t.Fatal(err)
+		}
+		gone[ins.Id] = true
+	}
+
+	pruned, err := s.PruneHistory(DefaultHistoryRetention)
+	if err != nil || len(pruned) != 0 {
+		t.Errorf("expected recent history to be kept, got %v (%v)", pruned, err)
+	}
+	pruned, err = s.PruneHistory(0)
+	if err != nil || len(pruned) != len(gone) {
+		t.Fatalf("expected %d histories to be pruned, got %v (%v)", len(gone), pruned, err)
+	}
+	for _, id := range pruned {
+		if !gone[id] {
+			t.Errorf("expected history of %d to be kept", id)
+		}
+		if history, _ := s.GetInstanceHistory(id); len(history) != 0 {
+			t.Errorf("expected pruned history to be gone, got %v", history)
+		}
+	}
+	if history, _ := s.GetInstanceHistory(live.Id); len(history) != 1 {
+		t.Errorf("expected history of a live instance to be kept, got %v", history)
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// A Client talks to a Server. Errors of the Server are returned as
+// *visor.Error, so that the IsErr* helpers of the visor package work on
+// them. The entities returned are detached from the coordinator, see
+// visor.JSONVersion.
+type Client struct {
+	url  string
+	HTTP *http.Client
+}
+
+// NewClient returns a Client for the Server at url, e.g.
+// "http://localhost:8080".
+func NewClient(url string) *Client {
+	return &Client{url: strings.TrimRight(url, "/"), HTTP: http.DefaultClient}
+}
+
+// Apps
+
+func (c *Client) GetApps() (apps []*visor.App, err error) {
+	err = c.do("GET", "/apps", nil, &apps)
+	return
+}
+
+// RegisterApp registers app along with its Env and DeployType.
+func (c *Client) RegisterApp(app *visor.App) (*visor.App, error) {
+	res := &visor.App{}
+	return res, c.do("POST", "/apps", app, res)
+}
+
+func (c *Client) GetApp(name string) (*visor.App, error) {
+	res := &visor.App{}
+	return res, c.do("GET", path("apps", name), nil, res)
+}
+
+func (c *Client) UnregisterApp(name string) error {
+	return c.do("DELETE", path("apps", name), nil, nil)
+}
+
+// Revisions
+
+func (c *Client) GetRevisions(app string) (revs []*visor.Revision, err error) {
+	err = c.do("GET", path("apps", app, "revs"), nil, &revs)
+	return
+}
+
+func (c *Client) RegisterRevision(app, ref, archiveUrl string) (*visor.Revision, error) {
+	req := &visor.Revision{App: &visor.App{Name: app}, Ref: ref, ArchiveUrl: archiveUrl}
+	res := &visor.Revision{}
+	return res, c.do("POST", path("apps", app, "revs"), req, res)
+}
+
+func (c *Client) GetRevision(app, ref string) (*visor.Revision, error) {
+	res := &visor.Revision{}
+	return res, c.do("GET", path("apps", app, "revs", ref), nil, res)
+}
+
+func (c *Client) UnregisterRevision(app, ref string) error {
+	return c.do("DELETE", path("apps", app, "revs", ref), nil, nil)
+}
+
+// Envs
+
+func (c *Client) GetEnvs(app string) (envs []*visor.Env, err error) {
+	err = c.do("GET", path("apps", app, "envs"), nil, &envs)
+	return
+}
+
+func (c *Client) RegisterEnv(app, ref string, vars map[string]string) (*visor.Env, error) {
+	req := &visor.Env{App: &visor.App{Name: app}, Ref: ref, Vars: vars}
+	res := &visor.Env{}
+	return res, c.do("POST", path("apps", app, "envs"), req, res)
+}
+
+func (c *Client) GetEnv(app, ref string) (*visor.Env, error) {
+	res := &visor.Env{}
+	return res, c.do("GET", path("apps", app, "envs", ref), nil, res)
+}
+
+func (c *Client) UnregisterEnv(app, ref string) error {
+	return c.do("DELETE", path("apps", app, "envs", ref), nil, nil)
+}
+
+// Procs
+
+func (c *Client) GetProcs(app string) (procs []*visor.Proc, err error) {
+	err = c.do("GET", path("apps", app, "procs"), nil, &procs)
+	return
+}
+
+func (c *Client) RegisterProc(app, name string, attrs visor.ProcAttrs) (*visor.Proc, error) {
+	req := &visor.Proc{App: &visor.App{Name: app}, Name: name, Attrs: attrs}
+	res := &visor.Proc{}
+	return res, c.do("POST", path("apps", app, "procs"), req, res)
+}
+
+func (c *Client) GetProc(app, name string) (*visor.Proc, error) {
+	res := &visor.Proc{}
+	return res, c.do("GET", path("apps", app, "procs", name), nil, res)
+}
+
+func (c *Client) UnregisterProc(app, name string) error {
+	return c.do("DELETE", path("apps", app, "procs", name), nil, nil)
+}
+
+func (c *Client) GetProcInstances(app, proc string) (instances []*visor.Instance, err error) {
+	err = c.do("GET", path("apps", app, "procs", proc, "instances"), nil, &instances)
+	return
+}
+
+// Instances
+
+func (c *Client) GetInstances() (instances []*visor.Instance, err error) {
+	err = c.do("GET", "/instances", nil, &instances)
+	return
+}
+
+// FindInstances returns the instances matching q, see
+// visor.Store.FindInstances.
+func (c *Client) FindInstances(q visor.Query) (instances []*visor.Instance, err error) {
+	p := "/instances"
+	if v := encodeQuery(q); len(v) > 0 {
+		p += "?" + v.Encode()
+	}
+	err = c.do("GET", p, nil, &instances)
+	return
+}
+
+func (c *Client) RegisterInstance(app, rev, proc, env string) (*visor.Instance, error) {
+	req := &visor.Instance{AppName: app, RevisionName: rev, ProcessName: proc, Env: env}
+	res := &visor.Instance{}
+	return res, c.do("POST", "/instances", req, res)
+}
+
+func (c *Client) GetInstance(id int64) (*visor.Instance, error) {
+	res := &visor.Instance{}
+	return res, c.do("GET", path("instances", strconv.FormatInt(id, 10)), nil, res)
+}
+
+// GetInstanceHistory returns the history of the instance with the given id,
+// which stays available after it is unregistered.
+func (c *Client) GetInstanceHistory(id int64) ([]*visor.HistoryEntry, error) {
+	res := []*visor.HistoryEntry{}
+	return res, c.do("GET", path("instances", strconv.FormatInt(id, 10), "history"), nil, &res)
+}
+
+func (c *Client) UnregisterInstance(id int64, client, reason string) error {
+	q := url.Values{"client": {client}, "reason": {reason}}
+	return c.do("DELETE", path("instances", strconv.FormatInt(id, 10))+"?"+q.Encode(), nil, nil)
+}
+
+// InstanceAction applies action to the instance with the given id and
+// returns the changed instance. The fields of a used by each action are:
+//
+//	claim, renew    Host, Lease
+//	unclaim         Host
+//	started         Host, Hostname, Port, TelePort
+//	heartbeat       Host
+//	restarted       Reason (visor.RestartFail or visor.RestartOOM), Count
+//	stop
+//	failed          Host, Reason
+//	lost            Client, Reason
+//	exited          Host
+//	lock            Client, Reason
+//	unlock
+func (c *Client) InstanceAction(id int64, action string, a *Action) (*visor.Instance, error) {
+	if a == nil {
+		a = &Action{}
+	}
+	var res *visor.Instance
+	err := c.do("POST", path("instances", strconv.FormatInt(id, 10), action), a, &res)
+	return res, err
+}
+
+func (c *Client) Claim(id int64, host string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "claim", &Action{Host: host})
+}
+
+func (c *Client) ClaimLease(id int64, host string, lease time.Duration) (*visor.Instance, error) {
+	return c.InstanceAction(id, "claim", &Action{Host: host, Lease: lease.String()})
+}
+
+func (c *Client) RenewClaim(id int64, host string, lease time.Duration) (*visor.Instance, error) {
+	return c.InstanceAction(id, "renew", &Action{Host: host, Lease: lease.String()})
+}
+
+func (c *Client) Unclaim(id int64, host string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "unclaim", &Action{Host: host})
+}
+
+func (c *Client) Started(id int64, host, hostname string, port, telePort int) (*visor.Instance, error) {
+	return c.InstanceAction(id, "started", &Action{Host: host, Hostname: hostname, Port: port, TelePort: telePort})
+}
+
+func (c *Client) Heartbeat(id int64, host string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "heartbeat", &Action{Host: host})
+}
+
+func (c *Client) Restarted(id int64, reason visor.RestartReason, count int) (*visor.Instance, error) {
+	return c.InstanceAction(id, "restarted", &Action{Reason: string(reason), Count: count})
+}
+
+func (c *Client) Stop(id int64) error {
+	_, err := c.InstanceAction(id, "stop", nil)
+	return err
+}
+
+func (c *Client) Failed(id int64, host, reason string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "failed", &Action{Host: host, Reason: reason})
+}
+
+func (c *Client) Lost(id int64, client, reason string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "lost", &Action{Client: client, Reason: reason})
+}
+
+func (c *Client) Exited(id int64, host string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "exited", &Action{Host: host})
+}
+
+func (c *Client) Lock(id int64, client, reason string) (*visor.Instance, error) {
+	return c.InstanceAction(id, "lock", &Action{Client: client, Reason: reason})
+}
+
+func (c *Client) Unlock(id int64) (*visor.Instance, error) {
+	return c.InstanceAction(id, "unlock", nil)
+}
+
+// Scale
+
+func (c *Client) GetScale(app, rev, proc string) (int, error) {
+	res := &scaleBody{}
+	err := c.do("GET", path("scale", app, rev, proc), nil, res)
+	return res.Factor, err
+}
+
+// Scale scales the proc to factor instances, see visor.Store.Scale.
+func (c *Client) Scale(app, rev, proc, env string, factor int) ([]*visor.Instance, int, error) {
+	res := &scaleBody{}
+	err := c.do("PUT", path("scale", app, rev, proc, env), &scaleBody{Factor: factor}, res)
+	if err != nil {
+		return nil, -1, err
+	}
+	return res.Instances, res.Current, nil
+}
+
+// Runners
+
+// GetRunners returns the runners on host, or all runners if host is empty.
+func (c *Client) GetRunners(host string) (runners []*visor.Runner, err error) {
+	p := "/runners"
+	if host != "" {
+		p += "?" + url.Values{"host": {host}}.Encode()
+	}
+	err = c.do("GET", p, nil, &runners)
+	return
+}
+
+func (c *Client) RegisterRunner(addr string, instanceId int64) (*visor.Runner, error) {
+	req := &visor.Runner{Addr: addr, InstanceId: instanceId}
+	res := &visor.Runner{}
+	return res, c.do("POST", "/runners", req, res)
+}
+
+func (c *Client) GetRunner(addr string) (*visor.Runner, error) {
+	res := &visor.Runner{}
+	return res, c.do("GET", path("runners", addr), nil, res)
+}
+
+func (c *Client) UnregisterRunner(addr string) error {
+	return c.do("DELETE", path("runners", addr), nil, nil)
+}
+
+// Services
+
+func (c *Client) GetLoggers() (addrs []string, err error) {
+	err = c.do("GET", "/loggers", nil, &addrs)
+	return
+}
+
+func (c *Client) RegisterLogger(addr, version string) error {
+	return c.do("PUT", path("loggers", addr), &serviceBody{Version: version}, nil)
+}
+
+func (c *Client) UnregisterLogger(addr string) error {
+	return c.do("DELETE", path("loggers", addr), nil, nil)
+}
+
+func (c *Client) GetProxies() (hosts []string, err error) {
+	err = c.do("GET", "/proxies", nil, &hosts)
+	return
+}
+
+func (c *Client) RegisterProxy(host string) error {
+	return c.do("PUT", path("proxies", host), nil, nil)
+}
+
+func (c *Client) UnregisterProxy(host string) error {
+	return c.do("DELETE", path("proxies", host), nil, nil)
+}
+
+func (c *Client) GetPms() (hosts []string, err error) {
+	err = c.do("GET", "/pms", nil, &hosts)
+	return
+}
+
+func (c *Client) RegisterPm(host, version string) error {
+	return c.do("PUT", path("pms", host), &serviceBody{Version: version}, nil)
+}
+
+func (c *Client) UnregisterPm(host string) error {
+	return c.do("DELETE", path("pms", host), nil, nil)
+}
+
+// do sends a request with the JSON encoding of body, if any, and decodes
+// the response into res, if given.
+func (c *Client) do(method, p string, body, res interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.url+p, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		e := &errorBody{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return &StatusError{resp.StatusCode, fmt.Sprintf("%s %s: %s", method, p, resp.Status)}
+		}
+		return decodeError(e, resp.StatusCode)
+	}
+	if res == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// path joins the escaped segments of a resource path.
+func path(segments ...string) string {
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/soundcloud/visor"
+)
+
+// errorBody is the body of every error response.
+type errorBody struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+type errorCode struct {
+	err    error
+	code   string
+	status int
+}
+
+// errorCodes maps the errors of the visor package to the codes and statuses
+// of error responses, and back.
+var errorCodes = []errorCode{
+	{visor.ErrNotFound, "not-found", http.StatusNotFound},
+	{visor.ErrNoEnt, "not-found", http.StatusNotFound},
+	{visor.ErrConflict, "conflict", http.StatusConflict},
+	{visor.ErrInsClaimed, "instance-claimed", http.StatusConflict},
+	{visor.ErrRevMismatch, "revision-mismatch", http.StatusConflict},
+	{visor.ErrInvalidState, "invalid-state", http.StatusConflict},
+	{visor.ErrInvalidArgument, "invalid-argument", http.StatusBadRequest},
+	{visor.ErrInvalidKey, "invalid-key", http.StatusBadRequest},
+	{visor.ErrBadProcName, "bad-proc-name", http.StatusBadRequest},
+	{visor.ErrUnauthorized, "unauthorized", http.StatusForbidden},
+	{visor.ErrCompacted, "compacted", http.StatusGone},
+}
+
+const internalErrorCode = "internal"
+
+// encodeError returns the body and status of the response for err.
+func encodeError(err error) (*errorBody, int) {
+	cause := err
+	switch e := err.(type) {
+	case *visor.Error:
+		cause = e.Err
+	case *visor.StateError:
+		cause = visor.ErrInvalidState
+	}
+	for _, c := range errorCodes {
+		if c.err == cause {
+			return &errorBody{err.Error(), c.code}, c.status
+		}
+	}
+	return &errorBody{err.Error(), internalErrorCode}, http.StatusInternalServerError
+}
+
+// decodeError turns an error response back into a *visor.Error, so that
+// the IsErr* helpers of the visor package work on errors of the Client.
+func decodeError(body *errorBody, status int) error {
+	for _, c := range errorCodes {
+		if c.code == body.Code {
+			return visor.NewError(c.err, body.Error)
+		}
+	}
+	return &StatusError{status, body.Error}
+}
+
+// A StatusError is returned by the Client for error responses which don't
+// map to an error of the visor package.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+const DefaultHeartbeat = 15 * time.Second
+
+// events streams the events of the Store as server-sent events. The query
+// is turned into a visor.EventFilter:
+//
+//	type=<type>,...  app=<app>  proc=<proc>  rev=<rev>  env=<env>  instance=<id>
+//
+// Events written by the same transaction share their Rev, see
+// visor.Store.WatchEventSince. The Rev is sent as an id of its own once all
+// events of it were sent, with the next revision or at the end of the
+// stream. The stream resumes after the Last-Event-ID header, or the since
+// parameter for the first request of a browser. A failed watch ends the
+// stream with an error event carrying an error body.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	f, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	since, err := parseSince(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, fmt.Errorf("streaming not supported"))
+		return
+	}
+	st, err := s.store.FastForward()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	l := make(chan *visor.Event)
+	errc := make(chan error, 1)
+	var rev int64
+	go func() {
+		var err error
+		if since > 0 {
+			rev, err = st.WatchEventFilterSince(ctx, since, f, l)
+		} else {
+			rev, err = st.WatchEventFilter(ctx, f, l)
+		}
+		errc <- err
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var heartbeat <-chan time.Time
+	if s.Heartbeat > 0 {
+		t := time.NewTicker(s.Heartbeat)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+
+	// The Rev of the events last sent, and the last id sent.
+	var last, id int64
+
+	for {
+		select {
+		case ev, ok := <-l:
+			if !ok {
+				err := <-errc
+				if rev > id {
+					fmt.Fprintf(w, "id: %d\n\n", rev)
+				}
+				if err != nil && ctx.Err() == nil {
+					body, _ := encodeError(err)
+					b, _ := json.Marshal(body)
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+				}
+				return
+			}
+			if ev.Rev != last {
+				// All events before ev.Rev are sent.
+				if last != 0 {
+					if _, err := fmt.Fprintf(w, "id: %d\n\n", last); err != nil {
+						return
+					}
+					id = last
+				}
+				last = ev.Rev
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+			if err != nil {
+				return
+			}
+		case <-heartbeat:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func parseEventFilter(q url.Values) (*visor.EventFilter, error) {
+	f := &visor.EventFilter{
+		App:      q.Get("app"),
+		Proc:     q.Get("proc"),
+		Revision: q.Get("rev"),
+		Env:      q.Get("env"),
+	}
+	for _, types := range q["type"] {
+		for _, t := range strings.Split(types, ",") {
+			if t != "" {
+				f.Types = append(f.Types, visor.EventType(t))
+			}
+		}
+	}
+	if id := q.Get("instance"); id != "" {
+		var err error
+		f.InstanceId, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, visor.NewError(visor.ErrInvalidArgument, "invalid instance id '"+id+"'")
+		}
+	}
+	return f, nil
+}
+
+func parseSince(r *http.Request) (int64, error) {
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	if since == "" {
+		return 0, nil
+	}
+	rev, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || rev < 0 {
+		return 0, visor.NewError(visor.ErrInvalidArgument, "invalid revision '"+since+"'")
+	}
+	return rev, nil
+}
+
+func encodeEventFilter(f *visor.EventFilter) url.Values {
+	q := url.Values{}
+	if f == nil {
+		return q
+	}
+	types := make([]string, len(f.Types))
+	for i, t := range f.Types {
+		types[i] = string(t)
+	}
+	for k, v := range map[string]string{
+		"type": strings.Join(types, ","),
+		"app":  f.App,
+		"proc": f.Proc,
+		"rev":  f.Revision,
+		"env":  f.Env,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if f.InstanceId != 0 {
+		q.Set("instance", strconv.FormatInt(f.InstanceId, 10))
+	}
+	return q
+}
+
+// WatchEvents sends the events matching f to listener until ctx is done or
+// the stream fails, like visor.Store.WatchEventFilterSince. If since is 0
+// the stream starts at the current revision. The last revision whose
+// events were all received is returned, to resume from. The listener is
+// closed on return.
+func (c *Client) WatchEvents(ctx context.Context, f *visor.EventFilter, since int64, listener chan *visor.Event) (int64, error) {
+	defer close(listener)
+
+	req, err := http.NewRequest("GET", c.url+"/events?"+encodeEventFilter(f).Encode(), nil)
+	if err != nil {
+		return since, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if since > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(since, 10))
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return since, ctxErr(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		e := &errorBody{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return since, &StatusError{resp.StatusCode, "GET /events: " + resp.Status}
+		}
+		return since, decodeError(e, resp.StatusCode)
+	}
+
+	var etype, data string
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			field, value := line, ""
+			if i := strings.Index(line, ":"); i >= 0 {
+				field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+			}
+			switch field {
+			case "id":
+				// The events of the revision were all sent.
+				if rev, err := strconv.ParseInt(value, 10, 64); err == nil {
+					since = rev
+				}
+			case "event":
+				etype = value
+			case "data":
+				if data != "" {
+					data += "\n"
+				}
+				data += value
+			}
+			continue
+		}
+		if data == "" {
+			// A heartbeat.
+			continue
+		}
+		if etype == "error" {
+			e := &errorBody{}
+			if err := json.Unmarshal([]byte(data), e); err != nil {
+				return since, err
+			}
+			return since, decodeError(e, http.StatusInternalServerError)
+		}
+		ev := &visor.Event{}
+		if err := json.Unmarshal([]byte(data), ev); err != nil {
+			return since, err
+		}
+		etype, data = "", ""
+
+		select {
+		case listener <- ev:
+		case <-ctx.Done():
+			return since, ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return since, ctxErr(ctx, err)
+	}
+	return since, ctxErr(ctx, fmt.Errorf("GET /events: stream closed"))
+}
+
+// ctxErr returns the error of ctx in place of err if ctx is done, as the
+// request failed because of it.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
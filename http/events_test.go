@@ -0,0 +1,173 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+func expectClientEvent(t *testing.T, l chan *visor.Event, etype visor.EventType) *visor.Event {
+	select {
+	case ev := <-l:
+		if ev == nil {
+			t.Fatalf("expected %s, got closed stream", etype)
+		}
+		if ev.Type != etype {
+			t.Errorf("expected %s, got %s", etype, ev.Type)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected %s, got timeout", etype)
+	}
+	return nil
+}
+
+func TestWatchEvents(t *testing.T) {
+	s, c, done := serverSetup(t)
+	defer done()
+
+	st, err := s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := st.GetSnapshot().Rev
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := make(chan *visor.Event)
+	f := &visor.EventFilter{Types: []visor.EventType{visor.EvInsReg}, App: "cat"}
+	go c.WatchEvents(ctx, f, since, l)
+
+	if _, err := s.RegisterInstance("dog", "128af9", "web", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	cat, err := s.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectClientEvent(t, l, visor.EvInsReg)
+	if ins, ok := ev.Source.(*visor.Instance); !ok || ins.Id != cat.Id || ins.AppName != "cat" {
+		t.Errorf("expected registration of %d, got %#v", cat.Id, ev.Source)
+	}
+	cancel()
+
+	// Resume right after the event received.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	bird, err := s.RegisterInstance("cat", "128af9", "worker", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = make(chan *visor.Event)
+	go c.WatchEvents(ctx, f, ev.Rev, l)
+
+	ev = expectClientEvent(t, l, visor.EvInsReg)
+	if ins, ok := ev.Source.(*visor.Instance); !ok || ins.Id != bird.Id {
+		t.Errorf("expected registration of %d, got %#v", bird.Id, ev.Source)
+	}
+}
+
+func TestWatchEventsRevision(t *testing.T) {
+	s, c, done := serverSetup(t)
+	defer done()
+
+	st, err := s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := st.GetSnapshot().Rev
+
+	body := time.Now().UTC().Format(time.RFC3339) + " 1.0"
+	sp, err := st.GetSnapshot().Txn().Set("/pms/cat", body).Set("/pms/dog", body).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(since int64, n int) int64 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := make(chan *visor.Event)
+		revc := make(chan int64, 1)
+		go func() {
+			rev, _ := c.WatchEvents(ctx, nil, since, l)
+			revc <- rev
+		}()
+		for i := 0; i < n; i++ {
+			expectClientEvent(t, l, visor.EvPmJoin)
+		}
+		cancel()
+		return <-revc
+	}
+
+	// The revision isn't complete before the next one starts.
+	if rev := watch(since, 2); rev != since {
+		t.Errorf("expected to resume from %d, got %d", since, rev)
+	}
+
+	if _, err = s.RegisterPm("bird", "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if rev := watch(since, 3); rev != sp.Rev {
+		t.Errorf("expected to resume from %d, got %d", sp.Rev, rev)
+	}
+}
+
+func TestEventsQuery(t *testing.T) {
+	s, _, done := serverSetup(t)
+	defer done()
+
+	srv := httptest.NewServer(NewServer(s))
+	defer srv.Close()
+
+	for _, query := range []string{"instance=cat", "since=-1", "since=x"} {
+		resp, err := http.Get(srv.URL + "/events?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %s", query, resp.Status)
+		}
+	}
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	s, _, done := serverSetup(t)
+	defer done()
+
+	server := NewServer(s)
+	server.Heartbeat = 10 * time.Millisecond
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %s", ct)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, ": heartbeat") {
+		t.Errorf("expected a heartbeat, got %q", line)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// parseQuery reads a visor.Query from the parameters of GET /instances:
+//
+//	app, proc, rev, env, host, claimer    match the fields of the instance
+//	status=<status>,...                   match any of the statuses
+//	registered-after, registered-before   RFC 3339 timestamps
+//	min-restarts, max-restarts            restarts over all reasons
+//	locked=true|false                     match locked or unlocked instances
+//	sort=id|registered|restarts, reverse, offset, limit
+func parseQuery(v url.Values) (visor.Query, error) {
+	q := visor.Query{
+		App:      v.Get("app"),
+		Proc:     v.Get("proc"),
+		Revision: v.Get("rev"),
+		Env:      v.Get("env"),
+		Host:     v.Get("host"),
+		Claimer:  v.Get("claimer"),
+		Sort:     visor.SortOrder(v.Get("sort")),
+	}
+	for _, statuses := range v["status"] {
+		for _, s := range strings.Split(statuses, ",") {
+			if s != "" {
+				q.Status = append(q.Status, visor.InsStatus(s))
+			}
+		}
+	}
+
+	var err error
+	parseTime := func(name string, t *time.Time) {
+		if s := v.Get(name); s != "" && err == nil {
+			if *t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				err = invalidParam(name, s)
+			}
+		}
+	}
+	parseInt := func(name string) *int {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return nil
+		}
+		n, e := strconv.Atoi(s)
+		if e != nil {
+			err = invalidParam(name, s)
+			return nil
+		}
+		return &n
+	}
+	parseBool := func(name string) *bool {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return nil
+		}
+		b, e := strconv.ParseBool(s)
+		if e != nil {
+			err = invalidParam(name, s)
+			return nil
+		}
+		return &b
+	}
+
+	parseTime("registered-after", &q.RegisteredAfter)
+	parseTime("registered-before", &q.RegisteredBefore)
+	q.MinRestarts = parseInt("min-restarts")
+	q.MaxRestarts = parseInt("max-restarts")
+	q.Locked = parseBool("locked")
+	if reverse := parseBool("reverse"); reverse != nil {
+		q.Reverse = *reverse
+	}
+	if offset := parseInt("offset"); offset != nil {
+		q.Offset = *offset
+	}
+	if limit := parseInt("limit"); limit != nil {
+		q.Limit = *limit
+	}
+	return q, err
+}
+
+func invalidParam(name, value string) error {
+	return visor.NewError(visor.ErrInvalidArgument, "invalid "+name+" '"+value+"'")
+}
+
+func encodeQuery(q visor.Query) url.Values {
+	v := url.Values{}
+	statuses := make([]string, len(q.Status))
+	for i, s := range q.Status {
+		statuses[i] = string(s)
+	}
+	for k, s := range map[string]string{
+		"app":     q.App,
+		"proc":    q.Proc,
+		"rev":     q.Revision,
+		"env":     q.Env,
+		"host":    q.Host,
+		"claimer": q.Claimer,
+		"status":  strings.Join(statuses, ","),
+		"sort":    string(q.Sort),
+	} {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	if !q.RegisteredAfter.IsZero() {
+		v.Set("registered-after", q.RegisteredAfter.Format(time.RFC3339Nano))
+	}
+	if !q.RegisteredBefore.IsZero() {
+		v.Set("registered-before", q.RegisteredBefore.Format(time.RFC3339Nano))
+	}
+	if q.MinRestarts != nil {
+		v.Set("min-restarts", strconv.Itoa(*q.MinRestarts))
+	}
+	if q.MaxRestarts != nil {
+		v.Set("max-restarts", strconv.Itoa(*q.MaxRestarts))
+	}
+	if q.Locked != nil {
+		v.Set("locked", strconv.FormatBool(*q.Locked))
+	}
+	if q.Reverse {
+		v.Set("reverse", "true")
+	}
+	if q.Offset != 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
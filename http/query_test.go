@@ -0,0 +1,50 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+func TestQueryParams(t *testing.T) {
+	max, locked := 3, false
+	q := visor.Query{
+		App:              "cat",
+		Proc:             "web",
+		Revision:         "128af9",
+		Env:              "prod",
+		Host:             "box",
+		Claimer:          "10.0.0.1",
+		Status:           []visor.InsStatus{visor.InsStatusRunning, visor.InsStatusLost},
+		RegisteredAfter:  time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC),
+		RegisteredBefore: time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC),
+		MaxRestarts:      &max,
+		Locked:           &locked,
+		Sort:             visor.SortByRegistered,
+		Reverse:          true,
+		Offset:           10,
+		Limit:            5,
+	}
+	got, err := parseQuery(encodeQuery(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, q) {
+		t.Errorf("expected %+v, got %+v", q, got)
+	}
+
+	for _, params := range []string{"limit=a", "locked=maybe", "registered-after=yesterday"} {
+		v, _ := url.ParseQuery(params)
+		if _, err := parseQuery(v); err == nil || !visor.IsErrInvalidArgument(err) {
+			t.Errorf("expected %s to be invalid, got %v", params, err)
+		}
+	}
+}
@@ -0,0 +1,602 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Package http exposes a visor.Store as REST resources and provides a
+// Client for them, so that tools don't need access to the coordinator.
+//
+// All bodies are JSON, entities are encoded as by the visor package.
+// Errors are returned as {"error": <message>, "code": <code>} with a
+// status derived from the error, see errorCodes.
+//
+//	GET    /apps                                list apps
+//	POST   /apps                                register an app
+//	GET    /apps/{app}                          get an app
+//	DELETE /apps/{app}                          unregister an app
+//	GET    /apps/{app}/revs                     list revisions
+//	POST   /apps/{app}/revs                     register a revision
+//	GET    /apps/{app}/revs/{rev}               get a revision
+//	DELETE /apps/{app}/revs/{rev}               unregister a revision
+//	GET    /apps/{app}/envs                     list envs
+//	POST   /apps/{app}/envs                     register an env
+//	GET    /apps/{app}/envs/{env}               get an env
+//	DELETE /apps/{app}/envs/{env}               unregister an env
+//	GET    /apps/{app}/procs                    list procs
+//	POST   /apps/{app}/procs                    register a proc
+//	GET    /apps/{app}/procs/{proc}             get a proc
+//	DELETE /apps/{app}/procs/{proc}             unregister a proc
+//	GET    /apps/{app}/procs/{proc}/instances   list the instances of a proc
+//	GET    /instances?app=&status=&limit=...    find instances, see parseQuery
+//	POST   /instances                           register an instance
+//	GET    /instances/{id}                      get an instance
+//	GET    /instances/{id}/history              get the history of an instance
+//	DELETE /instances/{id}?client=&reason=      unregister an instance
+//	POST   /instances/{id}/{action}             claim, renew, unclaim, started, heartbeat,
+//	                                            restarted, stop, failed, lost, exited, lock
+//	                                            or unlock an instance
+//	GET    /scale/{app}/{rev}/{proc}            get the scale of a proc
+//	PUT    /scale/{app}/{rev}/{proc}/{env}      scale a proc
+//	GET    /runners?host=                       list runners
+//	POST   /runners                             register a runner
+//	GET    /runners/{addr}                      get a runner
+//	DELETE /runners/{addr}                      unregister a runner
+//	GET    /{loggers,proxies,pms}               list services
+//	PUT    /{loggers,proxies,pms}/{addr}        register a service
+//	DELETE /{loggers,proxies,pms}/{addr}        unregister a service
+//	GET    /events                              stream events, see Server.Heartbeat
+//
+// Loggers are addressed by host:port, proxies and pms by host.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// An Action is a change of the state of an instance, see
+// Client.InstanceAction.
+type Action struct {
+	Host     string `json:"host,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	TelePort int    `json:"tele-port,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	// Lease is the duration of a claim in the format of time.Duration,
+	// visor.DefaultClaimLease if empty.
+	Lease string `json:"lease,omitempty"`
+}
+
+type scaleBody struct {
+	Factor    int               `json:"factor"`
+	Current   int               `json:"current"`
+	Instances []*visor.Instance `json:"instances,omitempty"`
+}
+
+type serviceBody struct {
+	Version string `json:"version,omitempty"`
+}
+
+// A Server serves the REST resources of a Store. Every request is handled
+// at the latest revision of the coordinator.
+type Server struct {
+	store *visor.Store
+	mux   *http.ServeMux
+
+	// Heartbeat is the interval of the comments sent on idle event
+	// streams, which keep proxies from closing them. Zero disables them.
+	Heartbeat time.Duration
+}
+
+func NewServer(store *visor.Store) *Server {
+	s := &Server{store: store, mux: http.NewServeMux(), Heartbeat: DefaultHeartbeat}
+
+	s.handle("GET /apps", s.getApps)
+	s.handle("POST /apps", s.registerApp)
+	s.handle("GET /apps/{app}", s.getApp)
+	s.handle("DELETE /apps/{app}", s.unregisterApp)
+	s.handle("GET /apps/{app}/revs", s.getRevisions)
+	s.handle("POST /apps/{app}/revs", s.registerRevision)
+	s.handle("GET /apps/{app}/revs/{rev}", s.getRevision)
+	s.handle("DELETE /apps/{app}/revs/{rev}", s.unregisterRevision)
+	s.handle("GET /apps/{app}/envs", s.getEnvs)
+	s.handle("POST /apps/{app}/envs", s.registerEnv)
+	s.handle("GET /apps/{app}/envs/{env}", s.getEnv)
+	s.handle("DELETE /apps/{app}/envs/{env}", s.unregisterEnv)
+	s.handle("GET /apps/{app}/procs", s.getProcs)
+	s.handle("POST /apps/{app}/procs", s.registerProc)
+	s.handle("GET /apps/{app}/procs/{proc}", s.getProc)
+	s.handle("DELETE /apps/{app}/procs/{proc}", s.unregisterProc)
+	s.handle("GET /apps/{app}/procs/{proc}/instances", s.getProcInstances)
+	s.handle("GET /instances", s.getInstances)
+	s.handle("POST /instances", s.registerInstance)
+	s.handle("GET /instances/{id}", s.getInstance)
+	s.handle("GET /instances/{id}/history", s.getInstanceHistory)
+	s.handle("DELETE /instances/{id}", s.unregisterInstance)
+	s.handle("POST /instances/{id}/{action}", s.instanceAction)
+	s.handle("GET /scale/{app}/{rev}/{proc}", s.getScale)
+	s.handle("PUT /scale/{app}/{rev}/{proc}/{env}", s.scale)
+	s.handle("GET /runners", s.getRunners)
+	s.handle("POST /runners", s.registerRunner)
+	s.handle("GET /runners/{addr}", s.getRunner)
+	s.handle("DELETE /runners/{addr}", s.unregisterRunner)
+	for _, service := range []string{"loggers", "proxies", "pms"} {
+		s.handle("GET /"+service, s.getServices(service))
+		s.handle("PUT /"+service+"/{addr}", s.registerService(service))
+		s.handle("DELETE /"+service+"/{addr}", s.unregisterService(service))
+	}
+	s.mux.HandleFunc("GET /events", s.events)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// A handler returns the status and body of a successful response.
+type handler func(st *visor.Store, r *http.Request) (int, interface{}, error)
+
+func (s *Server) handle(pattern string, h handler) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		st, err := s.store.FastForward()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		status, body, err := h(st, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, status, body)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	body, status := encodeError(err)
+	writeJSON(w, status, body)
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return visor.NewError(visor.ErrInvalidArgument, "invalid body: "+err.Error())
+	}
+	return nil
+}
+
+// Apps
+
+func (s *Server) getApps(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	apps, err := st.GetApps()
+	return http.StatusOK, apps, err
+}
+
+func (s *Server) registerApp(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	v := &visor.App{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	app := st.NewApp(v.Name, v.RepoUrl, v.Stack)
+	app.Env = v.Env
+	app.DeployType = v.DeployType
+
+	app, err := app.Register()
+	return http.StatusCreated, app, err
+}
+
+func (s *Server) getApp(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	return http.StatusOK, app, err
+}
+
+func (s *Server) unregisterApp(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, app.Unregister()
+}
+
+// Revisions
+
+func (s *Server) getRevisions(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	revs, err := app.GetRevisions()
+	return http.StatusOK, revs, err
+}
+
+func (s *Server) registerRevision(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	v := &visor.Revision{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	rev, err := st.NewRevision(app, v.Ref, v.ArchiveUrl).Register()
+	return http.StatusCreated, rev, err
+}
+
+func (s *Server) getRevision(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	rev, err := app.GetRevision(r.PathValue("rev"))
+	return http.StatusOK, rev, err
+}
+
+func (s *Server) unregisterRevision(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	rev, err := app.GetRevision(r.PathValue("rev"))
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, rev.Unregister()
+}
+
+// Envs
+
+func (s *Server) getEnvs(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	envs, err := app.GetEnvs()
+	return http.StatusOK, envs, err
+}
+
+func (s *Server) registerEnv(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	v := &visor.Env{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	env, err := app.NewEnv(v.Ref, v.Vars).Register()
+	return http.StatusCreated, env, err
+}
+
+func (s *Server) getEnv(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	env, err := app.GetEnv(r.PathValue("env"))
+	return http.StatusOK, env, err
+}
+
+func (s *Server) unregisterEnv(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	env, err := app.GetEnv(r.PathValue("env"))
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, env.Unregister()
+}
+
+// Procs
+
+func (s *Server) getProcs(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	procs, err := app.GetProcs()
+	return http.StatusOK, procs, err
+}
+
+func (s *Server) registerProc(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	v := &visor.Proc{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	proc := st.NewProc(app, v.Name)
+	proc.Attrs = v.Attrs
+
+	proc, err = proc.Register()
+	if err != nil {
+		return 0, nil, err
+	}
+	if proc.Attrs.Limits.MemoryLimitMb != nil {
+		proc, err = proc.StoreAttrs()
+	}
+	return http.StatusCreated, proc, err
+}
+
+func (s *Server) getProc(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	proc, err := app.GetProc(r.PathValue("proc"))
+	return http.StatusOK, proc, err
+}
+
+func (s *Server) unregisterProc(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	proc, err := app.GetProc(r.PathValue("proc"))
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, proc.Unregister()
+}
+
+func (s *Server) getProcInstances(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	app, err := st.GetApp(r.PathValue("app"))
+	if err != nil {
+		return 0, nil, err
+	}
+	proc, err := app.GetProc(r.PathValue("proc"))
+	if err != nil {
+		return 0, nil, err
+	}
+	instances, err := proc.GetInstances()
+	return http.StatusOK, instances, err
+}
+
+// Instances
+
+func (s *Server) getInstances(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		return 0, nil, err
+	}
+	instances, err := st.FindInstances(q)
+	return http.StatusOK, instances, err
+}
+
+func (s *Server) registerInstance(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	v := &visor.Instance{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	ins, err := st.RegisterInstance(v.AppName, v.RevisionName, v.ProcessName, v.Env)
+	return http.StatusCreated, ins, err
+}
+
+func (s *Server) getInstance(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	ins, err := getInstance(st, r)
+	return http.StatusOK, ins, err
+}
+
+func (s *Server) getInstanceHistory(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	id, err := instanceId(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	history, err := st.GetInstanceHistory(id)
+	return http.StatusOK, history, err
+}
+
+func (s *Server) unregisterInstance(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	ins, err := getInstance(st, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	q := r.URL.Query()
+	return http.StatusNoContent, nil, ins.Unregister(q.Get("client"), errors.New(q.Get("reason")))
+}
+
+func (s *Server) instanceAction(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	ins, err := getInstance(st, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	a := &Action{}
+	if err := readJSON(r, a); err != nil {
+		return 0, nil, err
+	}
+
+	switch r.PathValue("action") {
+	case "claim", "renew":
+		lease := visor.DefaultClaimLease
+		if a.Lease != "" {
+			if lease, err = time.ParseDuration(a.Lease); err != nil {
+				return 0, nil, visor.NewError(visor.ErrInvalidArgument, "invalid lease "+a.Lease)
+			}
+		}
+		if r.PathValue("action") == "claim" {
+			ins, err = ins.ClaimLease(a.Host, lease)
+		} else {
+			ins, err = ins.RenewClaim(a.Host, lease)
+		}
+	case "unclaim":
+		ins, err = ins.Unclaim(a.Host)
+	case "started":
+		ins, err = ins.Started(a.Host, a.Hostname, a.Port, a.TelePort)
+	case "heartbeat":
+		ins, err = ins.Heartbeat(a.Host)
+	case "restarted":
+		ins, err = ins.Restarted(visor.RestartReason(a.Reason), a.Count)
+	case "stop":
+		err = ins.Stop()
+	case "failed":
+		ins, err = ins.Failed(a.Host, errors.New(a.Reason))
+	case "lost":
+		ins, err = ins.Lost(a.Client, errors.New(a.Reason))
+	case "exited":
+		ins, err = ins.Exited(a.Host)
+	case "lock":
+		ins, err = ins.Lock(a.Client, errors.New(a.Reason))
+	case "unlock":
+		ins, err = ins.Unlock()
+	default:
+		return 0, nil, visor.NewError(visor.ErrNotFound, "unknown action "+r.PathValue("action"))
+	}
+	return http.StatusOK, ins, err
+}
+
+func getInstance(st *visor.Store, r *http.Request) (*visor.Instance, error) {
+	id, err := instanceId(r)
+	if err != nil {
+		return nil, err
+	}
+	return st.GetInstance(id)
+}
+
+func instanceId(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, visor.NewError(visor.ErrInvalidArgument, "invalid instance id "+r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// Scale
+
+func (s *Server) getScale(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	scale, _, err := st.GetScale(r.PathValue("app"), r.PathValue("rev"), r.PathValue("proc"))
+	return http.StatusOK, &scaleBody{Factor: scale, Current: scale}, err
+}
+
+func (s *Server) scale(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	v := &scaleBody{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	if v.Factor < 0 {
+		return 0, nil, visor.NewError(visor.ErrInvalidArgument, "scaling factor needs to be a positive integer")
+	}
+	instances, current, err := st.Scale(r.PathValue("app"), r.PathValue("rev"), r.PathValue("proc"), r.PathValue("env"), v.Factor)
+	return http.StatusOK, &scaleBody{Factor: v.Factor, Current: current, Instances: instances}, err
+}
+
+// Runners
+
+func (s *Server) getRunners(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	if host := r.URL.Query().Get("host"); host != "" {
+		runners, err := st.RunnersByHost(host)
+		if visor.IsErrNoEnt(err) {
+			return http.StatusOK, []*visor.Runner{}, nil
+		}
+		return http.StatusOK, runners, err
+	}
+	runners, err := st.Runners()
+	if visor.IsErrNoEnt(err) {
+		return http.StatusOK, []*visor.Runner{}, nil
+	}
+	return http.StatusOK, runners, err
+}
+
+func (s *Server) registerRunner(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	v := &visor.Runner{}
+	if err := readJSON(r, v); err != nil {
+		return 0, nil, err
+	}
+	runner, err := st.NewRunner(v.Addr, v.InstanceId, nil).Register()
+	return http.StatusCreated, runner, err
+}
+
+func (s *Server) getRunner(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	runner, err := st.GetRunner(r.PathValue("addr"))
+	return http.StatusOK, runner, err
+}
+
+func (s *Server) unregisterRunner(st *visor.Store, r *http.Request) (int, interface{}, error) {
+	runner, err := st.GetRunner(r.PathValue("addr"))
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, runner.Unregister()
+}
+
+// Services
+
+func (s *Server) getServices(service string) handler {
+	return func(st *visor.Store, r *http.Request) (int, interface{}, error) {
+		var (
+			names []string
+			err   error
+		)
+		switch service {
+		case "loggers":
+			names, err = st.GetLoggers()
+		case "proxies":
+			names, err = st.GetProxies()
+		case "pms":
+			names, err = st.GetPms()
+		}
+		if visor.IsErrNoEnt(err) {
+			names, err = []string{}, nil
+		}
+		return http.StatusOK, names, err
+	}
+}
+
+func (s *Server) registerService(service string) handler {
+	return func(st *visor.Store, r *http.Request) (int, interface{}, error) {
+		v := &serviceBody{}
+		if r.ContentLength != 0 {
+			if err := readJSON(r, v); err != nil {
+				return 0, nil, err
+			}
+		}
+		addr := r.PathValue("addr")
+
+		var err error
+		switch service {
+		case "loggers":
+			_, err = st.RegisterLogger(addr, v.Version)
+		case "proxies":
+			_, err = st.RegisterProxy(addr)
+		case "pms":
+			_, err = st.RegisterPm(addr, v.Version)
+		}
+		return http.StatusNoContent, nil, err
+	}
+}
+
+func (s *Server) unregisterService(service string) handler {
+	return func(st *visor.Store, r *http.Request) (int, interface{}, error) {
+		addr := r.PathValue("addr")
+
+		var err error
+		switch service {
+		case "loggers":
+			err = st.UnregisterLogger(addr)
+		case "proxies":
+			err = st.UnregisterProxy(addr)
+		case "pms":
+			err = st.UnregisterPm(addr)
+		}
+		return http.StatusNoContent, nil, err
+	}
+}
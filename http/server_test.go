@@ -0,0 +1,359 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+func serverSetup(t *testing.T) (*visor.Store, *Client, func()) {
+	s, err := visor.NewStore(visor.NewMemBackend(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewServer(s))
+
+	return s, NewClient(srv.URL), srv.Close
+}
+
+func TestApps(t *testing.T) {
+	_, c, done := serverSetup(t)
+	defer done()
+
+	app := &visor.App{Name: "cat", RepoUrl: "git://cat.git", Stack: "whiskers", Env: map[string]string{"HOME": "/home/cat"}}
+	app, err := c.RegisterApp(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.DeployType != visor.DeployLXC || app.Registered.IsZero() {
+		t.Errorf("expected registered app, got %#v", app)
+	}
+	_, err = c.RegisterApp(app)
+	if !visor.IsErrConflict(err) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+
+	got, err := c.GetApp("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "cat" || got.Stack != "whiskers" || !got.Registered.Equal(app.Registered) {
+		t.Errorf("expected app %#v, got %#v", app, got)
+	}
+	apps, err := c.GetApps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Name != "cat" {
+		t.Errorf("expected app cat to be listed, got %v", apps)
+	}
+
+	rev, err := c.RegisterRevision("cat", "128af9", "http://archive/cat.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.App.Name != "cat" || rev.Ref != "128af9" {
+		t.Errorf("unexpected revision %#v", rev)
+	}
+	revs, err := c.GetRevisions("cat")
+	if err != nil || len(revs) != 1 {
+		t.Errorf("expected one revision, got %v (%v)", revs, err)
+	}
+
+	env, err := c.RegisterEnv("cat", "prod", map[string]string{"PORT": "80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err = c.GetEnv("cat", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env.Vars, map[string]string{"PORT": "80"}) {
+		t.Errorf("unexpected env vars %v", env.Vars)
+	}
+
+	limit := 512
+	proc, err := c.RegisterProc("cat", "web", visor.ProcAttrs{Limits: visor.ResourceLimits{MemoryLimitMb: &limit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err = c.GetProc("cat", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proc.Port == 0 || proc.Attrs.Limits.MemoryLimitMb == nil || *proc.Attrs.Limits.MemoryLimitMb != limit {
+		t.Errorf("unexpected proc %#v", proc)
+	}
+	_, err = c.RegisterProc("cat", "web-1", visor.ProcAttrs{})
+	if !visor.IsErrInvalidArgument(err) && !isErr(err, visor.ErrBadProcName) {
+		t.Errorf("expected invalid proc name to be rejected, got %v", err)
+	}
+
+	for _, unreg := range []func() error{
+		func() error { return c.UnregisterProc("cat", "web") },
+		func() error { return c.UnregisterEnv("cat", "prod") },
+		func() error { return c.UnregisterRevision("cat", "128af9") },
+		func() error { return c.UnregisterApp("cat") },
+	} {
+		if err := unreg(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = c.GetApp("cat")
+	if !visor.IsErrNotFound(err) {
+		t.Errorf("expected app to be gone, got %v", err)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	s, c, done := serverSetup(t)
+	defer done()
+
+	_, err := c.RegisterApp(&visor.App{Name: "cat", RepoUrl: "git://cat.git", Stack: "whiskers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.RegisterRevision("cat", "128af9", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.RegisterProc("cat", "web", visor.ProcAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.RegisterEnv("cat", "prod", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	instances, current, err := c.Scale("cat", "128af9", "web", "prod", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 || current != 0 {
+		t.Fatalf("expected two new instances, got %v (%d)", instances, current)
+	}
+	scale, err := c.GetScale("cat", "128af9", "web")
+	if err != nil || scale != 2 {
+		t.Errorf("expected scale 2, got %d (%v)", scale, err)
+	}
+	_, _, err = c.Scale("cat", "128af9", "web", "prod", -1)
+	if !visor.IsErrInvalidArgument(err) {
+		t.Errorf("expected negative factor to be rejected, got %v", err)
+	}
+
+	ins, err := c.RegisterInstance("cat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = c.Claim(ins.Id, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.Claimed.IsZero() {
+		t.Errorf("expected instance to be claimed, got %#v", ins)
+	}
+	_, err = c.Claim(ins.Id, "10.0.0.2")
+	if !visor.IsErrInsClaimed(err) {
+		t.Errorf("expected instance to be claimed already, got %v", err)
+	}
+	ins, err = c.RenewClaim(ins.Id, "10.0.0.1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(ins.Lease) < 59*time.Minute {
+		t.Errorf("expected the lease to be renewed, got %s", ins.Lease)
+	}
+	ins, err = c.Started(ins.Id, "10.0.0.1", "box", 9000, 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = c.Heartbeat(ins.Id, "10.0.0.1"); err != nil || ins.LastHeartbeat.IsZero() {
+		t.Errorf("expected a heartbeat, got %v (%v)", ins, err)
+	}
+	ins, err = c.Restarted(ins.Id, visor.RestartOOM, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.Status != visor.InsStatusRunning || ins.Port != 9000 || ins.Restarts.OOM != 1 {
+		t.Errorf("unexpected instance %#v", ins)
+	}
+	ins, err = c.Lock(ins.Id, "deploy", "rollout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Lock(ins.Id, "deploy", "rollout")
+	if !visor.IsErrUnauthorized(err) {
+		t.Errorf("expected locked instance to be rejected, got %v", err)
+	}
+	if _, err = c.Unlock(ins.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Stop(ins.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Exited(ins.Id, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.GetInstance(ins.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != visor.InsStatusExited {
+		t.Errorf("expected instance to be exited, got %s", got.Status)
+	}
+	all, err := c.GetInstances()
+	if err != nil || len(all) != 3 {
+		t.Errorf("expected three instances, got %v (%v)", all, err)
+	}
+	one := 1
+	found, err := c.FindInstances(visor.Query{Status: []visor.InsStatus{visor.InsStatusExited}, MinRestarts: &one})
+	if err != nil || len(found) != 1 || found[0].Id != ins.Id {
+		t.Errorf("expected to find instance %d, got %v (%v)", ins.Id, found, err)
+	}
+	found, err = c.FindInstances(visor.Query{App: "cat", Sort: visor.SortById, Reverse: true, Limit: 2})
+	if err != nil || len(found) != 2 || found[0].Id != ins.Id {
+		t.Errorf("expected a page starting at instance %d, got %v (%v)", ins.Id, found, err)
+	}
+	_, err = c.FindInstances(visor.Query{Sort: "name"})
+	if !visor.IsErrInvalidArgument(err) {
+		t.Errorf("expected unknown sort order to be rejected, got %v", err)
+	}
+	procInstances, err := c.GetProcInstances("cat", "web")
+	if err != nil || len(procInstances) != 2 {
+		t.Errorf("expected two instances of the proc, got %v (%v)", procInstances, err)
+	}
+
+	if err = c.UnregisterInstance(instances[0].Id, "client", "scaled down"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetInstance(instances[0].Id)
+	if !visor.IsErrNotFound(err) {
+		t.Errorf("expected instance to be gone, got %v", err)
+	}
+	_, err = s.GetInstance(instances[1].Id)
+	if err != nil {
+		t.Errorf("expected instance %d to be kept, got %v", instances[1].Id, err)
+	}
+	history, err := c.GetInstanceHistory(instances[0].Id)
+	if err != nil || len(history) == 0 || history[len(history)-1].Event != visor.HistDone {
+		t.Errorf("expected the history of the unregistered instance, got %v (%v)", history, err)
+	}
+}
+
+func TestRunnersAndServices(t *testing.T) {
+	_, c, done := serverSetup(t)
+	defer done()
+
+	runners, err := c.GetRunners("")
+	if err != nil || len(runners) != 0 {
+		t.Errorf("expected no runners, got %v (%v)", runners, err)
+	}
+	r, err := c.RegisterRunner("10.0.0.1:5000", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.RegisterRunner("10.0.0.1:5000", 43); !visor.IsErrConflict(err) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+	r, err = c.GetRunner(r.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.InstanceId != 42 {
+		t.Errorf("expected runner of instance 42, got %d", r.InstanceId)
+	}
+	runners, err = c.GetRunners("10.0.0.1")
+	if err != nil || len(runners) != 1 {
+		t.Errorf("expected one runner on host, got %v (%v)", runners, err)
+	}
+	if err = c.UnregisterRunner(r.Addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.RegisterLogger("10.0.0.3:9000", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RegisterProxy("10.0.0.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RegisterPm("10.0.0.1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		get  func() ([]string, error)
+		want []string
+	}{
+		{c.GetLoggers, []string{"10.0.0.3:9000"}},
+		{c.GetProxies, []string{"10.0.0.4"}},
+		{c.GetPms, []string{"10.0.0.1"}},
+	} {
+		got, err := test.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expected %v, got %v", test.want, got)
+		}
+	}
+	if err = c.UnregisterLogger("10.0.0.3:9000"); err != nil {
+		t.Fatal(err)
+	}
+	loggers, err := c.GetLoggers()
+	if err != nil || len(loggers) != 0 {
+		t.Errorf("expected no loggers, got %v (%v)", loggers, err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{visor.NewError(visor.ErrNotFound, "gone"), http.StatusNotFound},
+		{visor.ErrConflict, http.StatusConflict},
+		{visor.NewError(visor.ErrInvalidArgument, "bad"), http.StatusBadRequest},
+		{visor.NewError(visor.ErrUnauthorized, "locked"), http.StatusForbidden},
+		{visor.ErrCompacted, http.StatusGone},
+		{errors.New("boom"), http.StatusInternalServerError},
+	} {
+		body, status := encodeError(test.err)
+		if status != test.status {
+			t.Errorf("expected %v to map to %d, got %d", test.err, test.status, status)
+		}
+		err := decodeError(body, status)
+		if status == http.StatusInternalServerError {
+			if _, ok := err.(*StatusError); !ok {
+				t.Errorf("expected a StatusError for %v, got %#v", test.err, err)
+			}
+			continue
+		}
+		if !isErr(err, test.err) || err.Error() != test.err.Error() {
+			t.Errorf("expected %v to round-trip, got %#v", test.err, err)
+		}
+	}
+}
+
+func isErr(err, target error) bool {
+	cause := func(e error) error {
+		if ve, ok := e.(*visor.Error); ok {
+			return ve.Err
+		}
+		return e
+	}
+	return cause(err) == cause(target)
+}
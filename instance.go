@@ -6,8 +6,8 @@
 package visor
 
 import (
+	"context"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
 	"path"
 	"sort"
 	"strconv"
@@ -22,6 +22,8 @@ const (
 	failedPath    = "failed"
 	lostPath      = "lost"
 	lockPath      = "lock"
+	leasePath     = "lease"
+	heartbeatPath = "heartbeat"
 	objectPath    = "object"
 	startPath     = "start"
 	statusPath    = "status"
@@ -53,6 +55,29 @@ const (
 
 type InsStatus string
 
+// insTransitions lists the statuses an instance can move to from each of
+// its statuses. Done instances are removed, they can't move anymore.
+var insTransitions = map[InsStatus][]InsStatus{
+	InsStatusPending:  {InsStatusClaimed, InsStatusLost, InsStatusDone},
+	InsStatusClaimed:  {InsStatusPending, InsStatusRunning, InsStatusFailed, InsStatusLost, InsStatusDone},
+	InsStatusRunning:  {InsStatusStopping, InsStatusFailed, InsStatusLost, InsStatusDone},
+	InsStatusStopping: {InsStatusExited, InsStatusFailed, InsStatusLost, InsStatusDone},
+	InsStatusFailed:   {InsStatusDone},
+	InsStatusExited:   {InsStatusDone},
+	InsStatusLost:     {InsStatusDone},
+}
+
+// CanTransition reports whether an instance can move from status s to
+// status to.
+func (s InsStatus) CanTransition(to InsStatus) bool {
+	for _, status := range insTransitions[s] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
 type InsRestarts struct {
 	OOM, Fail int
 }
@@ -71,7 +96,7 @@ func (p Int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 // Instance represents service instances.
 type Instance struct {
-	dir          *cp.Dir
+	dir          *dir
 	Id           int64
 	AppName      string
 	RevisionName string
@@ -85,9 +110,15 @@ type Instance struct {
 	Restarts     *InsRestarts
 	Registered   time.Time
 	Claimed      time.Time
+	// Lease is the deadline of the claim of a claimed instance, see
+	// ClaimLease. It's zero if the claim doesn't expire.
+	Lease time.Time
+	// LastHeartbeat is the time of the last heartbeat of a started
+	// instance, see Heartbeat.
+	LastHeartbeat time.Time
 }
 
-func (i *Instance) GetSnapshot() cp.Snapshot {
+func (i *Instance) GetSnapshot() Snapshot {
 	return i.dir.Snapshot
 }
 
@@ -121,46 +152,53 @@ func (s *Store) RegisterInstance(app, rev, proc, env string) (ins *Instance, err
 		ProcessName:  proc,
 		Env:          env,
 		Status:       InsStatusPending,
-		dir:          cp.NewDir(instancePath(id), s.GetSnapshot()),
+		dir:          newDir(instancePath(id), s.GetSnapshot()),
 		Restarts:     new(InsRestarts),
 	}
 
-	object := cp.NewFile(ins.dir.Prefix("object"), ins.objectArray(), new(cp.ListCodec), s.GetSnapshot())
-	object, err = object.Save()
-	if err != nil {
-		return nil, err
-	}
 	reg := time.Now()
-	_, err = ins.dir.Set(registeredPath, formatTime(reg))
-	if err != nil {
-		return
-	}
-	ins.Registered = reg
-	_, err = ins.GetSnapshot().Set(ins.procStatusPath(InsStatusRunning), formatTime(reg))
-	if err != nil {
-		return nil, err
-	}
 
-	start := cp.NewFile(ins.dir.Prefix(startPath), "", new(cp.StringCodec), s.GetSnapshot())
-	start, err = start.Save()
+	txn := s.GetSnapshot().Txn().
+		setValue(ins.dir.Prefix(objectPath), ins.objectArray(), new(listCodec)).
+		Set(ins.dir.Prefix(registeredPath), formatTime(reg)).
+		Set(ins.procStatusPath(InsStatusRunning), formatTime(reg)).
+		Set(ins.dir.Prefix(startPath), "")
+	sp, err := ins.record(txn, HistoryEntry{Event: HistRegistered}).Commit()
 	if err != nil {
 		return nil, err
 	}
-	ins.dir = ins.dir.Join(start)
+	ins.Registered = reg
+	ins.dir = ins.dir.Join(sp)
 
 	return
 }
 
+// Unregister moves the instance to the done lookup of its proc and removes
+// it, both in a single transaction. Its history is kept.
 func (i *Instance) Unregister(client string, reason error) error {
-	i, err := i.updateLookup(i.Status, InsStatusDone, fmt.Sprintf("%s %s %s", timestamp(), client, reason))
+	from, sp, err := i.transition(InsStatusDone)
 	if err != nil {
 		return err
 	}
-	return i.dir.Del("/")
+	txn := i.lookup(sp.Txn(), from, InsStatusDone, fmt.Sprintf("%s %s %s", timestamp(), client, reason)).
+		Del(i.dir.Name)
+	_, err = i.record(txn, HistoryEntry{Event: HistDone, Host: client, Reason: errString(reason)}).Commit()
+	return err
 }
 
-// Claim locks the instance to the specified host.
+// Claim locks the instance to the specified host for DefaultClaimLease,
+// see ClaimLease.
 func (i *Instance) Claim(host string) (*Instance, error) {
+	return i.ClaimLease(host, DefaultClaimLease)
+}
+
+// ClaimLease locks the instance to the specified host until lease has
+// passed. The claimer has to start the instance or renew the claim with
+// RenewClaim before that, or ReapClaims will unclaim it.
+func (i *Instance) ClaimLease(host string, lease time.Duration) (*Instance, error) {
+	if lease <= 0 {
+		return nil, errorf(ErrInvalidArgument, "claim lease must be positive, got %s", lease)
+	}
 	done, err := i.IsDone()
 	if err != nil {
 		return nil, err
@@ -177,33 +215,121 @@ func (i *Instance) Claim(host string) (*Instance, error) {
 	//           object = <app> <rev> <proc>
 	// -         start  =
 	// +         start  = 10.0.0.1
+	// +         lease  = 2012-07-19 16:32 UTC
 	//
-	f, err := i.dir.GetFile(startPath, new(cp.ListCodec))
+	from, sp, err := i.transition(InsStatusClaimed)
 	if err != nil {
+		switch from {
+		case InsStatusClaimed, InsStatusRunning, InsStatusStopping:
+			err = errorf(ErrInsClaimed, "%s already claimed", i)
+		}
 		return nil, err
 	}
-	fields := f.Value.([]string)
-	if len(fields) > 0 {
-		return nil, errorf(ErrInsClaimed, "%s already claimed", i)
-	}
-	d := i.dir.Join(f)
 
-	d, err = d.Set(startPath, host)
+	claimed := time.Now()
+	deadline := leaseDeadline(lease)
+	txn := sp.Txn().
+		Set(i.dir.Prefix(startPath), host).
+		Set(i.dir.Prefix(leasePath), formatTime(deadline)).
+		Set(i.claimPath(host), formatTime(claimed))
+	sp, err = i.record(txn, HistoryEntry{Event: HistClaimed, Host: host}).Commit()
 	if err != nil {
-		if cp.IsErrRevMismatch(err) {
+		if IsErrRevMismatch(err) {
 			err = errorf(ErrInsClaimed, "%s already claimed", i)
 		}
 		return i, err
 	}
+	i.Claimed = claimed
+	i.Lease = deadline
+	i.dir = i.dir.Join(sp)
+	return i, err
+}
 
-	claimed := time.Now()
-	d, err = i.claimDir().Join(d).Set(host, formatTime(claimed))
+// RenewClaim extends the claim of host to lease from now.
+func (i *Instance) RenewClaim(host string, lease time.Duration) (*Instance, error) {
+	//
+	//   instances/
+	//       6868/
+	//           start  = 10.0.0.1
+	// -         lease  = 2012-07-19 16:32 UTC
+	// +         lease  = 2012-07-19 16:35 UTC
+	//
+	if lease <= 0 {
+		return nil, errorf(ErrInvalidArgument, "claim lease must be positive, got %s", lease)
+	}
+	sp, err := i.GetSnapshot().FastForward()
 	if err != nil {
 		return nil, err
 	}
-	i.Claimed = claimed
-	i.dir = i.dir.Join(d)
-	return i, err
+	current, err := getInstance(i.Id, sp)
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != InsStatusClaimed {
+		return nil, errorf(ErrInvalidState, "%s isn't claimed", i)
+	}
+	if current.Ip != host {
+		return nil, errorf(ErrUnauthorized, "instance %d has different claimer: %s != %s", i.Id, current.Ip, host)
+	}
+
+	// Conflicts with ReapClaims, which rewrites the lease.
+	deadline := leaseDeadline(lease)
+	sp, err = sp.Txn().Set(i.dir.Prefix(leasePath), formatTime(deadline)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	i.Lease = deadline
+	i.dir = i.dir.Join(sp)
+	return i, nil
+}
+
+// expireClaim unclaims the instance if its lease has passed at now, and
+// records the expiry in the claim. It reports whether the claim expired,
+// which it doesn't if the instance changed since it was read.
+func (i *Instance) expireClaim(now time.Time) (bool, error) {
+	//
+	//   instances/
+	//       6868/
+	//           claims/
+	// -             10.0.0.1 = 2012-07-19 16:22 UTC
+	// +             10.0.0.1 = 2012-07-19 16:22 UTC claim lease expired at 2012-07-19 16:32 UTC
+	// -         start  = 10.0.0.1
+	// +         start  =
+	// -         lease  = 2012-07-19 16:32 UTC
+	// +         lease  =
+	//
+	if i.Status != InsStatusClaimed || i.Lease.IsZero() || now.Before(i.Lease) {
+		return false, nil
+	}
+	host := i.Ip
+	reason := "claim lease expired at " + formatTime(i.Lease)
+	claim := reason
+	if !i.Claimed.IsZero() {
+		claim = formatTime(i.Claimed) + " " + reason
+	}
+
+	txn := i.GetSnapshot().Txn().
+		Set(i.dir.Prefix(startPath), "").
+		Set(i.dir.Prefix(leasePath), "").
+		Set(i.claimPath(host), claim)
+	sp, err := i.record(txn, HistoryEntry{Event: HistUnclaimed, Host: host, Reason: reason}).Commit()
+	if IsErrRevMismatch(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	i.Ip = ""
+	i.Status = InsStatusPending
+	i.Lease = time.Time{}
+	i.dir = i.dir.Join(sp)
+	return true, nil
+}
+
+// leaseDeadline returns the deadline of a lease starting now, in the
+// precision it's stored in.
+func leaseDeadline(lease time.Duration) time.Time {
+	return time.Now().Add(lease).Truncate(time.Second)
 }
 
 // Claims returns the list of claimers.
@@ -213,7 +339,7 @@ func (i *Instance) Claims() (claims []string, err error) {
 		return
 	}
 	claims, err = sp.Getdir(i.dir.Prefix("claims"))
-	if cp.IsErrNoEnt(err) {
+	if IsErrNoEnt(err) {
 		claims = []string{}
 		err = nil
 	}
@@ -232,12 +358,19 @@ func (i *Instance) Unclaim(host string) (*Instance, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, sp, err := i.transition(InsStatusPending)
+	if err != nil {
+		return nil, err
+	}
 
-	d, err := i.setClaimer("")
+	txn := sp.Txn().Set(i.dir.Prefix(startPath), "")
+	sp, err = i.record(txn, HistoryEntry{Event: HistUnclaimed, Host: host}).Commit()
 	if err != nil {
 		return nil, err
 	}
-	i.dir = d
+	i.Ip = ""
+	i.Status = InsStatusPending
+	i.dir = i.dir.Join(sp)
 
 	return i, nil
 }
@@ -249,26 +382,69 @@ func (i *Instance) Started(host, hostname string, port, telePort int) (*Instance
 	//           object = <app> <rev> <proc>
 	// -         start  = 10.0.0.1
 	// +         start  = 10.0.0.1 24690 localhost 24691
+	// +         heartbeat = 2012-07-19 16:23 UTC
 	//
-	if i.Status == InsStatusRunning {
-		return i, nil
-	}
 	err := i.verifyClaimer(host)
 	if err != nil {
 		return nil, err
 	}
+	_, sp, err := i.transition(InsStatusRunning)
+	if err != nil {
+		return nil, err
+	}
 	i.started(host, hostname, port, telePort)
 
-	start := cp.NewFile(i.dir.Prefix(startPath), i.startArray(), new(cp.ListCodec), i.GetSnapshot())
-	start, err = start.Save()
+	beat := time.Now().Truncate(time.Second)
+	txn := sp.Txn().
+		setValue(i.dir.Prefix(startPath), i.startArray(), new(listCodec)).
+		Set(i.dir.Prefix(heartbeatPath), formatTime(beat))
+	sp, err = i.record(txn, HistoryEntry{Event: HistStarted, Host: hostname, Ip: host, Port: port}).Commit()
 	if err != nil {
 		return nil, err
 	}
-	i.dir = i.dir.Join(start)
+	i.LastHeartbeat = beat
+	i.dir = i.dir.Join(sp)
 
 	return i, nil
 }
 
+// Heartbeat tells the coordinator that the started instance is still alive
+// on host. Instances which stop sending heartbeats are found lost by a
+// LostDetector.
+func (i *Instance) Heartbeat(host string) (*Instance, error) {
+	//
+	//   instances/
+	//       6868/
+	//           start     = 10.0.0.1 24690 localhost 24691
+	// -         heartbeat = 2012-07-19 16:23 UTC
+	// +         heartbeat = 2012-07-19 16:24 UTC
+	//
+	sp, err := i.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	current, err := getInstance(i.Id, sp)
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != InsStatusRunning && current.Status != InsStatusStopping {
+		return nil, errorf(ErrInvalidState, "%s isn't started", i)
+	}
+	if current.Ip != host {
+		return nil, errorf(ErrUnauthorized, "instance %d has different claimer: %s != %s", i.Id, current.Ip, host)
+	}
+
+	// Conflicts with a LostDetector, which clears the heartbeat.
+	beat := time.Now().Truncate(time.Second)
+	sp, err = sp.Txn().Set(i.dir.Prefix(heartbeatPath), formatTime(beat)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	i.LastHeartbeat = beat
+	i.dir = i.dir.Join(sp)
+	return i, nil
+}
+
 // Restarted tells the coordinator that the instance has been restarted.
 func (i *Instance) Restarted(reason RestartReason, count int) (*Instance, error) {
 	//
@@ -285,8 +461,12 @@ func (i *Instance) Restarted(reason RestartReason, count int) (*Instance, error)
 	//           start    = 10.0.0.1 24691 localhost
 	// +         restarts = 1 0
 	//
-	if i.Status != InsStatusRunning {
-		return i, nil
+	status, _, err := i.currentStatus()
+	if err != nil {
+		return nil, err
+	}
+	if status != InsStatusRunning {
+		return nil, &StateError{i.Id, status, InsStatusRunning}
 	}
 
 	restarts, f, err := i.getRestarts()
@@ -301,12 +481,13 @@ func (i *Instance) Restarted(reason RestartReason, count int) (*Instance, error)
 		i.Restarts.OOM = restarts.OOM + count
 	}
 
-	f, err = f.Set(i.Restarts.Fields())
+	txn := f.Snapshot.Txn().setValue(f.Path, i.Restarts.Fields(), new(listIntCodec))
+	sp, err := i.record(txn, HistoryEntry{Event: HistRestarted, Count: count, Reason: string(reason)}).Commit()
 	if err != nil {
 		return nil, err
 	}
 
-	i.dir = i.dir.Join(f)
+	i.dir = i.dir.Join(sp)
 
 	return i, nil
 }
@@ -318,13 +499,14 @@ func (i *Instance) Stop() error {
 	//           ...
 	// +         stop =
 	//
-	if i.Status != InsStatusRunning {
-		return ErrInvalidState
-	}
-	_, err := i.dir.Set("stop", "")
+	_, sp, err := i.transition(InsStatusStopping)
 	if err != nil {
 		return err
 	}
+	txn := sp.Txn().Set(i.dir.Prefix(stopPath), "")
+	if _, err = i.record(txn, HistoryEntry{Event: HistStop}).Commit(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -334,45 +516,92 @@ func (i *Instance) Failed(host string, reason error) (*Instance, error) {
 	if err != nil {
 		return nil, err
 	}
-	current := i.Status
-
-	_, err = i.updateStatus(InsStatusFailed)
+	from, sp, err := i.transition(InsStatusFailed)
 	if err != nil {
 		return nil, err
 	}
-	return i.updateLookup(current, InsStatusFailed, fmt.Sprintf("%s %s", timestamp(), reason))
+	return i.moveTo(sp.Txn(), from, InsStatusFailed, fmt.Sprintf("%s %s", timestamp(), reason),
+		HistoryEntry{Event: HistFailed, Host: host, Reason: errString(reason)})
 }
 
 // Lost transitions the instance into lost state and updates the
 // coordinator with client and reason.
 func (i *Instance) Lost(client string, reason error) (*Instance, error) {
-	current := i.Status
-
-	_, err := i.updateStatus(InsStatusLost)
+	from, sp, err := i.transition(InsStatusLost)
 	if err != nil {
 		return nil, err
 	}
-	return i.updateLookup(current, InsStatusLost, fmt.Sprintf("%s %s %s", timestamp(), client, reason))
+	return i.lost(sp.Txn(), from, client, reason)
 }
 
-// Exited tells the coordinator that the instance has exited.
-func (i *Instance) Exited(host string) (i1 *Instance, err error) {
-	if err = i.verifyClaimer(host); err != nil {
-		return
+func (i *Instance) lost(txn *Txn, from InsStatus, client string, reason error) (*Instance, error) {
+	return i.moveTo(txn, from, InsStatusLost, fmt.Sprintf("%s %s %s", timestamp(), client, reason),
+		HistoryEntry{Event: HistLost, Host: client, Reason: errString(reason)})
+}
+
+// expireHeartbeat marks the started instance lost by client if its last
+// heartbeat is older than timeout at now. It reports whether the instance
+// was lost, which it isn't if it changed since it was read.
+func (i *Instance) expireHeartbeat(now time.Time, timeout time.Duration, client string) (bool, error) {
+	//
+	//   instances/
+	//       6868/
+	// -         heartbeat = 2012-07-19 16:23 UTC
+	// +         heartbeat =
+	// +         status    = lost
+	//
+	if i.Status != InsStatusRunning && i.Status != InsStatusStopping {
+		return false, nil
+	}
+	if i.LastHeartbeat.IsZero() || now.Sub(i.LastHeartbeat) < timeout {
+		return false, nil
+	}
+	reason := fmt.Errorf("no heartbeat since %s", formatTime(i.LastHeartbeat))
+	txn := i.GetSnapshot().Txn().Set(i.dir.Prefix(heartbeatPath), "")
+	_, err := i.lost(txn, i.Status, client, reason)
+	if IsErrRevMismatch(err) {
+		return false, nil
 	}
-	i1, err = i.updateStatus(InsStatusExited)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Exited tells the coordinator that the stopped instance has exited. It's
+// removed from the lookup of its proc.
+func (i *Instance) Exited(host string) (*Instance, error) {
+	err := i.verifyClaimer(host)
 	if err != nil {
 		return nil, err
 	}
-	err = i.dir.Snapshot.Del(i.procStatusPath(InsStatusExited))
+	_, sp, err := i.transition(InsStatusExited)
+	if err != nil {
+		return nil, err
+	}
+	txn := sp.Txn().
+		Set(i.dir.Prefix(statusPath), string(InsStatusExited)).
+		Del(i.procStatusPath(InsStatusExited))
+	sp, err = i.record(txn, HistoryEntry{Event: HistExited, Host: host}).Commit()
+	if err != nil {
+		return nil, err
+	}
+	i.Status = InsStatusExited
+	i.dir = i.dir.Join(sp)
 
-	return
+	return i, nil
 }
 
 func (i *Instance) WaitStatus() (*Instance, error) {
+	return i.WaitStatusContext(context.Background())
+}
+
+// WaitStatusContext is like WaitStatus, but returns ctx.Err() once ctx is
+// done. The same applies to all other Wait*Context methods.
+func (i *Instance) WaitStatusContext(ctx context.Context) (*Instance, error) {
 	p := path.Join(instancesPath, strconv.FormatInt(i.Id, 10), statusPath)
 	sp := i.GetSnapshot()
-	ev, err := sp.Wait(p)
+	ev, err := sp.wait(ctx, p)
 	if err != nil {
 		return nil, err
 	}
@@ -383,17 +612,29 @@ func (i *Instance) WaitStatus() (*Instance, error) {
 }
 
 func (i *Instance) WaitClaimed() (i1 *Instance, err error) {
-	return i.waitStartPathStatus(InsStatusClaimed)
+	return i.waitStartPathStatus(context.Background(), InsStatusClaimed)
+}
+
+func (i *Instance) WaitClaimedContext(ctx context.Context) (*Instance, error) {
+	return i.waitStartPathStatus(ctx, InsStatusClaimed)
 }
 
 func (i *Instance) WaitStarted() (i1 *Instance, err error) {
-	return i.waitStartPathStatus(InsStatusRunning)
+	return i.waitStartPathStatus(context.Background(), InsStatusRunning)
+}
+
+func (i *Instance) WaitStartedContext(ctx context.Context) (*Instance, error) {
+	return i.waitStartPathStatus(ctx, InsStatusRunning)
 }
 
 func (i *Instance) WaitStop() (*Instance, error) {
+	return i.WaitStopContext(context.Background())
+}
+
+func (i *Instance) WaitStopContext(ctx context.Context) (*Instance, error) {
 	p := path.Join(instancesPath, strconv.FormatInt(i.Id, 10), stopPath)
 	sp := i.GetSnapshot()
-	ev, err := sp.Wait(p)
+	ev, err := sp.wait(ctx, p)
 	if err != nil {
 		return nil, err
 	}
@@ -404,42 +645,27 @@ func (i *Instance) WaitStop() (*Instance, error) {
 }
 
 func (i *Instance) WaitExited() (*Instance, error) {
-	for {
-		i, err := i.WaitStatus()
-		if err != nil {
-			return nil, err
-		}
-		if i.Status == InsStatusExited {
-			break
-		}
-	}
-	return i, nil
+	return i.waitStatus(context.Background(), InsStatusExited)
+}
+
+func (i *Instance) WaitExitedContext(ctx context.Context) (*Instance, error) {
+	return i.waitStatus(ctx, InsStatusExited)
 }
 
 func (i *Instance) WaitFailed() (*Instance, error) {
-	for {
-		i, err := i.WaitStatus()
-		if err != nil {
-			return nil, err
-		}
-		if i.Status == InsStatusFailed {
-			break
-		}
-	}
-	return i, nil
+	return i.waitStatus(context.Background(), InsStatusFailed)
+}
+
+func (i *Instance) WaitFailedContext(ctx context.Context) (*Instance, error) {
+	return i.waitStatus(ctx, InsStatusFailed)
 }
 
 func (i *Instance) WaitLost() (*Instance, error) {
-	for {
-		i, err := i.WaitStatus()
-		if err != nil {
-			return nil, err
-		}
-		if i.Status == InsStatusLost {
-			break
-		}
-	}
-	return i, nil
+	return i.waitStatus(context.Background(), InsStatusLost)
+}
+
+func (i *Instance) WaitLostContext(ctx context.Context) (*Instance, error) {
+	return i.waitStatus(ctx, InsStatusLost)
 }
 
 func (i *Instance) GetStatusInfo() (string, error) {
@@ -532,8 +758,8 @@ func (i *Instance) claimPath(host string) string {
 	return i.dir.Prefix("claims", host)
 }
 
-func (i *Instance) claimDir() *cp.Dir {
-	return cp.NewDir(i.dir.Prefix(claimsPath), i.GetSnapshot())
+func (i *Instance) claimDir() *dir {
+	return newDir(i.dir.Prefix(claimsPath), i.GetSnapshot())
 }
 
 func (i *Instance) idString() string {
@@ -572,12 +798,47 @@ func (i *Instance) procLostPath() string {
 	return path.Join(appsPath, i.AppName, procsPath, i.ProcessName, lostPath, i.idString())
 }
 
+// parseStart sets the address and the status of the instance from the
+// fields of its start file, "<ip> <port> <hostname> <teleport>". The
+// instance is pending while the file is empty, claimed once it has an ip
+// and running once it has a port. Other statuses are kept in the status
+// and stop files.
+func (i *Instance) parseStart(fields []string) error {
+	if len(fields) == 0 {
+		i.Ip = ""
+		i.Status = InsStatusPending
+		return nil
+	}
+	if len(fields) == 1 {
+		i.claimed(fields[0])
+		return nil
+	}
+
+	port, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return errorf(ErrInvalidFile, "invalid port number '%s' of instance %d", fields[1], i.Id)
+	}
+	host, telePort := "", 0
+	if len(fields) > 2 {
+		host = fields[2]
+	}
+	// TODO (alx) This branch becomes unnecessary as soon as all components are migrated.
+	if len(fields) > 3 {
+		telePort, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return errorf(ErrInvalidFile, "invalid port number '%s' of instance %d", fields[3], i.Id)
+		}
+	}
+	i.started(fields[0], host, port, telePort)
+	return nil
+}
+
 func (i *Instance) claimed(ip string) {
 	i.Ip = ip
 	i.Status = InsStatusClaimed
 }
 
-func (i *Instance) getRestarts() (*InsRestarts, *cp.File, error) {
+func (i *Instance) getRestarts() (*InsRestarts, *file, error) {
 	sp, err := i.GetSnapshot().FastForward()
 	if err != nil {
 		return nil, nil, err
@@ -585,7 +846,7 @@ func (i *Instance) getRestarts() (*InsRestarts, *cp.File, error) {
 	i.dir = i.dir.Join(sp)
 
 	restarts := new(InsRestarts)
-	f, err := sp.GetFile(i.dir.Prefix(restartsPath), new(cp.ListIntCodec))
+	f, err := sp.getFile(i.dir.Prefix(restartsPath), new(listIntCodec))
 	if err == nil {
 		fields := f.Value.([]int)
 
@@ -594,7 +855,7 @@ func (i *Instance) getRestarts() (*InsRestarts, *cp.File, error) {
 		if len(fields) > 1 {
 			restarts.OOM = fields[restartOOMField]
 		}
-	} else if !cp.IsErrNoEnt(err) {
+	} else if !IsErrNoEnt(err) {
 		return nil, nil, err
 	}
 	return restarts, f, nil
@@ -608,15 +869,32 @@ func (i *Instance) started(ip, host string, port, telePort int) {
 	i.Status = InsStatusRunning
 }
 
-func (i *Instance) updateStatus(s InsStatus) (*Instance, error) {
-	d, err := i.dir.Set("status", string(s))
+// currentStatus reads the status of the instance at the latest revision.
+// Writes based on the status are made at the returned snapshot, so that
+// they fail with ErrRevMismatch if the instance changed in between.
+func (i *Instance) currentStatus() (InsStatus, Snapshot, error) {
+	sp, err := i.GetSnapshot().FastForward()
 	if err != nil {
-		return nil, err
+		return "", sp, err
+	}
+	current, err := getInstance(i.Id, sp)
+	if err != nil {
+		return "", sp, err
 	}
-	i.Status = s
-	i.dir = d
+	return current.Status, sp, nil
+}
 
-	return i, nil
+// transition checks that the instance can move from its current status to
+// status to, see insTransitions, and returns the current status.
+func (i *Instance) transition(to InsStatus) (InsStatus, Snapshot, error) {
+	from, sp, err := i.currentStatus()
+	if err != nil {
+		return "", sp, err
+	}
+	if !from.CanTransition(to) {
+		return from, sp, &StateError{i.Id, from, to}
+	}
+	return from, sp, nil
 }
 
 func (i *Instance) getClaimer() (*string, error) {
@@ -625,7 +903,7 @@ func (i *Instance) getClaimer() (*string, error) {
 		return nil, err
 	}
 	i.dir = i.dir.Join(sp)
-	f, err := sp.GetFile(i.dir.Prefix(startPath), new(cp.ListCodec))
+	f, err := sp.getFile(i.dir.Prefix(startPath), new(listCodec))
 	if err != nil {
 		return nil, err
 	}
@@ -637,14 +915,6 @@ func (i *Instance) getClaimer() (*string, error) {
 	return &fields[0], nil
 }
 
-func (i *Instance) setClaimer(claimer string) (*cp.Dir, error) {
-	d, err := i.dir.Set(startPath, claimer)
-	if err != nil {
-		return nil, err
-	}
-	return d, nil
-}
-
 func (i *Instance) verifyClaimer(host string) error {
 	claimer, err := i.getClaimer()
 	if err != nil {
@@ -674,63 +944,51 @@ func (i *Instance) procStatusPath(status InsStatus) string {
 	}
 }
 
-func (i *Instance) updateLookup(from, to InsStatus, value string) (*Instance, error) {
-	sp, err := i.GetSnapshot().Set(i.procStatusPath(to), value)
+// moveTo sets the status of the instance, moves it from the proc lookup of
+// status from to the one of status to and records e in its history, all
+// as part of txn.
+func (i *Instance) moveTo(txn *Txn, from, to InsStatus, value string, e HistoryEntry) (*Instance, error) {
+	txn = i.lookup(txn.Set(i.dir.Prefix(statusPath), string(to)), from, to, value)
+	sp, err := i.record(txn, e).Commit()
 	if err != nil {
 		return nil, err
 	}
-
+	i.Status = to
 	i.dir = i.dir.Join(sp)
 
-	err = i.dir.Snapshot.Del(i.procStatusPath(from))
-	if err != nil {
-		return nil, err
-	}
-
 	return i, nil
 }
 
-func (i *Instance) waitStartPath() (*Instance, error) {
+// lookup adds the ops moving the instance from the proc lookup of status
+// from to the one of status to to txn.
+func (i *Instance) lookup(txn *Txn, from, to InsStatus, value string) *Txn {
+	if i.procStatusPath(from) != i.procStatusPath(to) {
+		txn.Del(i.procStatusPath(from))
+	}
+	return txn.Set(i.procStatusPath(to), value)
+}
+
+func (i *Instance) waitStartPath(ctx context.Context) (*Instance, error) {
 	p := path.Join(instancesPath, strconv.FormatInt(i.Id, 10), startPath)
 	sp := i.GetSnapshot()
-	ev, err := sp.Wait(p)
+	ev, err := sp.wait(ctx, p)
 	if err != nil {
 		return nil, err
 	}
 	i.dir = i.dir.Join(ev)
-	parts, err := new(cp.ListCodec).Decode(ev.Body)
+	parts, err := new(listCodec).Decode(ev.Body)
 	if err != nil {
 		return nil, err
 	}
-	fields := parts.([]string)
-	if len(fields) >= 3 {
-		ip, host := fields[0], fields[2]
-		port, err := strconv.Atoi(fields[1])
-		if err != nil {
-			return nil, err
-		}
-
-		// TODO (alx) This branch becomes unnecessary as soon as all components are migrated.
-		telePort := 0
-		if len(fields) >= 4 {
-			telePort, err = strconv.Atoi(fields[3])
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		i.started(ip, host, port, telePort)
-	} else if len(fields) > 0 {
-		i.claimed(fields[0])
-	} else {
-		// TODO
+	if err := i.parseStart(parts.([]string)); err != nil {
+		return nil, err
 	}
 	return i, nil
 }
 
-func (i *Instance) waitStartPathStatus(s InsStatus) (i1 *Instance, err error) {
+func (i *Instance) waitStartPathStatus(ctx context.Context, s InsStatus) (i1 *Instance, err error) {
 	for {
-		i, err = i.waitStartPath()
+		i, err = i.waitStartPath(ctx)
 		if err != nil {
 			return i, err
 		}
@@ -741,67 +999,120 @@ func (i *Instance) waitStartPathStatus(s InsStatus) (i1 *Instance, err error) {
 	return i, nil
 }
 
+func (i *Instance) waitStatus(ctx context.Context, s InsStatus) (*Instance, error) {
+	for {
+		i, err := i.WaitStatusContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if i.Status == s {
+			return i, nil
+		}
+	}
+}
+
 func (s *Store) GetInstances() ([]*Instance, error) {
 	sp, err := s.GetSnapshot().FastForward()
 	if err != nil {
 		return nil, err
 	}
-	ids, err := sp.Getdir(instancesPath)
+	names, err := sp.Getdir(instancesPath)
 	if err != nil {
 		return nil, err
 	}
 
-	instances := []*Instance{}
-	ch, errch := cp.GetSnapshotables(ids, func(idstr string) (cp.Snapshotable, error) {
-		id, err := parseInstanceId(idstr)
+	ids := []int64{}
+	for _, name := range names {
+		id, err := parseInstanceId(name)
 		if err != nil {
-			return nil, err
-		}
-		return getInstance(id, sp)
-	})
-	errStr := ""
-	for i := 0; i < len(ids); i++ {
-		select {
-		case i := <-ch:
-			instances = append(instances, i.(*Instance))
-		case err := <-errch:
-			errStr = fmt.Sprintf("%s\n%s", errStr, err)
+			// Not an instance, reported by Fsck.
+			continue
 		}
+		ids = append(ids, id)
 	}
-	if len(errStr) > 0 {
-		return instances, NewError(ErrNotFound, errStr)
+
+	instances, errs := getInstancesById(ids, sp)
+	if errs != nil {
+		return instances, errs
 	}
+	return instances, nil
+}
 
+// getInstancesById reads the instances with ids in parallel. The errors of
+// those which couldn't be read are returned as an InstancesError, which is
+// nil if all could be read.
+func getInstancesById(ids []int64, sp Snapshot) ([]*Instance, InstancesError) {
+	instances := []*Instance{}
+	errs := InstancesError{}
+
+	type result struct {
+		id  int64
+		ins *Instance
+		err error
+	}
+	ch := make(chan result, len(ids))
+
+	for _, id := range ids {
+		go func(id int64) {
+			ins, err := getInstance(id, sp)
+			ch <- result{id, ins, err}
+		}(id)
+	}
+	for range ids {
+		r := <-ch
+		if r.err != nil {
+			errs[r.id] = r.err
+		} else {
+			instances = append(instances, r.ins)
+		}
+	}
+	if len(errs) > 0 {
+		return instances, errs
+	}
 	return instances, nil
 }
 
 func (s *Store) WatchInstanceStart(listener chan *Instance, errors chan error) {
+	_, err := s.watchInstanceStart(context.Background(), listener)
+	errors <- err
+}
+
+// WatchInstanceStartContext is like WatchInstanceStart, but returns once
+// ctx is done, see WatchEventRawContext.
+func (s *Store) WatchInstanceStartContext(ctx context.Context, listener chan *Instance) (int64, error) {
+	defer close(listener)
+	return s.watchInstanceStart(ctx, listener)
+}
+
+func (s *Store) watchInstanceStart(ctx context.Context, listener chan *Instance) (int64, error) {
 	// instances/*/start =
 	sp := s.GetSnapshot()
 	for {
-		ev, err := sp.Wait(path.Join(instancesPath, "*", startPath))
+		evs, err := sp.waitAll(ctx, path.Join(instancesPath, "*", startPath))
 		if err != nil {
-			errors <- err
-			return
+			return sp.Rev, err
 		}
-		sp = sp.Join(ev)
-
-		if !ev.IsSet() || string(ev.Body) != "" {
-			continue
-		}
-		idstr := strings.Split(ev.Path, "/")[2]
+		for _, ev := range evs {
+			if !ev.IsSet() || string(ev.Body) != "" {
+				continue
+			}
+			idstr := strings.Split(ev.Path, "/")[2]
 
-		id, err := parseInstanceId(idstr)
-		if err != nil {
-			errors <- err
-			return
-		}
-		ins, err := getInstance(id, ev.GetSnapshot())
-		if err != nil {
-			errors <- err
-			return
+			id, err := parseInstanceId(idstr)
+			if err != nil {
+				return sp.Rev, err
+			}
+			ins, err := getInstance(id, ev.GetSnapshot())
+			if err != nil {
+				return sp.Rev, err
+			}
+			select {
+			case listener <- ins:
+			case <-ctx.Done():
+				return sp.Rev, ctx.Err()
+			}
 		}
-		listener <- ins
+		sp = sp.Join(evs[0])
 	}
 }
 
@@ -817,11 +1128,11 @@ func parseInstanceId(idstr string) (int64, error) {
 	return strconv.ParseInt(idstr, 10, 64)
 }
 
-func getInstance(id int64, s cp.Snapshotable) (*Instance, error) {
+func getInstance(id int64, s Snapshotable) (*Instance, error) {
 	i := &Instance{
 		Id:     id,
 		Status: InsStatusPending,
-		dir:    cp.NewDir(instancePath(id), s.GetSnapshot()),
+		dir:    newDir(instancePath(id), s.GetSnapshot()),
 	}
 
 	exists, _, err := s.GetSnapshot().Exists(i.dir.Name)
@@ -832,38 +1143,19 @@ func getInstance(id int64, s cp.Snapshotable) (*Instance, error) {
 		return nil, errorf(ErrNotFound, `instance '%d' not found`, id)
 	}
 
-	f, err := i.dir.GetFile(startPath, new(cp.ListCodec))
-	if cp.IsErrNoEnt(err) {
+	f, err := i.dir.GetFile(startPath, new(listCodec))
+	if IsErrNoEnt(err) {
 		// Ignore
 	} else if err != nil {
 		return nil, err
 	} else {
-		fields := f.Value.([]string)
-
-		if len(fields) > 0 { // IP
-			i.Status = InsStatusClaimed
-			i.Ip = fields[0]
-		}
-		if len(fields) > 1 { // Port
-			i.Status = InsStatusRunning
-			i.Port, err = strconv.Atoi(fields[1])
-			if err != nil {
-				panic("invalid port number: " + fields[1])
-			}
-		}
-		if len(fields) > 2 { // Hostname
-			i.Host = fields[2]
-		}
-		if len(fields) > 3 { // TelePort
-			i.TelePort, err = strconv.Atoi(fields[3])
-			if err != nil {
-				panic("invalid port number: " + fields[3])
-			}
+		if err := i.parseStart(f.Value.([]string)); err != nil {
+			return nil, err
 		}
 	}
 
 	statusStr, _, err := i.dir.Get(statusPath)
-	if cp.IsErrNoEnt(err) {
+	if IsErrNoEnt(err) {
 		err = nil
 	} else if err == nil {
 		i.Status = InsStatus(statusStr)
@@ -875,12 +1167,34 @@ func getInstance(id int64, s cp.Snapshotable) (*Instance, error) {
 		_, _, err := i.dir.Get(stopPath)
 		if err == nil {
 			i.Status = InsStatusStopping
-		} else if !cp.IsErrNoEnt(err) {
+		} else if !IsErrNoEnt(err) {
 			return nil, err
 		}
 	}
 
-	f, err = i.dir.GetFile(objectPath, new(cp.ListCodec))
+	if i.Status == InsStatusRunning || i.Status == InsStatusStopping {
+		beat, _, err := i.dir.Get(heartbeatPath)
+		if err == nil && beat != "" {
+			if i.LastHeartbeat, err = parseTime(beat); err != nil {
+				return nil, errorf(ErrInvalidFile, "heartbeat file for %d: %s", id, err)
+			}
+		} else if err != nil && !IsErrNoEnt(err) {
+			return nil, err
+		}
+	}
+
+	if i.Status == InsStatusClaimed {
+		lease, _, err := i.dir.Get(leasePath)
+		if err == nil && lease != "" {
+			if i.Lease, err = parseTime(lease); err != nil {
+				return nil, errorf(ErrInvalidFile, "lease file for %d: %s", id, err)
+			}
+		} else if err != nil && !IsErrNoEnt(err) {
+			return nil, err
+		}
+	}
+
+	f, err = i.dir.GetFile(objectPath, new(listCodec))
 	if err != nil {
 		return nil, errorf(ErrNotFound, "object file not found for instance %d", id)
 	}
@@ -903,10 +1217,10 @@ func getInstance(id int64, s cp.Snapshotable) (*Instance, error) {
 		return nil, err
 	}
 
-	f, err = i.dir.GetFile(registeredPath, new(cp.StringCodec))
+	f, err = i.dir.GetFile(registeredPath, new(stringCodec))
 	if err != nil {
 		// FIXME remove as soon as instances have consistent registered field
-		if !cp.IsErrNoEnt(err) {
+		if !IsErrNoEnt(err) {
 			return nil, err
 		}
 	} else {
@@ -920,14 +1234,19 @@ func getInstance(id int64, s cp.Snapshotable) (*Instance, error) {
 		}
 	}
 
-	f, err = i.claimDir().GetFile(i.Ip, new(cp.StringCodec))
+	if i.Ip == "" {
+		return i, nil
+	}
+
+	f, err = i.claimDir().GetFile(i.Ip, new(stringCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			return i, nil
 		}
 		return nil, err
-	} else {
-		i.Claimed, err = parseTime(f.Value.(string))
+	} else if fields := strings.Fields(f.Value.(string)); len(fields) > 0 {
+		// An expired claim is followed by the reason, see expireClaim.
+		i.Claimed, err = parseTime(fields[0])
 		if err != nil {
 			return nil, err
 		}
@@ -936,7 +1255,7 @@ func getInstance(id int64, s cp.Snapshotable) (*Instance, error) {
 	return i, nil
 }
 
-func getInstanceIds(app, rev, proc string, s cp.Snapshotable) (ids Int64Slice, err error) {
+func getInstanceIds(app, rev, proc string, s Snapshotable) (ids Int64Slice, err error) {
 	sp := s.GetSnapshot()
 	p := procInstancesPath(app, rev, proc)
 	exists, _, err := sp.Exists(p)
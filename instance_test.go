@@ -6,7 +6,9 @@
 package visor
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -43,6 +45,25 @@ func instanceSetupClaimed(name, host string) (i *Instance) {
 	return
 }
 
+// setupInstance registers an instance of the proc of cat, which is claimed
+// and started on host unless host is empty.
+func setupInstance(t *testing.T, s *Store, proc, host string) *Instance {
+	ins, err := s.RegisterInstance("cat", "128af9", proc, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host == "" {
+		return ins
+	}
+	if ins, err = ins.Claim(host); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Started(host, "box", 9000, 9001); err != nil {
+		t.Fatal(err)
+	}
+	return ins
+}
+
 func TestInstanceRegisterAndGet(t *testing.T) {
 	s := instanceSetup()
 
@@ -72,6 +93,23 @@ func TestInstanceRegisterAndGet(t *testing.T) {
 	if ins1.Restarts.Fail != 0 {
 		t.Error("restarts != 0")
 	}
+
+	// All files of the instance appear at the same revision.
+	sp := ins.GetSnapshot()
+	for _, p := range []string{
+		ins.dir.Prefix(objectPath),
+		ins.dir.Prefix(registeredPath),
+		ins.dir.Prefix(startPath),
+		ins.procInstancesPath(),
+	} {
+		_, rev, err := sp.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != sp.Rev {
+			t.Errorf("expected %s to be written at %d, got %d", p, sp.Rev, rev)
+		}
+	}
 }
 
 func TestInstanceUnregister(t *testing.T) {
@@ -97,6 +135,9 @@ func TestInstanceUnregister(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err = i.Stop(); err != nil {
+		t.Fatal(err)
+	}
 	i, err = i.Exited(ip)
 	if err != nil {
 		t.Fatal(err)
@@ -189,6 +230,9 @@ func TestInstanceClaiming(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err = i.Stop(); err != nil {
+		t.Fatal(err)
+	}
 	i, err = i.Exited(hostB)
 	if err != nil {
 		t.Fatal(err)
@@ -445,7 +489,7 @@ func TestWatchInstanceStartAndStop(t *testing.T) {
 	go func() {
 		ins, err := ins.WaitStop()
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 		ch <- ins
 	}()
@@ -539,6 +583,26 @@ func TestInstanceWaitStop(t *testing.T) {
 	// }
 }
 
+func TestInstanceWaitContext(t *testing.T) {
+	s := instanceSetup()
+	ins, err := s.RegisterInstance("bobcat", "985245a", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = ins.WaitClaimedContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected wait to end with its context, got %v", err)
+	}
+	_, err = ins.WaitExitedContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected wait to end with its context, got %v", err)
+	}
+}
+
 func TestInstanceLocking(t *testing.T) {
 	ip := "10.0.10.0"
 	ins := instanceSetupClaimed("grumpy-cat", ip)
@@ -575,6 +639,182 @@ func TestInstanceLocking(t *testing.T) {
 	}
 }
 
+func TestInstanceStateErrors(t *testing.T) {
+	ip := "10.0.0.1"
+	ins := instanceSetupClaimed("state-cat", ip)
+
+	_, err := ins.Exited(ip)
+	se, ok := err.(*StateError)
+	if !ok || se.Id != ins.Id || se.From != InsStatusClaimed || se.To != InsStatusExited {
+		t.Fatalf("expected claimed to exited to fail, got %#v", err)
+	}
+	if !IsErrInvalidState(err) {
+		t.Errorf("expected %s to be an invalid state", err)
+	}
+	for name, is := range map[string]func(error) bool{
+		"IsErrConflict":        IsErrConflict,
+		"IsErrUnauthorized":    IsErrUnauthorized,
+		"IsErrNotFound":        IsErrNotFound,
+		"IsErrNoEnt":           IsErrNoEnt,
+		"IsErrRevMismatch":     IsErrRevMismatch,
+		"IsErrCompacted":       IsErrCompacted,
+		"IsErrSchemaMism":      IsErrSchemaMism,
+		"IsErrInsClaimed":      IsErrInsClaimed,
+		"IsErrInvalidFile":     IsErrInvalidFile,
+		"IsErrInvalidArgument": IsErrInvalidArgument,
+		"IsErrInvalidKey":      IsErrInvalidKey,
+	} {
+		if is(err) {
+			t.Errorf("expected %s of %s to be false", name, err)
+		}
+	}
+	if _, err = ins.Restarted(RestartOOM, 1); !IsErrInvalidState(err) {
+		t.Errorf("expected restart of a claimed instance to fail, got %v", err)
+	}
+
+	// The status is read from the coordinator, not from the copy.
+	stale, err := storeFromSnapshotable(ins).GetInstance(ins.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ins.Started(ip, "box", 9000, 9001); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stale.Started(ip, "box", 9000, 9001); !IsErrInvalidState(err) {
+		t.Errorf("expected a stale instance not to start twice, got %v", err)
+	}
+	// A pm claiming a finished instance sees a StateError.
+	if _, err = ins.Failed(ip, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Claim(ip)
+	if IsErrInsClaimed(err) || !IsErrInvalidState(err) {
+		t.Errorf("expected claim of a failed instance to be an invalid state, got %#v", err)
+	}
+}
+
+// insOps are the changes TestInstanceTransitions makes, with the status
+// each moves to.
+var insOps = []struct {
+	name string
+	to   InsStatus
+	do   func(ins *Instance, host string) error
+}{
+	{"claim", InsStatusClaimed, func(ins *Instance, host string) error {
+		_, err := ins.Claim(host)
+		return err
+	}},
+	{"unclaim", InsStatusPending, func(ins *Instance, host string) error {
+		_, err := ins.Unclaim(host)
+		return err
+	}},
+	{"started", InsStatusRunning, func(ins *Instance, host string) error {
+		_, err := ins.Started(host, "box", 9000, 9001)
+		return err
+	}},
+	{"restarted", InsStatusRunning, func(ins *Instance, host string) error {
+		_, err := ins.Restarted(RestartFail, 1)
+		return err
+	}},
+	{"stop", InsStatusStopping, func(ins *Instance, host string) error {
+		return ins.Stop()
+	}},
+	{"failed", InsStatusFailed, func(ins *Instance, host string) error {
+		_, err := ins.Failed(host, errors.New("boom"))
+		return err
+	}},
+	{"lost", InsStatusLost, func(ins *Instance, host string) error {
+		_, err := ins.Lost("watchman", errors.New("gone"))
+		return err
+	}},
+	{"exited", InsStatusExited, func(ins *Instance, host string) error {
+		_, err := ins.Exited(host)
+		return err
+	}},
+	{"unregister", InsStatusDone, func(ins *Instance, host string) error {
+		return ins.Unregister("test", errors.New("done"))
+	}},
+}
+
+// TestInstanceTransitions drives instances through random changes and
+// checks after each that the status and the proc lookups agree with the
+// transition table.
+func TestInstanceTransitions(t *testing.T) {
+	s := instanceSetup()
+	seed := time.Now().UnixNano()
+	r := rand.New(rand.NewSource(seed))
+	host := "10.0.0.1"
+
+	for n := 0; n < 20; n++ {
+		ins, err := s.RegisterInstance("random-cat", "128af9", "web", "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := InsStatus(InsStatusPending)
+		claimed := false
+		trace := []string{}
+
+		for step := 0; step < 12 && want != InsStatusDone; step++ {
+			op := insOps[r.Intn(len(insOps))]
+			trace = append(trace, op.name)
+			err := op.do(ins, host)
+
+			allowed := want.CanTransition(op.to)
+			if op.name == "restarted" {
+				allowed = want == InsStatusRunning
+			}
+			switch {
+			case allowed && err != nil:
+				t.Fatalf("seed %d, %v: expected %s to %s to succeed, got %s", seed, trace, want, op.to, err)
+			case allowed:
+				want = op.to
+				switch op.name {
+				case "claim":
+					claimed = true
+				case "unclaim":
+					claimed = false
+				}
+			case err == nil:
+				t.Fatalf("seed %d, %v: expected %s to %s to fail", seed, trace, want, op.to)
+			case IsErrInvalidState(err):
+			case IsErrUnauthorized(err) && !claimed:
+			case op.name == "claim" && IsErrInsClaimed(err):
+			default:
+				t.Fatalf("seed %d, %v: unexpected error %s", seed, trace, err)
+			}
+			testInstanceLookups(t, ins, want, seed, trace)
+		}
+	}
+}
+
+func testInstanceLookups(t *testing.T, ins *Instance, want InsStatus, seed int64, trace []string) {
+	sp, err := ins.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != InsStatusDone {
+		got, err := getInstance(ins.Id, sp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != want {
+			t.Fatalf("seed %d, %v: expected status %s, got %s", seed, trace, want, got.Status)
+		}
+	}
+	for _, status := range []InsStatus{InsStatusRunning, InsStatusFailed, InsStatusLost, InsStatusDone} {
+		p := ins.procStatusPath(status)
+		exists, _, err := sp.Exists(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Exited instances are only kept in the instance tree.
+		expected := p == ins.procStatusPath(want) && want != InsStatusExited
+		if exists != expected {
+			t.Fatalf("seed %d, %v: expected %s to exist: %t, got %t", seed, trace, p, expected, exists)
+		}
+	}
+}
+
 func testInstanceStatus(s *Store, t *testing.T, id int64, status InsStatus) {
 	ins, err := s.GetInstance(id)
 	if err != nil {
@@ -0,0 +1,440 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// JSONVersion is the version of the JSON documents written for events and
+// entities. Documents of any other version are rejected when decoded.
+const JSONVersion = 1
+
+// Entities decoded from JSON are detached from the coordinator, their
+// snapshot is the zero Snapshot. Get a bound copy from the Store before
+// changing them.
+var detachedStore = &Store{}
+
+type appJSON struct {
+	Version    int               `json:"version"`
+	Name       string            `json:"name"`
+	RepoUrl    string            `json:"repo-url"`
+	Stack      string            `json:"stack"`
+	Head       string            `json:"head,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	DeployType string            `json:"deploy-type"`
+	Registered string            `json:"registered,omitempty"`
+}
+
+func (a *App) MarshalJSON() ([]byte, error) {
+	return json.Marshal(appJSON{
+		Version:    JSONVersion,
+		Name:       a.Name,
+		RepoUrl:    a.RepoUrl,
+		Stack:      a.Stack,
+		Head:       a.Head,
+		Env:        a.Env,
+		DeployType: a.DeployType,
+		Registered: formatJSONTime(a.Registered),
+	})
+}
+
+func (a *App) UnmarshalJSON(data []byte) error {
+	v := appJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "app"); err != nil {
+		return err
+	}
+	registered, err := parseJSONTime(v.Registered)
+	if err != nil {
+		return err
+	}
+	app := detachedStore.NewApp(v.Name, v.RepoUrl, v.Stack)
+	app.Head = v.Head
+	app.DeployType = v.DeployType
+	app.Registered = registered
+	if v.Env != nil {
+		app.Env = v.Env
+	}
+	*a = *app
+	return nil
+}
+
+type revisionJSON struct {
+	Version    int    `json:"version"`
+	App        string `json:"app"`
+	Ref        string `json:"ref"`
+	ArchiveUrl string `json:"archive-url"`
+	Registered string `json:"registered,omitempty"`
+}
+
+func (r *Revision) MarshalJSON() ([]byte, error) {
+	return json.Marshal(revisionJSON{
+		Version:    JSONVersion,
+		App:        appName(r.App),
+		Ref:        r.Ref,
+		ArchiveUrl: r.ArchiveUrl,
+		Registered: formatJSONTime(r.Registered),
+	})
+}
+
+func (r *Revision) UnmarshalJSON(data []byte) error {
+	v := revisionJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "revision"); err != nil {
+		return err
+	}
+	registered, err := parseJSONTime(v.Registered)
+	if err != nil {
+		return err
+	}
+	rev := detachedStore.NewRevision(detachedApp(v.App), v.Ref, v.ArchiveUrl)
+	rev.Registered = registered
+	*r = *rev
+	return nil
+}
+
+type envJSON struct {
+	Version    int               `json:"version"`
+	App        string            `json:"app"`
+	Ref        string            `json:"ref"`
+	Vars       map[string]string `json:"vars"`
+	Registered string            `json:"registered,omitempty"`
+}
+
+func (e *Env) MarshalJSON() ([]byte, error) {
+	vars := e.Vars
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	return json.Marshal(envJSON{
+		Version:    JSONVersion,
+		App:        appName(e.App),
+		Ref:        e.Ref,
+		Vars:       vars,
+		Registered: formatJSONTime(e.Registered),
+	})
+}
+
+func (e *Env) UnmarshalJSON(data []byte) error {
+	v := envJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "env"); err != nil {
+		return err
+	}
+	registered, err := parseJSONTime(v.Registered)
+	if err != nil {
+		return err
+	}
+	env := detachedApp(v.App).NewEnv(v.Ref, v.Vars)
+	env.Registered = registered
+	*e = *env
+	return nil
+}
+
+type procJSON struct {
+	Version    int       `json:"version"`
+	App        string    `json:"app"`
+	Name       string    `json:"name"`
+	Port       int       `json:"port"`
+	Attrs      ProcAttrs `json:"attrs"`
+	Registered string    `json:"registered,omitempty"`
+}
+
+func (p *Proc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(procJSON{
+		Version:    JSONVersion,
+		App:        appName(p.App),
+		Name:       p.Name,
+		Port:       p.Port,
+		Attrs:      p.Attrs,
+		Registered: formatJSONTime(p.Registered),
+	})
+}
+
+func (p *Proc) UnmarshalJSON(data []byte) error {
+	v := procJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "proc"); err != nil {
+		return err
+	}
+	registered, err := parseJSONTime(v.Registered)
+	if err != nil {
+		return err
+	}
+	proc := detachedStore.NewProc(detachedApp(v.App), v.Name)
+	proc.Port = v.Port
+	proc.Attrs = v.Attrs
+	proc.Registered = registered
+	*p = *proc
+	return nil
+}
+
+type restartsJSON struct {
+	Fail int `json:"fail"`
+	OOM  int `json:"oom"`
+}
+
+type instanceJSON struct {
+	Version    int           `json:"version"`
+	Id         int64         `json:"id"`
+	App        string        `json:"app"`
+	Revision   string        `json:"rev"`
+	Proc       string        `json:"proc"`
+	Env        string        `json:"env"`
+	Status     InsStatus     `json:"status"`
+	Ip         string        `json:"ip,omitempty"`
+	Port       int           `json:"port,omitempty"`
+	TelePort   int           `json:"tele-port,omitempty"`
+	Host       string        `json:"host,omitempty"`
+	Restarts   *restartsJSON `json:"restarts,omitempty"`
+	Registered string        `json:"registered,omitempty"`
+	Claimed    string        `json:"claimed,omitempty"`
+	Lease      string        `json:"lease,omitempty"`
+	Heartbeat  string        `json:"heartbeat,omitempty"`
+}
+
+func (i *Instance) MarshalJSON() ([]byte, error) {
+	v := instanceJSON{
+		Version:    JSONVersion,
+		Id:         i.Id,
+		App:        i.AppName,
+		Revision:   i.RevisionName,
+		Proc:       i.ProcessName,
+		Env:        i.Env,
+		Status:     i.Status,
+		Ip:         i.Ip,
+		Port:       i.Port,
+		TelePort:   i.TelePort,
+		Host:       i.Host,
+		Registered: formatJSONTime(i.Registered),
+		Claimed:    formatJSONTime(i.Claimed),
+		Lease:      formatJSONTime(i.Lease),
+		Heartbeat:  formatJSONTime(i.LastHeartbeat),
+	}
+	if i.Restarts != nil {
+		v.Restarts = &restartsJSON{Fail: i.Restarts.Fail, OOM: i.Restarts.OOM}
+	}
+	return json.Marshal(v)
+}
+
+func (i *Instance) UnmarshalJSON(data []byte) error {
+	v := instanceJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "instance"); err != nil {
+		return err
+	}
+	registered, err := parseJSONTime(v.Registered)
+	if err != nil {
+		return err
+	}
+	claimed, err := parseJSONTime(v.Claimed)
+	if err != nil {
+		return err
+	}
+	lease, err := parseJSONTime(v.Lease)
+	if err != nil {
+		return err
+	}
+	heartbeat, err := parseJSONTime(v.Heartbeat)
+	if err != nil {
+		return err
+	}
+	*i = Instance{
+		dir:           newDir(instancePath(v.Id), Snapshot{}),
+		Id:            v.Id,
+		AppName:       v.App,
+		RevisionName:  v.Revision,
+		ProcessName:   v.Proc,
+		Env:           v.Env,
+		Status:        v.Status,
+		Ip:            v.Ip,
+		Port:          v.Port,
+		TelePort:      v.TelePort,
+		Host:          v.Host,
+		Registered:    registered,
+		Claimed:       claimed,
+		Lease:         lease,
+		LastHeartbeat: heartbeat,
+	}
+	if v.Restarts != nil {
+		i.Restarts = &InsRestarts{Fail: v.Restarts.Fail, OOM: v.Restarts.OOM}
+	}
+	return nil
+}
+
+type runnerJSON struct {
+	Version    int    `json:"version"`
+	Addr       string `json:"addr"`
+	InstanceId int64  `json:"instance-id"`
+}
+
+func (r *Runner) MarshalJSON() ([]byte, error) {
+	return json.Marshal(runnerJSON{
+		Version:    JSONVersion,
+		Addr:       r.Addr,
+		InstanceId: r.InstanceId,
+	})
+}
+
+func (r *Runner) UnmarshalJSON(data []byte) error {
+	v := runnerJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "runner"); err != nil {
+		return err
+	}
+	*r = *detachedStore.NewRunner(v.Addr, v.InstanceId, nil)
+	return nil
+}
+
+type serviceJSON struct {
+	Version        int         `json:"version"`
+	Type           ServiceType `json:"type"`
+	Addr           string      `json:"addr"`
+	ServiceVersion string      `json:"service-version,omitempty"`
+	Registered     string      `json:"registered,omitempty"`
+}
+
+func (s *Service) MarshalJSON() ([]byte, error) {
+	return json.Marshal(serviceJSON{
+		Version:        JSONVersion,
+		Type:           s.Type,
+		Addr:           s.Addr,
+		ServiceVersion: s.Version,
+		Registered:     formatJSONTime(s.Registered),
+	})
+}
+
+func (s *Service) UnmarshalJSON(data []byte) error {
+	v := serviceJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "service"); err != nil {
+		return err
+	}
+	registered, err := parseJSONTime(v.Registered)
+	if err != nil {
+		return err
+	}
+	*s = Service{
+		Type:       v.Type,
+		Addr:       v.Addr,
+		Version:    v.ServiceVersion,
+		Registered: registered,
+	}
+	return nil
+}
+
+type eventJSON struct {
+	Version int             `json:"version"`
+	Type    EventType       `json:"type"`
+	Rev     int64           `json:"rev"`
+	Body    string          `json:"body"`
+	Path    EventData       `json:"path"`
+	Source  json.RawMessage `json:"source"`
+}
+
+// MarshalJSON encodes the event along with its Source, which is null for
+// events without one.
+func (ev *Event) MarshalJSON() ([]byte, error) {
+	src, err := json.Marshal(ev.Source)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(eventJSON{
+		Version: JSONVersion,
+		Type:    ev.Type,
+		Rev:     ev.Rev,
+		Body:    ev.Body,
+		Path:    ev.Path,
+		Source:  src,
+	})
+}
+
+// UnmarshalJSON decodes an event written by MarshalJSON. The type of the
+// Source is derived from the event type.
+func (ev *Event) UnmarshalJSON(data []byte) error {
+	v := eventJSON{}
+	if err := unmarshalJSON(data, &v, &v.Version, "event"); err != nil {
+		return err
+	}
+	*ev = Event{
+		Type: v.Type,
+		Rev:  v.Rev,
+		Body: v.Body,
+		Path: v.Path,
+	}
+	if len(v.Source) == 0 || string(v.Source) == "null" {
+		return nil
+	}
+	src := newEventSource(v.Type)
+	if src == nil {
+		return errorf(ErrInvalidArgument, "event %s can't have a source", v.Type)
+	}
+	if err := json.Unmarshal(v.Source, src); err != nil {
+		return err
+	}
+	ev.Source = src
+	return nil
+}
+
+// newEventSource returns an empty Source for events of the given type, see
+// canonicalizeMetadata.
+func newEventSource(etype EventType) Snapshotable {
+	switch etype {
+	case EvAppReg, EvAppUnreg:
+		return &App{}
+	case EvRevReg, EvRevUnreg:
+		return &Revision{}
+	case EvProcReg, EvProcUnreg:
+		return &Proc{}
+	case EvEnvReg, EvEnvUnreg:
+		return &Env{}
+	case EvRunnerReg, EvRunnerUnreg:
+		return &Runner{}
+	}
+	if isInstanceEvent(etype) {
+		return &Instance{}
+	}
+	if _, ok := serviceTypes[etype]; ok {
+		return &Service{}
+	}
+	return nil
+}
+
+// unmarshalJSON decodes data into v and checks the version decoded into
+// version.
+func unmarshalJSON(data []byte, v interface{}, version *int, kind string) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if *version != JSONVersion {
+		return errorf(ErrInvalidArgument, "unsupported %s version %d", kind, *version)
+	}
+	return nil
+}
+
+func detachedApp(name string) *App {
+	return detachedStore.NewApp(name, "", "")
+}
+
+func appName(app *App) string {
+	if app == nil {
+		return ""
+	}
+	return app.Name
+}
+
+func formatJSONTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return formatTime(t)
+}
+
+func parseJSONTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	t, err := parseTime(val)
+	if err != nil {
+		return time.Time{}, errorf(ErrInvalidArgument, "invalid timestamp %s", val)
+	}
+	return t, nil
+}
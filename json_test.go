@@ -0,0 +1,171 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var jsonTime = time.Date(2013, 7, 19, 16, 22, 0, 0, time.UTC)
+
+func TestJSONRoundTrip(t *testing.T) {
+	app := detachedStore.NewApp("cat", "git://cat.git", "whiskers")
+	app.Head = "128af9"
+	app.Env = map[string]string{"HOME": "/home/cat"}
+	app.DeployType = DeployLXC
+	app.Registered = jsonTime
+
+	rev := detachedStore.NewRevision(detachedApp("cat"), "128af9", "http://archive/cat.tar.gz")
+	rev.Registered = jsonTime
+
+	env := detachedApp("cat").NewEnv("prod", map[string]string{"PORT": "80"})
+	env.Registered = jsonTime
+
+	limit := 512
+	proc := detachedStore.NewProc(detachedApp("cat"), "web")
+	proc.Port = 8000
+	proc.Attrs.Limits.MemoryLimitMb = &limit
+	proc.Registered = jsonTime
+
+	ins := &Instance{}
+	*ins = Instance{
+		dir:          newDir(instancePath(6868), Snapshot{}),
+		Id:           6868,
+		AppName:      "cat",
+		RevisionName: "128af9",
+		ProcessName:  "web",
+		Env:          "prod",
+		Status:       InsStatusRunning,
+		Ip:           "10.0.0.1",
+		Port:         24690,
+		TelePort:     24691,
+		Host:         "box.local",
+		Restarts:     &InsRestarts{Fail: 2, OOM: 1},
+		Registered:   jsonTime,
+		Claimed:      jsonTime.Add(time.Minute),
+	}
+
+	runner := detachedStore.NewRunner("10.0.0.1:5000", 6868, nil)
+
+	svc := &Service{Type: ServiceLogger, Addr: "10.0.0.3:9000", Version: "v2", Registered: jsonTime}
+
+	tests := []struct {
+		v    interface{}
+		json string
+	}{
+		{app, `{"version":1,"name":"cat","repo-url":"git://cat.git","stack":"whiskers","head":"128af9","env":{"HOME":"/home/cat"},"deploy-type":"lxc","registered":"2013-07-19T16:22:00Z"}`},
+		{rev, `{"version":1,"app":"cat","ref":"128af9","archive-url":"http://archive/cat.tar.gz","registered":"2013-07-19T16:22:00Z"}`},
+		{env, `{"version":1,"app":"cat","ref":"prod","vars":{"PORT":"80"},"registered":"2013-07-19T16:22:00Z"}`},
+		{proc, `{"version":1,"app":"cat","name":"web","port":8000,"attrs":{"limits":{"memory-limit-mb":512}},"registered":"2013-07-19T16:22:00Z"}`},
+		{ins, `{"version":1,"id":6868,"app":"cat","rev":"128af9","proc":"web","env":"prod","status":"running","ip":"10.0.0.1","port":24690,"tele-port":24691,"host":"box.local","restarts":{"fail":2,"oom":1},"registered":"2013-07-19T16:22:00Z","claimed":"2013-07-19T16:23:00Z"}`},
+		{runner, `{"version":1,"addr":"10.0.0.1:5000","instance-id":6868}`},
+		{svc, `{"version":1,"type":"logger","addr":"10.0.0.3:9000","service-version":"v2","registered":"2013-07-19T16:22:00Z"}`},
+	}
+
+	for _, test := range tests {
+		b, err := json.Marshal(test.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.json {
+			t.Errorf("expected %T to encode as\n%s\ngot\n%s", test.v, test.json, b)
+		}
+
+		decoded := reflect.New(reflect.TypeOf(test.v).Elem()).Interface()
+		if err := json.Unmarshal(b, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, test.v) {
+			t.Errorf("expected %T to round-trip\n%#v\ngot\n%#v", test.v, test.v, decoded)
+		}
+	}
+}
+
+func TestEventJSONRoundTrip(t *testing.T) {
+	id := "6868"
+	ins := &Instance{
+		dir:          newDir(instancePath(6868), Snapshot{}),
+		Id:           6868,
+		AppName:      "cat",
+		RevisionName: "128af9",
+		ProcessName:  "web",
+		Env:          "prod",
+		Status:       InsStatusPending,
+		Registered:   jsonTime,
+	}
+	app := "cat"
+
+	tests := []struct {
+		ev   *Event
+		json string
+	}{
+		{
+			&Event{Type: EvInsReg, Rev: 42, Body: "cat 128af9 web prod", Path: EventData{Instance: &id}, Source: ins},
+			`{"version":1,"type":"instance-register","rev":42,"body":"cat 128af9 web prod","path":{"instance":"6868"},"source":{"version":1,"id":6868,"app":"cat","rev":"128af9","proc":"web","env":"prod","status":"pending","registered":"2013-07-19T16:22:00Z"}}`,
+		},
+		{
+			&Event{Type: EvAppUnreg, Rev: 43, Path: EventData{App: &app}},
+			`{"version":1,"type":"app-unregister","rev":43,"body":"","path":{"app":"cat"},"source":null}`,
+		},
+	}
+
+	for _, test := range tests {
+		b, err := json.Marshal(test.ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.json {
+			t.Errorf("expected %s to encode as\n%s\ngot\n%s", test.ev.Type, test.json, b)
+		}
+
+		decoded := &Event{}
+		if err := json.Unmarshal(b, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, test.ev) {
+			t.Errorf("expected %s to round-trip\n%#v\ngot\n%#v", test.ev.Type, test.ev, decoded)
+		}
+	}
+}
+
+func TestEventJSONLive(t *testing.T) {
+	s, l := eventSetup()
+
+	go storeFromSnapshotable(s).WatchEvent(l)
+
+	ins, err := s.RegisterInstance("jsoncat", "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvInsReg, ins, l, t)
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Event{}
+	if err := json.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	src, ok := decoded.Source.(*Instance)
+	if !ok || src.Id != ins.Id || src.Env != "default" || src.Status != InsStatusPending {
+		t.Errorf("expected decoded source %s, got %#v", ins, decoded.Source)
+	}
+}
+
+func TestJSONVersion(t *testing.T) {
+	err := json.Unmarshal([]byte(`{"version":2,"name":"cat"}`), &App{})
+	if !IsErrInvalidArgument(err) {
+		t.Errorf("expected unsupported version to be rejected, got %v", err)
+	}
+	err = json.Unmarshal([]byte(`{"version":1,"type":"app-register","source":{"version":0}}`), &Event{})
+	if !IsErrInvalidArgument(err) {
+		t.Errorf("expected unsupported source version to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterBackend("mem", dialMem)
+}
+
+var (
+	memTreesMu sync.Mutex
+	memTrees   = map[string]*MemBackend{}
+)
+
+// MemBackend is an in-process Backend which keeps the full revision
+// history of its tree in memory. It is meant for tests and local
+// development.
+type MemBackend struct {
+	mu        sync.Mutex
+	rev       int64
+	compacted int64
+	files     map[string][]memVersion
+	events    []RawEvent
+	notify    chan struct{}
+	closed    bool
+}
+
+type memVersion struct {
+	rev  int64
+	body []byte
+	del  bool
+}
+
+// NewMemBackend returns an empty MemBackend.
+func NewMemBackend() *MemBackend {
+	return &MemBackend{
+		files:  map[string][]memVersion{},
+		notify: make(chan struct{}),
+	}
+}
+
+// dialMem returns the tree named by the uri, e.g. "mem:" or "mem:staging".
+// All Stores dialed with the same uri in one process share the tree.
+func dialMem(uri string) (Backend, error) {
+	name := strings.TrimPrefix(uri, "mem:")
+
+	memTreesMu.Lock()
+	defer memTreesMu.Unlock()
+
+	m, ok := memTrees[name]
+	if !ok || m.isClosed() {
+		m = NewMemBackend()
+		memTrees[name] = m
+	}
+	return m, nil
+}
+
+func (m *MemBackend) Rev() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, errorf(ErrInvalidState, "backend is closed")
+	}
+	return m.rev, nil
+}
+
+func (m *MemBackend) Get(p string, rev int64) ([]byte, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkCompacted(rev); err != nil {
+		return nil, RevMissing, err
+	}
+
+	p = path.Clean(p)
+
+	if v, ok := m.fileAt(p, rev); ok {
+		return v.body, v.rev, nil
+	}
+	if len(m.dirAt(p, rev)) > 0 {
+		return nil, RevDir, errorf(ErrInvalidFile, "%s is a directory", p)
+	}
+	return nil, RevMissing, errorf(ErrNoEnt, "%s not found", p)
+}
+
+func (m *MemBackend) Getdir(p string, rev int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkCompacted(rev); err != nil {
+		return nil, err
+	}
+
+	p = path.Clean(p)
+
+	if _, ok := m.fileAt(p, rev); ok {
+		return nil, errorf(ErrInvalidFile, "%s is not a directory", p)
+	}
+	names := m.dirAt(p, rev)
+	if len(names) == 0 {
+		return nil, errorf(ErrNoEnt, "%s not found", p)
+	}
+	return names, nil
+}
+
+func (m *MemBackend) Stat(p string, rev int64) (int, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkCompacted(rev); err != nil {
+		return 0, RevMissing, err
+	}
+
+	p = path.Clean(p)
+
+	if v, ok := m.fileAt(p, rev); ok {
+		return len(v.body), v.rev, nil
+	}
+	if names := m.dirAt(p, rev); len(names) > 0 {
+		return len(names), RevDir, nil
+	}
+	return 0, RevMissing, errorf(ErrNoEnt, "%s not found", p)
+}
+
+func (m *MemBackend) Set(p string, rev int64, body []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, errorf(ErrInvalidState, "backend is closed")
+	}
+	p = path.Clean(p)
+
+	if err := m.checkSet(p, rev); err != nil {
+		return 0, err
+	}
+	m.rev++
+	m.record(p, memVersion{body: copyBytes(body)})
+	m.wake()
+
+	return m.rev, nil
+}
+
+func (m *MemBackend) Del(p string, rev int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errorf(ErrInvalidState, "backend is closed")
+	}
+	p = path.Clean(p)
+
+	paths := m.treeAt(p, m.rev)
+	for _, file := range paths {
+		if err := m.checkRev(file, rev); err != nil {
+			return err
+		}
+	}
+	for _, file := range paths {
+		m.rev++
+		m.record(file, memVersion{del: true})
+	}
+	m.wake()
+
+	return nil
+}
+
+func (m *MemBackend) Commit(ops []TxnOp, rev int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, errorf(ErrInvalidState, "backend is closed")
+	}
+
+	type change struct {
+		path string
+		v    memVersion
+	}
+	changes := []change{}
+
+	for _, op := range ops {
+		p := path.Clean(op.Path)
+
+		switch op.Op {
+		case OpSet:
+			if err := m.checkSet(p, rev); err != nil {
+				return 0, err
+			}
+			changes = append(changes, change{p, memVersion{body: copyBytes(op.Body)}})
+		case OpDel:
+			for _, file := range m.treeAt(p, m.rev) {
+				if err := m.checkRev(file, rev); err != nil {
+					return 0, err
+				}
+				changes = append(changes, change{file, memVersion{del: true}})
+			}
+		default:
+			return 0, errorf(ErrInvalidArgument, "invalid op %d for %s", op.Op, p)
+		}
+	}
+
+	m.rev++
+	for _, c := range changes {
+		m.record(c.path, c.v)
+	}
+	m.wake()
+
+	return m.rev, nil
+}
+
+func (m *MemBackend) Wait(ctx context.Context, glob string, rev int64) ([]RawEvent, error) {
+	re, err := GlobRegexp(glob)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, errorf(ErrInvalidState, "backend is closed")
+		}
+		if err := m.checkCompacted(rev); err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		i := sort.Search(len(m.events), func(i int) bool {
+			return m.events[i].Rev >= rev
+		})
+		evs := []RawEvent{}
+		for ; i < len(m.events); i++ {
+			if len(evs) > 0 && m.events[i].Rev != evs[0].Rev {
+				break
+			}
+			if re.MatchString(m.events[i].Path) {
+				evs = append(evs, m.events[i])
+			}
+		}
+		if len(evs) > 0 {
+			m.mu.Unlock()
+			return evs, nil
+		}
+		notify := m.notify
+		m.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Compact discards the history before rev, like coordinators do to bound
+// their memory. Reads and waits at earlier revisions fail with
+// ErrCompacted afterwards.
+func (m *MemBackend) Compact(rev int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rev > m.rev {
+		return errorf(ErrInvalidArgument, "revision %d is in the future", rev)
+	}
+	if rev <= m.compacted {
+		return nil
+	}
+
+	for p, versions := range m.files {
+		// Keep the version current at rev and all later ones.
+		i := sort.Search(len(versions), func(i int) bool {
+			return versions[i].rev > rev
+		})
+		if i > 0 {
+			i--
+		}
+		kept := append([]memVersion(nil), versions[i:]...)
+		if len(kept) == 1 && kept[0].del {
+			delete(m.files, p)
+			continue
+		}
+		m.files[p] = kept
+	}
+
+	i := sort.Search(len(m.events), func(i int) bool {
+		return m.events[i].Rev >= rev
+	})
+	m.events = append([]RawEvent(nil), m.events[i:]...)
+	m.compacted = rev
+
+	return nil
+}
+
+// Getuid returns a fresh revision of the tree, which is never reused.
+func (m *MemBackend) Getuid() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rev++
+
+	return m.rev, nil
+}
+
+// Close wakes up all waiters and makes further calls fail. A closed tree
+// is replaced when its uri is dialed again.
+func (m *MemBackend) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.notify)
+	}
+	return nil
+}
+
+func (m *MemBackend) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closed
+}
+
+// record adds a version of the file at p at the current revision and
+// emits the matching event. m.mu must be held.
+func (m *MemBackend) record(p string, v memVersion) {
+	v.rev = m.rev
+	m.files[p] = append(m.files[p], v)
+
+	op := OpSet
+	if v.del {
+		op = OpDel
+	}
+	m.events = append(m.events, RawEvent{Op: op, Path: p, Body: v.body, Rev: v.rev})
+}
+
+// wake wakes up all waiters. m.mu must be held.
+func (m *MemBackend) wake() {
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+// checkSet verifies that the file at p can be written at rev.
+func (m *MemBackend) checkSet(p string, rev int64) error {
+	if len(m.dirAt(p, m.rev)) > 0 {
+		return errorf(ErrInvalidFile, "%s is a directory", p)
+	}
+	for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+		if _, ok := m.fileAt(parent, m.rev); ok {
+			return errorf(ErrInvalidFile, "%s is not a directory", parent)
+		}
+	}
+	return m.checkRev(p, rev)
+}
+
+func (m *MemBackend) checkCompacted(rev int64) error {
+	if rev < m.compacted {
+		return errorf(ErrCompacted, "revision %d has been compacted, oldest is %d", rev, m.compacted)
+	}
+	return nil
+}
+
+func (m *MemBackend) checkRev(p string, rev int64) error {
+	if rev == RevClobber {
+		return nil
+	}
+	cur := RevMissing
+	if v, ok := m.fileAt(p, m.rev); ok {
+		cur = v.rev
+	}
+	if cur > rev {
+		return errorf(ErrRevMismatch, "%s has been changed", p)
+	}
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// fileAt returns the version of the file at p which was current at rev.
+func (m *MemBackend) fileAt(p string, rev int64) (memVersion, bool) {
+	versions := m.files[p]
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].rev > rev
+	})
+	if i == 0 || versions[i-1].del {
+		return memVersion{}, false
+	}
+	return versions[i-1], true
+}
+
+// dirAt returns the sorted entry names of the directory at p at rev.
+func (m *MemBackend) dirAt(p string, rev int64) []string {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	seen := map[string]bool{}
+	names := []string{}
+
+	for file := range m.files {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		if _, ok := m.fileAt(file, rev); !ok {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(file, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// treeAt returns the paths of all files at or below p at rev.
+func (m *MemBackend) treeAt(p string, rev int64) []string {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	paths := []string{}
+
+	for file := range m.files {
+		if file != p && !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		if _, ok := m.fileAt(file, rev); ok {
+			paths = append(paths, file)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// GlobRegexp translates a coordinator glob into a regular expression,
+// where '*' matches within a path segment and '**' across segments. It is
+// meant for backends without native globs.
+func GlobRegexp(glob string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			buf.WriteString("[^/]*")
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	buf.WriteString("$")
+
+	re, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, errorf(ErrInvalidArgument, "invalid glob %s: %s", glob, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemBackendSharedByUri(t *testing.T) {
+	s1, err := DialUri("mem:shared-test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := DialUri("mem:shared-test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3, err := DialUri("mem:other-test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s1.RegisterPm("10.0.0.1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pms, err := s2.GetPms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pms) != 1 || pms[0] != "10.0.0.1" {
+		t.Errorf("expected pm to be visible on the same tree, got %v", pms)
+	}
+	_, err = s3.GetPms()
+	if !IsErrNoEnt(err) {
+		t.Errorf("expected pms to be missing on another tree, got %v", err)
+	}
+}
+
+func TestMemBackendClose(t *testing.T) {
+	m := NewMemBackend()
+
+	errch := make(chan error)
+	go func() {
+		_, err := m.Wait(context.Background(), "/**", 1)
+		errch <- err
+	}()
+
+	m.Close()
+
+	select {
+	case err := <-errch:
+		if err == nil {
+			t.Error("expected wait on closed backend to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected wait to return after close")
+	}
+
+	_, err := m.Set("/foo", RevClobber, []byte("bar"))
+	if err == nil {
+		t.Error("expected set on closed backend to fail")
+	}
+}
+
+func TestMemBackendCompact(t *testing.T) {
+	m := NewMemBackend()
+
+	rev1, err := m.Set("/cat", RevMissing, []byte("meow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := m.Set("/cat", rev1, []byte("purr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Del("/cat", rev2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev3, err := m.Set("/dog", RevMissing, []byte("woof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Compact(rev2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = m.Get("/cat", rev1)
+	if !IsErrCompacted(err) {
+		t.Errorf("expected read before compaction to fail, got %v", err)
+	}
+	body, _, err := m.Get("/cat", rev2)
+	if err != nil || string(body) != "purr" {
+		t.Errorf("expected purr at compacted revision, got %s %v", body, err)
+	}
+	_, err = m.Wait(context.Background(), "/**", rev1)
+	if !IsErrCompacted(err) {
+		t.Errorf("expected wait before compaction to fail, got %v", err)
+	}
+	evs, err := m.Wait(context.Background(), "/dog", rev2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evs[0].Rev != rev3 {
+		t.Errorf("expected event at %d, got %s", rev3, evs[0])
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	migrationLockPath = "/migration-lock"
+	initialEnvRef     = "initial"
+)
+
+// MigrationLockTimeout is how long the lock of Migrate is respected. An
+// older lock was left behind by a Migrate which didn't finish, and is
+// taken over.
+const MigrationLockTimeout = 10 * time.Minute
+
+// A Migration upgrades the registry from Version-1 to Version. Instead of
+// changing the registry itself, it plans the changes against a Snapshot,
+// which lets Migrate print them before or instead of applying them. Plans
+// must be idempotent: planning against an already migrated tree must not
+// return any changes.
+type Migration struct {
+	Version     int
+	Description string
+	Plan        func(sp Snapshot) ([]MigrationChange, error)
+}
+
+// MigrationChange is a single write planned by a Migration.
+type MigrationChange struct {
+	Op   Op
+	Path string
+	Body string
+}
+
+func (c MigrationChange) String() string {
+	if c.Op == OpDel {
+		return "del " + c.Path
+	}
+	return "set " + c.Path
+}
+
+var migrations = []*Migration{
+	{
+		Version:     4,
+		Description: "move app env vars into an initial env",
+		Plan:        planEnvMigration,
+	},
+}
+
+// RegisterMigration adds a Migration to the ordered list of migrations
+// applied by Migrate.
+func RegisterMigration(m *Migration) {
+	for _, other := range migrations {
+		if other.Version == m.Version {
+			panic("visor: RegisterMigration called twice for version " + strconv.Itoa(m.Version))
+		}
+	}
+	migrations = append(migrations, m)
+	sort.Sort(migrationsByVersion(migrations))
+}
+
+type migrationsByVersion []*Migration
+
+func (m migrationsByVersion) Len() int           { return len(m) }
+func (m migrationsByVersion) Less(i, j int) bool { return m[i].Version < m[j].Version }
+func (m migrationsByVersion) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Migrate applies all migrations between the schema version of the
+// registry and SchemaVersion in order. Each migration is committed in a
+// single transaction together with its schema version. Every path touched
+// is written to out. With dryRun set nothing is changed; plans of
+// consecutive migrations are then made against the unmigrated tree.
+//
+// Migrate holds a global lock for its whole run, a concurrent Migrate
+// fails with ErrUnauthorized, see MigrationLockTimeout.
+func (s *Store) Migrate(out io.Writer, dryRun bool) (*Store, error) {
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := getSchemaVersion(sp)
+	if err != nil {
+		return nil, err
+	}
+	if v > SchemaVersion {
+		return nil, errorf(ErrInvalidState, "schema version %d is newer than %d", v, SchemaVersion)
+	}
+
+	if !dryRun {
+		sp, err = lockMigration(sp)
+		if err != nil {
+			return nil, err
+		}
+		// The lock is only removed as long as it is still ours.
+		defer sp.Del(migrationLockPath)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= v || m.Version > SchemaVersion {
+			continue
+		}
+		if m.Version != v+1 {
+			return nil, errorf(ErrNotFound, "no migration from schema version %d to %d", v, v+1)
+		}
+
+		changes, err := m.Plan(sp)
+		if err != nil {
+			return nil, fmt.Errorf("migration %d failed: %s", m.Version, err)
+		}
+		changes = append(changes, MigrationChange{OpSet, schemaPath, strconv.Itoa(m.Version)})
+
+		fmt.Fprintf(out, "%d: %s\n", m.Version, m.Description)
+		for _, c := range changes {
+			fmt.Fprintf(out, "  %s\n", c)
+		}
+
+		if !dryRun {
+			sp, err = applyMigration(sp, changes)
+			if err != nil {
+				return nil, fmt.Errorf("migration %d failed: %s", m.Version, err)
+			}
+		}
+		v = m.Version
+	}
+	if v != SchemaVersion {
+		return nil, errorf(ErrNotFound, "no migration from schema version %d to %d", v, v+1)
+	}
+
+	s.snapshot = sp
+
+	return s, nil
+}
+
+// lockMigration writes the time and owner of the migration to the lock,
+// and returns the Snapshot at which it was written.
+func lockMigration(sp Snapshot) (Snapshot, error) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s %s %d", timestamp(), host, os.Getpid())
+
+	rev := RevMissing
+	body, frev, err := sp.Get(migrationLockPath)
+	if err == nil {
+		if !migrationLockStale(body) {
+			return sp, errorf(ErrUnauthorized, "another migration is in progress: %s", body)
+		}
+		rev = frev
+	} else if !IsErrNoEnt(err) {
+		return sp, err
+	}
+
+	rev, err = sp.conn.backend.Set(sp.conn.path(migrationLockPath), rev, []byte(owner))
+	if IsErrRevMismatch(err) {
+		return sp, errorf(ErrUnauthorized, "another migration is in progress")
+	}
+	if err != nil {
+		return sp, err
+	}
+	return Snapshot{rev, sp.conn}, nil
+}
+
+// migrationLockStale checks if the lock with body is older than
+// MigrationLockTimeout. Locks which can't be read are stale as well.
+func migrationLockStale(body string) bool {
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return true
+	}
+	t, err := parseTime(fields[0])
+	return err != nil || time.Since(t) > MigrationLockTimeout
+}
+
+func applyMigration(sp Snapshot, changes []MigrationChange) (Snapshot, error) {
+	txn := sp.Txn()
+	for _, c := range changes {
+		switch c.Op {
+		case OpSet:
+			txn.Set(c.Path, c.Body)
+		case OpDel:
+			txn.Del(c.Path)
+		}
+	}
+	return txn.Commit()
+}
+
+func getSchemaVersion(sp Snapshot) (int, error) {
+	val, _, err := sp.Get(schemaPath)
+	if err != nil {
+		return -1, err
+	}
+	v, err := strconv.Atoi(val)
+	if err != nil {
+		return -1, errorf(ErrInvalidFile, "invalid schema version: %s", val)
+	}
+	return v, nil
+}
+
+// planEnvMigration registers the env vars set on each app under
+// /apps/<app>/env as the Env "initial". The old vars are left in place for
+// components which haven't been upgraded yet.
+func planEnvMigration(sp Snapshot) ([]MigrationChange, error) {
+	changes := []MigrationChange{}
+
+	apps, err := sp.Getdir(appsPath)
+	if IsErrNoEnt(err) {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		keys, err := sp.Getdir(path.Join(appsPath, app, "env"))
+		if IsErrNoEnt(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		envPath := path.Join(appsPath, app, envsPath, initialEnvRef)
+
+		exists, _, err := sp.Exists(envPath)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+
+		vars := map[string]string{}
+		for _, key := range keys {
+			val, _, err := sp.Get(path.Join(appsPath, app, "env", key))
+			if err != nil {
+				return nil, err
+			}
+			vars[strings.Replace(key, "-", "_", -1)] = val
+		}
+		body, err := json.Marshal(vars)
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes,
+			MigrationChange{OpSet, path.Join(envPath, varsPath), string(body)},
+			MigrationChange{OpSet, path.Join(envPath, registeredPath), timestamp()},
+		)
+	}
+	return changes, nil
+}
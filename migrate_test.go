@@ -0,0 +1,179 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func migrateSetup() (*Store, *App) {
+	s := visorSetup("/migrate-test")
+
+	app := s.NewApp("migrate-cat", "git://cat.git", "whiskers")
+	app.Env["HOME_DIR"] = "/home/cat"
+	app.Env["PORT"] = "8080"
+
+	app, err := app.Register()
+	if err != nil {
+		panic(err)
+	}
+	err = s.SetSchemaVersion(3)
+	if err != nil {
+		panic(err)
+	}
+	s, err = s.FastForward()
+	if err != nil {
+		panic(err)
+	}
+	return s, app
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	s, app := migrateSetup()
+
+	out := &bytes.Buffer{}
+
+	_, err := s.Migrate(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{
+		"set apps/migrate-cat/envs/initial/vars",
+		"set apps/migrate-cat/envs/initial/registered",
+		"set /schema-version",
+	} {
+		if !strings.Contains(out.String(), p) {
+			t.Errorf("expected dry run output to contain %q, got:\n%s", p, out)
+		}
+	}
+
+	_, err = app.GetEnv(initialEnvRef)
+	if !IsErrNotFound(err) {
+		t.Errorf("expected dry run not to register env, got %v", err)
+	}
+	s, err = s.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := getSchemaVersion(s.GetSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 3 {
+		t.Errorf("expected dry run to keep schema version 3, got %d", v)
+	}
+}
+
+func TestMigrateEnvs(t *testing.T) {
+	s, app := migrateSetup()
+
+	s, err := s.Migrate(&bytes.Buffer{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := s.VerifySchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != SchemaVersion {
+		t.Errorf("expected schema version %d, got %d", SchemaVersion, v)
+	}
+
+	env, err := app.GetEnv(initialEnvRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Vars["HOME_DIR"] != "/home/cat" || env.Vars["PORT"] != "8080" || len(env.Vars) != 2 {
+		t.Errorf("unexpected vars in migrated env: %v", env.Vars)
+	}
+
+	// The migration is committed in one transaction.
+	_, schemaRev, err := s.GetSnapshot().Get(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, varsRev, err := s.GetSnapshot().Get("/apps/migrate-cat/envs/initial/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schemaRev != varsRev {
+		t.Errorf("expected env and schema version at the same revision, got %d and %d", varsRev, schemaRev)
+	}
+
+	// The lock is released.
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = sp.Get(migrationLockPath)
+	if !IsErrNoEnt(err) {
+		t.Errorf("expected migration lock to be removed, got %v", err)
+	}
+
+	// Migrating again is a no-op.
+	err = s.SetSchemaVersion(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	_, err = s.Migrate(out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "envs/initial") {
+		t.Errorf("expected second migration not to touch envs, got:\n%s", out)
+	}
+}
+
+func TestMigrateLocked(t *testing.T) {
+	s, _ := migrateSetup()
+
+	_, err := lockMigration(s.GetSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Migrate(&bytes.Buffer{}, false)
+	if !IsErrUnauthorized(err) {
+		t.Errorf("expected concurrent migration to fail, got %v", err)
+	}
+}
+
+func TestMigrateStaleLock(t *testing.T) {
+	s, _ := migrateSetup()
+
+	stale := time.Now().Add(-MigrationLockTimeout - time.Minute).UTC().Format(time.RFC3339)
+	old, err := s.GetSnapshot().Set(migrationLockPath, stale+" crashed-host 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := lockMigration(old)
+	if err != nil {
+		t.Fatalf("expected stale lock to be taken over, got %v", err)
+	}
+
+	// A lock taken over isn't removed by its former owner.
+	old.Del(migrationLockPath)
+	_, err = s.Migrate(&bytes.Buffer{}, false)
+	if !IsErrUnauthorized(err) {
+		t.Errorf("expected concurrent migration to fail, got %v", err)
+	}
+
+	err = sp.Del(migrationLockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Migrate(&bytes.Buffer{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the buckets of
+// the latency histograms kept by CallStats.
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// A BackendCall is a single operation of a Store on its Backend. Path is
+// relative to the root of the Store; for waits it is the glob and for
+// commits the path of the first op. Rev is the revision the call was made
+// at. The Duration of a wait includes the time it blocked.
+type BackendCall struct {
+	Method   string // rev, get, getdir, stat, set, del, commit, wait or getuid
+	Path     string
+	Rev      int64
+	Duration time.Duration
+	Err      error
+}
+
+// An Observer is notified of every call to the Backend made by a Store
+// returned by WithObserver, and by all entities derived from it. Calls
+// are observed once they returned; ObserveCall may be called
+// concurrently and must not block.
+type Observer interface {
+	ObserveCall(call *BackendCall)
+}
+
+// WithObserver returns a copy of the Store whose backend calls are
+// reported to o. Entities already derived from s aren't observed.
+func (s *Store) WithObserver(o Observer) *Store {
+	c := &conn{root: s.snapshot.conn.root}
+	c.backend = &observedBackend{s.snapshot.conn.backend, o, c}
+	return &Store{Snapshot{s.snapshot.Rev, c}}
+}
+
+type observedBackend struct {
+	Backend
+	observer Observer
+	conn     *conn
+}
+
+func (b *observedBackend) observe(method, p string, rev int64, start time.Time, err error) {
+	if p != "" {
+		p = b.conn.relpath(p)
+	}
+	b.observer.ObserveCall(&BackendCall{method, p, rev, time.Since(start), err})
+}
+
+func (b *observedBackend) Rev() (int64, error) {
+	start := time.Now()
+	rev, err := b.Backend.Rev()
+	b.observe("rev", "", rev, start, err)
+	return rev, err
+}
+
+func (b *observedBackend) Get(p string, rev int64) ([]byte, int64, error) {
+	start := time.Now()
+	body, frev, err := b.Backend.Get(p, rev)
+	b.observe("get", p, rev, start, err)
+	return body, frev, err
+}
+
+func (b *observedBackend) Getdir(p string, rev int64) ([]string, error) {
+	start := time.Now()
+	names, err := b.Backend.Getdir(p, rev)
+	b.observe("getdir", p, rev, start, err)
+	return names, err
+}
+
+func (b *observedBackend) Stat(p string, rev int64) (int, int64, error) {
+	start := time.Now()
+	n, frev, err := b.Backend.Stat(p, rev)
+	b.observe("stat", p, rev, start, err)
+	return n, frev, err
+}
+
+func (b *observedBackend) Set(p string, rev int64, body []byte) (int64, error) {
+	start := time.Now()
+	nrev, err := b.Backend.Set(p, rev, body)
+	b.observe("set", p, rev, start, err)
+	return nrev, err
+}
+
+func (b *observedBackend) Del(p string, rev int64) error {
+	start := time.Now()
+	err := b.Backend.Del(p, rev)
+	b.observe("del", p, rev, start, err)
+	return err
+}
+
+func (b *observedBackend) Commit(ops []TxnOp, rev int64) (int64, error) {
+	p := ""
+	if len(ops) > 0 {
+		p = ops[0].Path
+	}
+	start := time.Now()
+	nrev, err := b.Backend.Commit(ops, rev)
+	b.observe("commit", p, rev, start, err)
+	return nrev, err
+}
+
+func (b *observedBackend) Wait(ctx context.Context, glob string, rev int64) ([]RawEvent, error) {
+	start := time.Now()
+	evs, err := b.Backend.Wait(ctx, glob, rev)
+	b.observe("wait", glob, rev, start, err)
+	return evs, err
+}
+
+func (b *observedBackend) Getuid() (int64, error) {
+	start := time.Now()
+	uid, err := b.Backend.Getuid()
+	b.observe("getuid", "", 0, start, err)
+	return uid, err
+}
+
+// CallStats is an Observer which counts backend calls and keeps a latency
+// histogram per method. Missing files and cancelled waits aren't counted
+// as errors. It serves its metrics in the Prometheus text format:
+//
+//	visor_backend_calls_total{method}         counter
+//	visor_backend_errors_total{method}        counter
+//	visor_backend_call_seconds{method}        histogram
+type CallStats struct {
+	mu      sync.Mutex
+	methods map[string]*methodStats
+	buckets []float64
+}
+
+type methodStats struct {
+	errors  float64
+	latency *histogram
+}
+
+func NewCallStats() *CallStats {
+	return &CallStats{methods: map[string]*methodStats{}, buckets: DefaultLatencyBuckets}
+}
+
+func (c *CallStats) ObserveCall(call *BackendCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.methods[call.Method]
+	if m == nil {
+		m = &methodStats{latency: newHistogram(c.buckets)}
+		c.methods[call.Method] = m
+	}
+	m.latency.observe(call.Duration.Seconds())
+
+	err := call.Err
+	if err != nil && !IsErrNoEnt(err) && err != context.Canceled && err != context.DeadlineExceeded {
+		m.errors++
+	}
+}
+
+// Calls returns the number of calls and failed calls of method.
+func (c *CallStats) Calls(method string) (calls, errors int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.methods[method]
+	if m == nil {
+		return 0, 0
+	}
+	return int(m.latency.count), int(m.errors)
+}
+
+func (c *CallStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w.
+func (c *CallStats) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	methods := make([]string, 0, len(c.methods))
+	for method := range c.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	calls := metricSet{}
+	errors := metricSet{}
+	for _, method := range methods {
+		calls.add(c.methods[method].latency.count, "method", method)
+		errors.add(c.methods[method].errors, "method", method)
+	}
+
+	buf := &bytes.Buffer{}
+	calls.write(buf, "visor_backend_calls_total", "counter", "Calls to the backend.")
+	errors.write(buf, "visor_backend_errors_total", "counter", "Failed calls to the backend.")
+	writeMetricHeader(buf, "visor_backend_call_seconds", "histogram", "Latency of calls to the backend.")
+	for _, method := range methods {
+		c.methods[method].latency.writeSamples(buf, "visor_backend_call_seconds", "method", method)
+	}
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type callRecorder struct {
+	mu    sync.Mutex
+	calls []BackendCall
+}
+
+func (r *callRecorder) ObserveCall(call *BackendCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, *call)
+}
+
+func (r *callRecorder) reset() []BackendCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+func TestObserver(t *testing.T) {
+	rec := &callRecorder{}
+	s := visorSetup("/observer-test").WithObserver(rec)
+
+	app, err := s.NewApp("cat", "git://cat.git", "whiskers").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.reset()
+
+	// Entities derived from the Store are observed as well.
+	if _, err = app.GetProcs(); err != nil {
+		t.Fatal(err)
+	}
+	calls := rec.reset()
+	if len(calls) == 0 {
+		t.Fatal("expected calls of the app to be observed")
+	}
+	found := false
+	for _, c := range calls {
+		if c.Method == "getdir" && c.Path == "/apps/cat/procs" {
+			found = true
+			if c.Rev < app.GetSnapshot().Rev {
+				t.Errorf("expected getdir at %d or later, got %d", app.GetSnapshot().Rev, c.Rev)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected getdir of /apps/cat/procs relative to the root, got %+v", calls)
+	}
+
+	_, err = s.GetApp("dog")
+	if !IsErrNotFound(err) {
+		t.Fatalf("expected dog not to be found, got %v", err)
+	}
+	calls = rec.reset()
+	if len(calls) == 0 || calls[len(calls)-1].Err == nil {
+		t.Errorf("expected the failed read to be observed, got %+v", calls)
+	}
+}
+
+func TestCallStats(t *testing.T) {
+	stats := NewCallStats()
+	s := visorSetup("/call-stats-test").WithObserver(stats)
+
+	if _, err := s.GetApp("cat"); !IsErrNotFound(err) {
+		t.Fatalf("expected cat not to be found, got %v", err)
+	}
+	sp := s.GetSnapshot()
+	if _, err := sp.Txn().Set("/cat", "meow").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.Txn().Set("/cat", "purr").Commit(); !IsErrRevMismatch(err) {
+		t.Fatalf("expected a revision mismatch, got %v", err)
+	}
+
+	if calls, errors := stats.Calls("commit"); calls < 2 || errors != 1 {
+		t.Errorf("expected a failed commit, got %d calls and %d errors", calls, errors)
+	}
+	if calls, errors := stats.Calls("get"); calls == 0 || errors != 0 {
+		t.Errorf("expected missing files not to be errors, got %d calls and %d errors", calls, errors)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := stats.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`visor_backend_errors_total{method="commit"} 1`,
+		`visor_backend_call_seconds_bucket{method="commit",le="+Inf"}`,
+		`visor_backend_call_seconds_count{method="get"}`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %s, got\n%s", line, buf)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"time"
+)
+
+// every calls f at once and then every interval until ctx is done. The
+// errors of f are sent to errc, if set, and discarded while errc is full,
+// so that a slow reader doesn't hold up the loop.
+func every(ctx context.Context, interval time.Duration, errc chan<- error, f func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := f(); err != nil && errc != nil {
+			select {
+			case errc <- err:
+			default:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -8,7 +8,6 @@ package visor
 import (
 	"errors"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
 	"regexp"
 	"strconv"
 	"time"
@@ -18,7 +17,7 @@ var reProcName = regexp.MustCompile("^[[:alnum:]]+$")
 
 // Proc represents a process type with a certain scale.
 type Proc struct {
-	dir        *cp.Dir
+	dir        *dir
 	Name       string
 	App        *App
 	Port       int
@@ -47,11 +46,11 @@ func (s *Store) NewProc(app *App, name string) *Proc {
 	return &Proc{
 		Name: name,
 		App:  app,
-		dir:  cp.NewDir(app.dir.Prefix(procsPath, string(name)), s.GetSnapshot()),
+		dir:  newDir(app.dir.Prefix(procsPath, string(name)), s.GetSnapshot()),
 	}
 }
 
-func (p *Proc) GetSnapshot() cp.Snapshot {
+func (p *Proc) GetSnapshot() Snapshot {
 	return p.dir.Snapshot
 }
 
@@ -79,7 +78,7 @@ func (p *Proc) Register() (*Proc, error) {
 		return nil, errors.New(fmt.Sprintf("couldn't claim port: %s", err.Error()))
 	}
 
-	port := cp.NewFile(p.dir.Prefix(procsPortPath), p.Port, new(cp.IntCodec), sp)
+	port := newFile(p.dir.Prefix(procsPortPath), p.Port, new(intCodec), sp)
 	port, err = port.Save()
 	if err != nil {
 		return nil, err
@@ -196,7 +195,7 @@ func (p *Proc) StoreAttrs() (*Proc, error) {
 	if err != nil {
 		return nil, err
 	}
-	attrs := cp.NewFile(p.dir.Prefix(procsAttrsPath), p.Attrs, new(cp.JsonCodec), sp)
+	attrs := newFile(p.dir.Prefix(procsAttrsPath), p.Attrs, new(jsonCodec), sp)
 	attrs, err = attrs.Save()
 	if err != nil {
 		return nil, err
@@ -219,27 +218,27 @@ func (a *App) GetProc(name string) (*Proc, error) {
 	return getProc(a, name, sp)
 }
 
-func getProc(app *App, name string, s cp.Snapshotable) (*Proc, error) {
+func getProc(app *App, name string, s Snapshotable) (*Proc, error) {
 	p := &Proc{
-		dir:  cp.NewDir(app.dir.Prefix(procsPath, name), s.GetSnapshot()),
+		dir:  newDir(app.dir.Prefix(procsPath, name), s.GetSnapshot()),
 		Name: name,
 		App:  app,
 	}
 
-	port, err := p.dir.GetFile(procsPortPath, new(cp.IntCodec))
+	port, err := p.dir.GetFile(procsPortPath, new(intCodec))
 	if err != nil {
 		return nil, errorf(ErrNotFound, "port not found for %s-%s", app.Name, name)
 	}
 	p.Port = port.Value.(int)
 
-	_, err = p.dir.GetFile(procsAttrsPath, &cp.JsonCodec{DecodedVal: &p.Attrs})
-	if err != nil && !cp.IsErrNoEnt(err) {
+	_, err = p.dir.GetFile(procsAttrsPath, &jsonCodec{DecodedVal: &p.Attrs})
+	if err != nil && !IsErrNoEnt(err) {
 		return nil, err
 	}
 
-	f, err := p.dir.GetFile(registeredPath, new(cp.StringCodec))
+	f, err := p.dir.GetFile(registeredPath, new(stringCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, "registered not found for %s:%s", app.Name, name)
 		}
 		return nil, err
@@ -256,8 +255,8 @@ func getProc(app *App, name string, s cp.Snapshotable) (*Proc, error) {
 	return p, nil
 }
 
-func getProcInstances(ids []string, s cp.Snapshotable) ([]*Instance, error) {
-	ch, errch := cp.GetSnapshotables(ids, func(idstr string) (cp.Snapshotable, error) {
+func getProcInstances(ids []string, s Snapshotable) ([]*Instance, error) {
+	ch, errch := getSnapshotables(ids, func(idstr string) (Snapshotable, error) {
 		id, err := parseInstanceId(idstr)
 		if err != nil {
 			return nil, err
@@ -276,7 +275,7 @@ func getProcInstances(ids []string, s cp.Snapshotable) ([]*Instance, error) {
 	return ins, nil
 }
 
-func getProcInstanceIds(p *Proc, s cp.Snapshotable) ([]int64, error) {
+func getProcInstanceIds(p *Proc, s Snapshotable) ([]int64, error) {
 	sp := s.GetSnapshot()
 	revs, err := sp.Getdir(p.dir.Prefix("instances"))
 	if err != nil {
@@ -293,7 +292,7 @@ func getProcInstanceIds(p *Proc, s cp.Snapshotable) ([]int64, error) {
 	return ids, nil
 }
 
-func claimNextPort(s cp.Snapshot) (int, error) {
+func claimNextPort(s Snapshot) (int, error) {
 	for {
 		var err error
 		s, err = s.FastForward()
@@ -301,7 +300,7 @@ func claimNextPort(s cp.Snapshot) (int, error) {
 			return -1, err
 		}
 
-		f, err := s.GetFile(nextPortPath, new(cp.IntCodec))
+		f, err := s.getFile(nextPortPath, new(intCodec))
 		if err == nil {
 			port := f.Value.(int)
 
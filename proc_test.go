@@ -170,7 +170,7 @@ func TestProcGetFailedInstances(t *testing.T) {
 		t.Fatal(err)
 	}
 	if len(failed) != 4 {
-		t.Errorf("list is missing instances: %s", len(failed))
+		t.Errorf("list is missing instances: %d", len(failed))
 	}
 
 	is, err := proc.GetInstances()
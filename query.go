@@ -0,0 +1,265 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"path"
+	"sort"
+	"time"
+)
+
+// A SortOrder orders the instances found by a Query.
+type SortOrder string
+
+const (
+	SortById         SortOrder = "id"
+	SortByRegistered SortOrder = "registered"
+	SortByRestarts   SortOrder = "restarts"
+)
+
+// A Query selects instances. Every field which is set has to match, empty
+// fields match all instances. Host matches the ip as well as the hostname
+// of an instance, Claimer every host which ever claimed it. Restarts are
+// counted over all reasons.
+//
+// The instances found are ordered by Sort, by id if it's empty, and ties
+// are broken by id. Offset and Limit select a page of them, a Limit of 0
+// selects all.
+type Query struct {
+	App      string
+	Proc     string
+	Revision string
+	Env      string
+	Host     string
+	Claimer  string
+	Status   []InsStatus
+
+	RegisteredAfter  time.Time
+	RegisteredBefore time.Time
+	MinRestarts      *int
+	MaxRestarts      *int
+	Locked           *bool
+
+	Sort    SortOrder
+	Reverse bool
+	Offset  int
+	Limit   int
+}
+
+// FindInstances returns the instances matching q, read at the latest
+// revision. Like GetInstances it returns an InstancesError along with the
+// instances which could be read if some couldn't.
+func (s *Store) FindInstances(q Query) ([]*Instance, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		return nil, err
+	}
+	return findInstances(q, sp)
+}
+
+func findInstances(q Query, sp Snapshot) ([]*Instance, error) {
+	ids, err := q.candidates(sp)
+	if err != nil {
+		return nil, err
+	}
+	instances, errs := getInstancesById(ids, sp)
+
+	found, err := q.find(instances)
+	if err != nil {
+		return nil, err
+	}
+	if errs != nil {
+		return found, errs
+	}
+	return found, nil
+}
+
+func (q *Query) validate() error {
+	switch q.Sort {
+	case "", SortById, SortByRegistered, SortByRestarts:
+	default:
+		return errorf(ErrInvalidArgument, "unknown sort order '%s'", q.Sort)
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return errorf(ErrInvalidArgument, "offset and limit can't be negative")
+	}
+	return nil
+}
+
+// candidates returns the ids of the instances q can match. Only the
+// lookups of a proc are listed if the query is limited to one and can't
+// match exited instances, which aren't listed by their proc.
+func (q *Query) candidates(sp Snapshot) ([]int64, error) {
+	ids := []int64{}
+
+	if q.App != "" && q.Proc != "" && len(q.Status) > 0 && !hasStatus(q.Status, InsStatusExited) {
+		revs := []string{q.Revision}
+		if q.Revision == "" {
+			var err error
+			revs, err = getdirOptional(sp, path.Join(appsPath, q.App, procsPath, q.Proc, instancesPath))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, rev := range revs {
+			revIds, err := getInstanceIds(q.App, rev, q.Proc, sp)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, revIds...)
+		}
+		for _, dir := range []string{failedPath, lostPath} {
+			names, err := getdirOptional(sp, path.Join(appsPath, q.App, procsPath, q.Proc, dir))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if id, err := parseInstanceId(name); err == nil {
+					ids = append(ids, id)
+				}
+			}
+		}
+		return uniqueIds(ids), nil
+	}
+
+	names, err := getdirOptional(sp, instancesPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		id, err := parseInstanceId(name)
+		if err != nil {
+			// Not an instance, reported by Fsck.
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// find returns the page of instances matching q in its order. Claimer and
+// Locked are read at the revision of each instance.
+func (q *Query) find(instances []*Instance) ([]*Instance, error) {
+	found := []*Instance{}
+	for _, ins := range instances {
+		ok, err := q.match(ins)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, ins)
+		}
+	}
+	q.sort(found)
+
+	if q.Offset >= len(found) {
+		return []*Instance{}, nil
+	}
+	found = found[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(found) {
+		found = found[:q.Limit]
+	}
+	return found, nil
+}
+
+func (q *Query) match(ins *Instance) (bool, error) {
+	restarts := restartCount(ins)
+
+	switch {
+	case q.App != "" && ins.AppName != q.App:
+	case q.Proc != "" && ins.ProcessName != q.Proc:
+	case q.Revision != "" && ins.RevisionName != q.Revision:
+	case q.Env != "" && ins.Env != q.Env:
+	case q.Host != "" && ins.Ip != q.Host && ins.Host != q.Host:
+	case len(q.Status) > 0 && !hasStatus(q.Status, ins.Status):
+	case !q.RegisteredAfter.IsZero() && !ins.Registered.After(q.RegisteredAfter):
+	case !q.RegisteredBefore.IsZero() && !ins.Registered.Before(q.RegisteredBefore):
+	case q.MinRestarts != nil && restarts < *q.MinRestarts:
+	case q.MaxRestarts != nil && restarts > *q.MaxRestarts:
+	default:
+		return q.matchFiles(ins)
+	}
+	return false, nil
+}
+
+// matchFiles matches the fields which aren't kept by Instance.
+func (q *Query) matchFiles(ins *Instance) (bool, error) {
+	sp := ins.GetSnapshot()
+
+	if q.Claimer != "" {
+		exists, _, err := sp.Exists(ins.dir.Prefix(claimsPath, q.Claimer))
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	if q.Locked != nil {
+		exists, _, err := sp.Exists(ins.dir.Prefix(lockPath))
+		if err != nil || exists != *q.Locked {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (q *Query) sort(instances []*Instance) {
+	less := func(a, b *Instance) bool { return a.Id < b.Id }
+
+	switch q.Sort {
+	case SortByRegistered:
+		less = func(a, b *Instance) bool {
+			if a.Registered.Equal(b.Registered) {
+				return a.Id < b.Id
+			}
+			return a.Registered.Before(b.Registered)
+		}
+	case SortByRestarts:
+		less = func(a, b *Instance) bool {
+			if restartCount(a) == restartCount(b) {
+				return a.Id < b.Id
+			}
+			return restartCount(a) < restartCount(b)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		if q.Reverse {
+			return less(instances[j], instances[i])
+		}
+		return less(instances[i], instances[j])
+	})
+}
+
+// uniqueIds drops the ids listed by more than one lookup, which Fsck
+// reports.
+func uniqueIds(ids []int64) []int64 {
+	seen := map[int64]bool{}
+	unique := []int64{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func restartCount(ins *Instance) int {
+	if ins.Restarts == nil {
+		return 0
+	}
+	return ins.Restarts.OOM + ins.Restarts.Fail
+}
+
+func hasStatus(statuses []InsStatus, s InsStatus) bool {
+	for _, status := range statuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+	"time"
+)
+
+func expectFound(t *testing.T, s *Store, q Query, want ...*Instance) {
+	found, err := s.FindInstances(q)
+	if err != nil {
+		t.Fatalf("%+v: %s", q, err)
+	}
+	ids := []int64{}
+	for _, ins := range found {
+		ids = append(ids, ins.Id)
+	}
+	wantIds := []int64{}
+	for _, ins := range want {
+		wantIds = append(wantIds, ins.Id)
+	}
+	if len(ids) != len(wantIds) {
+		t.Fatalf("expected %+v to find %v, got %v", q, wantIds, ids)
+	}
+	for i := range ids {
+		if ids[i] != wantIds[i] {
+			t.Fatalf("expected %+v to find %v, got %v", q, wantIds, ids)
+		}
+	}
+}
+
+func TestFindInstances(t *testing.T) {
+	s := visorSetup("/query-test")
+	register := func(app, rev, proc, env string) *Instance {
+		ins, err := s.RegisterInstance(app, rev, proc, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ins
+	}
+
+	web := register("cat", "128af9", "web", "prod")
+	worker := register("cat", "128af9", "worker", "prod")
+	canary := register("cat", "f00f00", "web", "canary")
+	dog := register("dog", "128af9", "web", "prod")
+
+	var err error
+	if web, err = web.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if web, err = web.Started("10.0.0.1", "box", 9000, 9001); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = web.Restarted(RestartFail, 3); err != nil {
+		t.Fatal(err)
+	}
+	if canary, err = canary.Claim("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if canary, err = canary.Unclaim("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dog.Lock("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	failed := register("cat", "128af9", "web", "prod")
+	if failed, err = failed.Claim("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if failed, err = failed.Failed("10.0.0.3", nil); err != nil {
+		t.Fatal(err)
+	}
+	exited := register("cat", "128af9", "web", "prod")
+	if exited, err = exited.Claim("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if exited, err = exited.Started("10.0.0.3", "box", 9002, 9003); err != nil {
+		t.Fatal(err)
+	}
+	if err = exited.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if exited, err = exited.Exited("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	finished := []InsStatus{InsStatusFailed, InsStatusExited}
+
+	expectFound(t, s, Query{}, web, worker, canary, dog, failed, exited)
+	expectFound(t, s, Query{App: "cat", Proc: "web"}, web, canary, failed, exited)
+	expectFound(t, s, Query{App: "cat", Proc: "web", Status: []InsStatus{InsStatusFailed}}, failed)
+	expectFound(t, s, Query{App: "cat", Proc: "web", Status: finished}, failed, exited)
+	expectFound(t, s, Query{App: "cat", Status: finished}, failed, exited)
+	expectFound(t, s, Query{App: "cat", Proc: "web", Revision: "f00f00"}, canary)
+	expectFound(t, s, Query{Revision: "128af9", Env: "prod", Proc: "web", Status: []InsStatus{InsStatusRunning, InsStatusPending}}, web, dog)
+	expectFound(t, s, Query{Status: []InsStatus{InsStatusRunning, InsStatusClaimed}}, web)
+	expectFound(t, s, Query{Status: []InsStatus{InsStatusPending}}, worker, canary, dog)
+	expectFound(t, s, Query{Host: "box", Status: []InsStatus{InsStatusRunning}}, web)
+	expectFound(t, s, Query{Host: "10.0.0.1"}, web)
+	expectFound(t, s, Query{Claimer: "10.0.0.2"}, canary)
+
+	locked, unlocked := true, false
+	expectFound(t, s, Query{Locked: &locked}, dog)
+	expectFound(t, s, Query{Locked: &unlocked, App: "dog"})
+
+	one, none := 1, 0
+	expectFound(t, s, Query{MinRestarts: &one}, web)
+	expectFound(t, s, Query{MaxRestarts: &none, App: "cat"}, worker, canary, failed, exited)
+
+	expectFound(t, s, Query{RegisteredAfter: time.Now().Add(time.Minute)})
+	expectFound(t, s, Query{RegisteredBefore: time.Now().Add(time.Minute), App: "dog"}, dog)
+
+	expectFound(t, s, Query{Sort: SortByRestarts, Reverse: true, Limit: 2}, web, exited)
+	expectFound(t, s, Query{Sort: SortByRegistered, Offset: 1, Limit: 2}, worker, canary)
+	expectFound(t, s, Query{Offset: 6})
+
+	if _, err := s.FindInstances(Query{Sort: "name"}); !IsErrInvalidArgument(err) {
+		t.Errorf("expected an unknown sort order to be invalid, got %v", err)
+	}
+	if _, err := s.FindInstances(Query{Limit: -1}); !IsErrInvalidArgument(err) {
+		t.Errorf("expected a negative limit to be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultClaimLease is the lease of claims made with Instance.Claim.
+const DefaultClaimLease = 5 * time.Minute
+
+const DefaultReaperInterval = 30 * time.Second
+
+// ReapClaims unclaims the claimed instances whose lease has passed, so
+// that they can be claimed again, and returns them. The expiry is appended
+// to the claim of the instance. Instances which were renewed, started or
+// reaped by someone else in the meantime are skipped, which makes it safe
+// for every pm to reap.
+func (s *Store) ReapClaims() ([]*Instance, error) {
+	claimed, err := s.FindInstances(Query{Status: []InsStatus{InsStatusClaimed}})
+	if _, ok := err.(InstancesError); err != nil && !ok {
+		return nil, err
+	}
+
+	now := time.Now()
+	reaped := []*Instance{}
+	for _, ins := range claimed {
+		expired, err := ins.expireClaim(now)
+		if err != nil {
+			return reaped, err
+		}
+		if expired {
+			reaped = append(reaped, ins)
+		}
+	}
+	return reaped, nil
+}
+
+// A Reaper calls ReapClaims every Interval.
+type Reaper struct {
+	store *Store
+
+	Interval time.Duration
+
+	// Reaped receives the instances whose claim expired, if set.
+	Reaped chan *Instance
+	// Errors receives failed reaps, if set.
+	Errors chan error
+}
+
+func (s *Store) NewReaper() *Reaper {
+	return &Reaper{store: s, Interval: DefaultReaperInterval}
+}
+
+// Run reaps until ctx is done.
+func (r *Reaper) Run(ctx context.Context) error {
+	every(ctx, r.Interval, r.Errors, func() error {
+		reaped, err := r.store.ReapClaims()
+		for _, ins := range reaped {
+			if r.Reaped == nil {
+				break
+			}
+			select {
+			case r.Reaped <- ins:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return err
+	})
+	return nil
+}
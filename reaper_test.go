@@ -0,0 +1,200 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventTypesSince returns the types of the events after rev up to the
+// latest revision.
+func eventTypesSince(t *testing.T, s *Store, rev int64) []EventType {
+	latest, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l := make(chan *Event)
+	go s.WatchEventSince(ctx, rev, l)
+
+	types := []EventType{}
+	for ev := range l {
+		if ev.Rev > latest.Rev {
+			cancel()
+			continue
+		}
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func hasEventType(types []EventType, want EventType) bool {
+	for _, t := range types {
+		if t == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReapClaims(t *testing.T) {
+	s := visorSetup("/reaper-test")
+
+	short, err := setupInstance(t, s, "web", "").ClaimLease("10.0.0.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := setupInstance(t, s, "web", "").Claim("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := setupInstance(t, s, "web", "").ClaimLease("10.0.0.3", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started, err = started.Started("10.0.0.3", "box", 9000, 9001); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = setupInstance(t, s, "web", "").ClaimLease("10.0.0.1", 0); !IsErrInvalidArgument(err) {
+		t.Errorf("expected a zero lease to be invalid, got %v", err)
+	}
+
+	got, err := s.GetInstance(long.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Lease.Equal(long.Lease) || time.Until(got.Lease) < DefaultClaimLease-2*time.Second {
+		t.Errorf("expected lease %s, got %s", long.Lease, got.Lease)
+	}
+
+	reaped, err := s.ReapClaims()
+	if err != nil || len(reaped) != 0 {
+		t.Errorf("expected no claim to expire yet, got %v (%v)", reaped, err)
+	}
+
+	if _, err = short.RenewClaim("10.0.0.2", time.Second); !IsErrUnauthorized(err) {
+		t.Errorf("expected renewal by another host to be rejected, got %v", err)
+	}
+	if short, err = short.RenewClaim("10.0.0.1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(short.Lease) + 10*time.Millisecond)
+
+	before, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reaped, err = s.ReapClaims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reaped) != 1 || reaped[0].Id != short.Id {
+		t.Fatalf("expected only instance %d to be reaped, got %v", short.Id, reaped)
+	}
+
+	got, err = s.GetInstance(short.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != InsStatusPending || got.Ip != "" || !got.Lease.IsZero() {
+		t.Errorf("expected reaped instance to be pending, got %s at %q until %s", got.Status, got.Ip, got.Lease)
+	}
+	claim, _, err := got.dir.Get(claimsPath + "/10.0.0.1")
+	if err != nil || !strings.Contains(claim, "claim lease expired") {
+		t.Errorf("expected the expiry in the claim, got %q (%v)", claim, err)
+	}
+	history, err := got.History()
+	if err != nil || history[len(history)-1].Event != HistUnclaimed {
+		t.Errorf("expected the expiry in the history, got %v (%v)", history, err)
+	}
+	if types := eventTypesSince(t, s, before.Rev); !hasEventType(types, EvInsUnclaim) || hasEventType(types, EvInsClaim) {
+		t.Errorf("expected the expiry to be an unclaim only, got %v", types)
+	}
+	if _, err = short.RenewClaim("10.0.0.1", time.Second); !IsErrInvalidState(err) {
+		t.Errorf("expected renewal of an expired claim to fail, got %v", err)
+	}
+
+	// The claimer which lost the claim can claim it again.
+	if before, err = before.FastForward(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = got.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if types := eventTypesSince(t, s, before.Rev); !hasEventType(types, EvInsClaim) {
+		t.Errorf("expected a claim event, got %v", types)
+	}
+	if got, err = s.GetInstance(short.Id); err != nil || got.Status != InsStatusClaimed {
+		t.Errorf("expected instance to be claimed again, got %v (%v)", got, err)
+	}
+
+	if got, err = s.GetInstance(started.Id); err != nil || got.Status != InsStatusRunning {
+		t.Errorf("expected started instance to be kept, got %v (%v)", got, err)
+	}
+}
+
+func TestReapClaimsConflict(t *testing.T) {
+	s := visorSetup("/reaper-conflict-test")
+
+	ins, err := setupInstance(t, s, "web", "").ClaimLease("10.0.0.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *ins
+	if _, err = ins.RenewClaim("10.0.0.1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := stale.expireClaim(time.Now().Add(time.Minute))
+	if err != nil || expired {
+		t.Errorf("expected a renewed claim to be kept, got %v (%v)", expired, err)
+	}
+
+	stale = *ins
+	if _, err = ins.Started("10.0.0.1", "box", 9000, 9001); err != nil {
+		t.Fatal(err)
+	}
+	expired, err = stale.expireClaim(time.Now().Add(2 * time.Hour))
+	if err != nil || expired {
+		t.Errorf("expected a started instance to be kept, got %v (%v)", expired, err)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	s := visorSetup("/reaper-run-test")
+
+	ins, err := setupInstance(t, s, "web", "").ClaimLease("10.0.0.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.NewReaper()
+	r.Interval = 10 * time.Millisecond
+	r.Reaped = make(chan *Instance)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case reaped := <-r.Reaped:
+		if reaped.Id != ins.Id {
+			t.Errorf("expected instance %d to be reaped, got %d", ins.Id, reaped.Id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the claim to expire")
+	}
+}
@@ -7,14 +7,13 @@ package visor
 
 import (
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
 	"time"
 )
 
 // A Revision represents an application revision,
 // identifiable by its `ref`.
 type Revision struct {
-	dir        *cp.Dir
+	dir        *dir
 	App        *App
 	Ref        string
 	ArchiveUrl string
@@ -29,12 +28,12 @@ const (
 // NewRevision returns a new instance of Revision.
 func (s *Store) NewRevision(app *App, ref, archiveUrl string) (rev *Revision) {
 	rev = &Revision{App: app, Ref: ref, ArchiveUrl: archiveUrl}
-	rev.dir = cp.NewDir(app.dir.Prefix(revsPath, ref), s.GetSnapshot())
+	rev.dir = newDir(app.dir.Prefix(revsPath, ref), s.GetSnapshot())
 
 	return
 }
 
-func (r *Revision) GetSnapshot() cp.Snapshot {
+func (r *Revision) GetSnapshot() Snapshot {
 	return r.dir.Snapshot
 }
 
@@ -110,25 +109,25 @@ func (s *Store) GetRevisions() (revisions []*Revision, err error) {
 	return
 }
 
-func getRevision(app *App, ref string, s cp.Snapshotable) (*Revision, error) {
+func getRevision(app *App, ref string, s Snapshotable) (*Revision, error) {
 	r := &Revision{
-		dir: cp.NewDir(app.dir.Prefix(revsPath, ref), s.GetSnapshot()),
+		dir: newDir(app.dir.Prefix(revsPath, ref), s.GetSnapshot()),
 		App: app,
 		Ref: ref,
 	}
 
-	f, err := r.dir.GetFile(archiveUrlPath, new(cp.StringCodec))
+	f, err := r.dir.GetFile(archiveUrlPath, new(stringCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, "archive-url not found for %s:%s", app.Name, ref)
 		}
 		return nil, err
 	}
 	r.ArchiveUrl = f.Value.(string)
 
-	f, err = r.dir.GetFile(registeredPath, new(cp.StringCodec))
+	f, err = r.dir.GetFile(registeredPath, new(stringCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, "registered not found for %s:%s", app.Name, ref)
 		}
 		return nil, err
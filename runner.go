@@ -7,8 +7,8 @@ package visor
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
 	"github.com/soundcloud/visor/net"
 	"io"
 	"path"
@@ -28,7 +28,7 @@ const (
 )
 
 type Runner struct {
-	dir        *cp.Dir
+	dir        *dir
 	Addr       string
 	InstanceId int64
 	conn       io.ReadWriteCloser
@@ -37,14 +37,14 @@ type Runner struct {
 
 func (s *Store) NewRunner(addr string, instanceId int64, network net.Network) *Runner {
 	return &Runner{
-		dir:        cp.NewDir(runnerPath(addr), s.GetSnapshot()),
+		dir:        newDir(runnerPath(addr), s.GetSnapshot()),
 		Addr:       addr,
 		InstanceId: instanceId,
 		net:        network,
 	}
 }
 
-func (r *Runner) GetSnapshot() cp.Snapshot {
+func (r *Runner) GetSnapshot() Snapshot {
 	return r.dir.Snapshot
 }
 
@@ -62,7 +62,7 @@ func (r *Runner) Register() (*Runner, error) {
 		return nil, ErrConflict
 	}
 
-	f := cp.NewFile(r.dir.Name, []string{strconv.FormatInt(r.InstanceId, 10)}, new(cp.ListCodec), sp)
+	f := newFile(r.dir.Name, []string{strconv.FormatInt(r.InstanceId, 10)}, new(listCodec), sp)
 	f, err = f.Save()
 	if err != nil {
 		return nil, err
@@ -156,7 +156,7 @@ func (r *Runner) Exit() error {
 func (r *Runner) Down() error {
 	out, err := r.cmd("down")
 	if out != "OK\n" {
-		return fmt.Errorf(out)
+		return fmt.Errorf("%s", out)
 	}
 	return err
 }
@@ -186,7 +186,7 @@ func (s *Store) RunnersByHost(host string) ([]*Runner, error) {
 	if err != nil {
 		return nil, err
 	}
-	ch, errch := cp.GetSnapshotables(ids, func(id string) (cp.Snapshotable, error) {
+	ch, errch := getSnapshotables(ids, func(id string) (Snapshotable, error) {
 		return getRunner(runnerAddr(host, id), sp)
 	})
 	runners := []*Runner{}
@@ -212,43 +212,66 @@ func (s *Store) GetRunner(addr string) (*Runner, error) {
 }
 
 func (s *Store) WatchRunnerStart(host string, ch chan *Runner, errch chan error) {
-	var sp cp.Snapshotable = s
-	for {
-		ev, err := waitRunnersByHost(host, sp)
-		if err != nil {
-			errch <- err
-			return
-		}
-		sp = ev
+	_, err := s.watchRunnerStart(context.Background(), host, ch)
+	errch <- err
+}
 
-		if !ev.IsSet() {
-			continue
-		}
-		addr := addrFromPath(ev.Path)
+// WatchRunnerStartContext is like WatchRunnerStart, but returns once ctx
+// is done, see WatchEventRawContext.
+func (s *Store) WatchRunnerStartContext(ctx context.Context, host string, ch chan *Runner) (int64, error) {
+	defer close(ch)
+	return s.watchRunnerStart(ctx, host, ch)
+}
+
+func (s *Store) WatchRunnerStop(host string, ch chan string, errch chan error) {
+	_, err := s.watchRunnerStop(context.Background(), host, ch)
+	errch <- err
+}
+
+// WatchRunnerStopContext is like WatchRunnerStop, but returns once ctx is
+// done, see WatchEventRawContext.
+func (s *Store) WatchRunnerStopContext(ctx context.Context, host string, ch chan string) (int64, error) {
+	defer close(ch)
+	return s.watchRunnerStop(ctx, host, ch)
+}
 
-		runner, err := getRunner(addr, ev)
+func (s *Store) watchRunnerStart(ctx context.Context, host string, ch chan *Runner) (int64, error) {
+	sp := s.GetSnapshot()
+	for {
+		ev, err := waitRunnersByHost(ctx, host, sp)
 		if err != nil {
-			errch <- err
-			return
+			return sp.Rev, err
+		}
+		if ev.IsSet() {
+			runner, err := getRunner(addrFromPath(ev.Path), ev)
+			if err != nil {
+				return sp.Rev, err
+			}
+			select {
+			case ch <- runner:
+			case <-ctx.Done():
+				return sp.Rev, ctx.Err()
+			}
 		}
-		ch <- runner
+		sp = sp.Join(ev)
 	}
 }
 
-func (s *Store) WatchRunnerStop(host string, ch chan string, errch chan error) {
-	var sp cp.Snapshotable = s
+func (s *Store) watchRunnerStop(ctx context.Context, host string, ch chan string) (int64, error) {
+	sp := s.GetSnapshot()
 	for {
-		ev, err := waitRunnersByHost(host, sp)
+		ev, err := waitRunnersByHost(ctx, host, sp)
 		if err != nil {
-			errch <- err
-			return
+			return sp.Rev, err
 		}
-		sp = ev
-
-		if !ev.IsDel() {
-			continue
+		if ev.IsDel() {
+			select {
+			case ch <- addrFromPath(ev.Path):
+			case <-ctx.Done():
+				return sp.Rev, ctx.Err()
+			}
 		}
-		ch <- addrFromPath(ev.Path)
+		sp = sp.Join(ev)
 	}
 }
 
@@ -259,11 +282,11 @@ func addrFromPath(path string) string {
 	return addr
 }
 
-func getRunner(addr string, s cp.Snapshotable) (*Runner, error) {
+func getRunner(addr string, s Snapshotable) (*Runner, error) {
 	sp := s.GetSnapshot()
-	f, err := sp.GetFile(runnerPath(addr), new(cp.ListCodec))
+	f, err := sp.getFile(runnerPath(addr), new(listCodec))
 	if err != nil {
-		if cp.IsErrNoEnt(err) {
+		if IsErrNoEnt(err) {
 			err = errorf(ErrNotFound, "runner '%s' not found", addr)
 		}
 		return nil, err
@@ -278,9 +301,9 @@ func getRunner(addr string, s cp.Snapshotable) (*Runner, error) {
 	return storeFromSnapshotable(sp).NewRunner(addr, insId, new(net.Net)), nil
 }
 
-func waitRunnersByHost(host string, s cp.Snapshotable) (cp.Event, error) {
+func waitRunnersByHost(ctx context.Context, host string, s Snapshotable) (RawEvent, error) {
 	sp := s.GetSnapshot()
-	return sp.Wait(path.Join(runnersPath, host, "*"))
+	return sp.wait(ctx, path.Join(runnersPath, host, "*"))
 }
 
 func runnerAddr(host, port string) string {
@@ -6,6 +6,7 @@
 package visor
 
 import (
+	"context"
 	"github.com/soundcloud/visor/net"
 	"testing"
 	"time"
@@ -178,3 +179,22 @@ func TestWatchRunnerStop(t *testing.T) {
 		t.Errorf("expected runner, got timeout")
 	}
 }
+
+func TestWatchRunnerStartContext(t *testing.T) {
+	s := runnerSetup()
+	ch := make(chan *Runner)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	rev, err := s.WatchRunnerStartContext(ctx, "127.0.0.1", ch)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected watch to end with its context, got %v", err)
+	}
+	if rev != s.GetSnapshot().Rev {
+		t.Errorf("expected last revision %d, got %d", s.GetSnapshot().Rev, rev)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expected channel to be closed")
+	}
+}
@@ -0,0 +1,513 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const schemaPath = "/schema-version"
+
+// uidBasePath holds the base added to uids, see Snapshot.Getuid.
+const uidBasePath = "/uid-base"
+
+// Snapshotable is implemented by all types which are bound to a
+// Snapshot of the coordinator.
+type Snapshotable interface {
+	GetSnapshot() Snapshot
+}
+
+// A Snapshot is a view of the coordinator at a specific revision.
+type Snapshot struct {
+	Rev  int64
+	conn *conn
+}
+
+// conn scopes a Backend to the root a Store was dialed with.
+type conn struct {
+	backend Backend
+	root    string
+}
+
+func (c *conn) path(p string) string {
+	return path.Join(c.root, p)
+}
+
+func (c *conn) relpath(p string) string {
+	if c.root == "/" {
+		return p
+	}
+	return "/" + strings.TrimLeft(strings.TrimPrefix(p, c.root), "/")
+}
+
+func dialUri(uri, root string) (Snapshot, error) {
+	b, err := DialBackend(uri)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return newSnapshot(b, root)
+}
+
+func newSnapshot(b Backend, root string) (Snapshot, error) {
+	rev, err := b.Rev()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{rev, &conn{b, path.Join("/", root)}}, nil
+}
+
+func (s Snapshot) GetSnapshot() Snapshot {
+	return s
+}
+
+// FastForward returns a Snapshot at the latest revision of the coordinator.
+func (s Snapshot) FastForward() (Snapshot, error) {
+	rev, err := s.conn.backend.Rev()
+	if err != nil {
+		return s, err
+	}
+	return Snapshot{rev, s.conn}, nil
+}
+
+// Join returns the more recent Snapshot of s and other.
+func (s Snapshot) Join(other Snapshotable) Snapshot {
+	sp := other.GetSnapshot()
+	if sp.Rev > s.Rev {
+		return sp
+	}
+	return s
+}
+
+// Exists checks if a file or directory exists at path.
+func (s Snapshot) Exists(path string) (exists bool, rev int64, err error) {
+	_, rev, err = s.Stat(path, nil)
+	if IsErrNoEnt(err) {
+		return false, RevMissing, nil
+	}
+	if err != nil {
+		return false, rev, err
+	}
+	return true, rev, nil
+}
+
+// Get returns the body and file revision of the file at path.
+func (s Snapshot) Get(path string) (string, int64, error) {
+	body, rev, err := s.conn.backend.Get(s.conn.path(path), s.Rev)
+	if err != nil {
+		return "", rev, err
+	}
+	return string(body), rev, nil
+}
+
+// Getdir returns the entry names of the directory at path.
+func (s Snapshot) Getdir(path string) ([]string, error) {
+	return s.conn.backend.Getdir(s.conn.path(path), s.Rev)
+}
+
+// Stat returns the length and file revision of the file or directory at
+// path. If rev is nil the revision of the Snapshot is used.
+func (s Snapshot) Stat(path string, rev *int64) (int, int64, error) {
+	r := s.Rev
+	if rev != nil {
+		r = *rev
+	}
+	return s.conn.backend.Stat(s.conn.path(path), r)
+}
+
+// Set writes body to the file at path, given the file wasn't changed
+// after the Snapshot was taken.
+func (s Snapshot) Set(path, body string) (Snapshot, error) {
+	rev, err := s.conn.backend.Set(s.conn.path(path), s.Rev, []byte(body))
+	if err != nil {
+		return s, err
+	}
+	return Snapshot{rev, s.conn}, nil
+}
+
+// Del removes the file or directory tree at path.
+func (s Snapshot) Del(path string) error {
+	return s.conn.backend.Del(s.conn.path(path), s.Rev)
+}
+
+// Wait blocks until a file matching glob changes after the Snapshot. If
+// several matching files were changed by the same transaction only the
+// first change is returned, see WaitAll.
+func (s Snapshot) Wait(glob string) (RawEvent, error) {
+	return s.wait(context.Background(), glob)
+}
+
+// WaitAll blocks until files matching glob change after the Snapshot and
+// returns all matching changes made at the first such revision.
+func (s Snapshot) WaitAll(glob string) ([]RawEvent, error) {
+	return s.waitAll(context.Background(), glob)
+}
+
+func (s Snapshot) wait(ctx context.Context, glob string) (RawEvent, error) {
+	evs, err := s.waitAll(ctx, glob)
+	if err != nil {
+		return RawEvent{}, err
+	}
+	return evs[0], nil
+}
+
+func (s Snapshot) waitAll(ctx context.Context, glob string) ([]RawEvent, error) {
+	evs, err := s.conn.backend.Wait(ctx, s.conn.path(glob), s.Rev+1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range evs {
+		evs[i].Path = s.conn.relpath(evs[i].Path)
+		evs[i].snapshot = Snapshot{evs[i].Rev, s.conn}
+	}
+	return evs, nil
+}
+
+// Txn starts a transaction based on the Snapshot.
+func (s Snapshot) Txn() *Txn {
+	return &Txn{sp: s}
+}
+
+// Getuid returns a coordinator wide unique id. Import sets a base which
+// is added to the ids of the backend, so that they start above the ids of
+// the imported registry.
+func (s Snapshot) Getuid() (int64, error) {
+	uid, err := s.conn.backend.Getuid()
+	if err != nil {
+		return 0, err
+	}
+	sp, err := s.FastForward()
+	if err != nil {
+		return 0, err
+	}
+	body, _, err := sp.Get(uidBasePath)
+	if IsErrNoEnt(err) {
+		return uid, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	base, err := strconv.ParseInt(body, 10, 64)
+	if err != nil {
+		return 0, errorf(ErrInvalidFile, "invalid uid base '%s'", body)
+	}
+	return base + uid, nil
+}
+
+func (s Snapshot) getFile(path string, c codec) (*file, error) {
+	f := &file{Path: path, codec: c, Snapshot: s}
+
+	body, rev, err := s.conn.backend.Get(s.conn.path(path), s.Rev)
+	if err != nil {
+		return f, err
+	}
+	f.FileRev = rev
+
+	f.Value, err = c.Decode(body)
+	if err != nil {
+		return nil, errorf(ErrInvalidFile, "error decoding %s: %s", path, err)
+	}
+	return f, nil
+}
+
+func (s Snapshot) reset() error {
+	return s.conn.backend.Del(s.conn.root, RevClobber)
+}
+
+// A Txn collects writes which Commit applies atomically, given none of
+// the files they touch was changed after the Snapshot the Txn is based on.
+// A later write to the same path replaces an earlier one.
+type Txn struct {
+	sp  Snapshot
+	ops []TxnOp
+	err error
+}
+
+// Set adds a write of body to the file at path.
+func (t *Txn) Set(path, body string) *Txn {
+	return t.add(TxnOp{OpSet, t.sp.conn.path(path), []byte(body)})
+}
+
+// Del adds the removal of the file or directory tree at path.
+func (t *Txn) Del(path string) *Txn {
+	return t.add(TxnOp{OpDel, t.sp.conn.path(path), nil})
+}
+
+// Commit applies all writes of the Txn and returns a Snapshot at their
+// revision. A conflicting change fails the whole Txn with ErrRevMismatch.
+func (t *Txn) Commit() (Snapshot, error) {
+	if t.err != nil {
+		return t.sp, t.err
+	}
+	if len(t.ops) == 0 {
+		return t.sp, nil
+	}
+	rev, err := t.sp.conn.backend.Commit(t.ops, t.sp.Rev)
+	if err != nil {
+		return t.sp, err
+	}
+	return Snapshot{rev, t.sp.conn}, nil
+}
+
+func (t *Txn) setValue(path string, value interface{}, c codec) *Txn {
+	body, err := c.Encode(value)
+	if err != nil {
+		if t.err == nil {
+			t.err = err
+		}
+		return t
+	}
+	return t.Set(path, string(body))
+}
+
+func (t *Txn) add(op TxnOp) *Txn {
+	for i, other := range t.ops {
+		if other.Path == op.Path {
+			t.ops = append(t.ops[:i], t.ops[i+1:]...)
+			break
+		}
+	}
+	t.ops = append(t.ops, op)
+
+	return t
+}
+
+// Op is the kind of change a RawEvent represents.
+type Op int
+
+const (
+	OpSet Op = iota + 1
+	OpDel
+)
+
+// A RawEvent is a single change to a file in the coordinator.
+type RawEvent struct {
+	Op       Op
+	Path     string
+	Body     []byte
+	Rev      int64
+	snapshot Snapshot
+}
+
+func (e RawEvent) IsSet() bool {
+	return e.Op == OpSet
+}
+
+func (e RawEvent) IsDel() bool {
+	return e.Op == OpDel
+}
+
+// GetSnapshot returns the Snapshot at the revision of the change.
+func (e RawEvent) GetSnapshot() Snapshot {
+	return e.snapshot
+}
+
+func (e RawEvent) String() string {
+	op := "set"
+	if e.IsDel() {
+		op = "del"
+	}
+	return fmt.Sprintf("RawEvent<%s %s@%d>", op, e.Path, e.Rev)
+}
+
+// dir is a directory in the coordinator bound to a Snapshot.
+type dir struct {
+	Name     string
+	Snapshot Snapshot
+}
+
+func newDir(name string, s Snapshot) *dir {
+	return &dir{name, s}
+}
+
+func (d *dir) GetSnapshot() Snapshot {
+	return d.Snapshot
+}
+
+func (d *dir) Join(s Snapshotable) *dir {
+	return &dir{d.Name, d.Snapshot.Join(s)}
+}
+
+func (d *dir) Prefix(paths ...string) string {
+	return path.Join(append([]string{d.Name}, paths...)...)
+}
+
+func (d *dir) Get(name string) (string, int64, error) {
+	return d.Snapshot.Get(d.Prefix(name))
+}
+
+func (d *dir) GetFile(name string, c codec) (*file, error) {
+	return d.Snapshot.getFile(d.Prefix(name), c)
+}
+
+func (d *dir) Set(name, value string) (*dir, error) {
+	sp, err := d.Snapshot.Set(d.Prefix(name), value)
+	if err != nil {
+		return nil, err
+	}
+	return &dir{d.Name, sp}, nil
+}
+
+func (d *dir) Del(name string) error {
+	return d.Snapshot.Del(d.Prefix(name))
+}
+
+// file is a single encoded value in the coordinator bound to a Snapshot.
+type file struct {
+	Path     string
+	Value    interface{}
+	FileRev  int64
+	codec    codec
+	Snapshot Snapshot
+}
+
+func newFile(path string, value interface{}, c codec, s Snapshotable) *file {
+	return &file{Path: path, Value: value, codec: c, Snapshot: s.GetSnapshot()}
+}
+
+func (f *file) GetSnapshot() Snapshot {
+	return f.Snapshot
+}
+
+// Save writes the file, given it wasn't changed after its Snapshot.
+func (f *file) Save() (*file, error) {
+	return f.write(f.Value, f.Snapshot.Rev)
+}
+
+// Set writes value to the file, given it wasn't changed after it was read.
+func (f *file) Set(value interface{}) (*file, error) {
+	return f.write(value, f.FileRev)
+}
+
+func (f *file) write(value interface{}, rev int64) (*file, error) {
+	body, err := f.codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	sp := f.Snapshot
+	rev, err = sp.conn.backend.Set(sp.conn.path(f.Path), rev, body)
+	if err != nil {
+		return nil, err
+	}
+	return &file{f.Path, value, rev, f.codec, Snapshot{rev, sp.conn}}, nil
+}
+
+type codec interface {
+	Encode(interface{}) ([]byte, error)
+	Decode([]byte) (interface{}, error)
+}
+
+type stringCodec struct{}
+
+func (*stringCodec) Encode(v interface{}) ([]byte, error) {
+	return []byte(v.(string)), nil
+}
+
+func (*stringCodec) Decode(b []byte) (interface{}, error) {
+	return string(b), nil
+}
+
+type intCodec struct{}
+
+func (*intCodec) Encode(v interface{}) ([]byte, error) {
+	return []byte(strconv.Itoa(v.(int))), nil
+}
+
+func (*intCodec) Decode(b []byte) (interface{}, error) {
+	return strconv.Atoi(string(b))
+}
+
+type listCodec struct{}
+
+func (*listCodec) Encode(v interface{}) ([]byte, error) {
+	return []byte(strings.Join(v.([]string), " ")), nil
+}
+
+func (*listCodec) Decode(b []byte) (interface{}, error) {
+	return strings.Fields(string(b)), nil
+}
+
+type listIntCodec struct{}
+
+func (*listIntCodec) Encode(v interface{}) ([]byte, error) {
+	fields := []string{}
+	for _, i := range v.([]int) {
+		fields = append(fields, strconv.Itoa(i))
+	}
+	return []byte(strings.Join(fields, " ")), nil
+}
+
+func (*listIntCodec) Decode(b []byte) (interface{}, error) {
+	ints := []int{}
+	for _, field := range strings.Fields(string(b)) {
+		i, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
+
+type jsonCodec struct {
+	DecodedVal interface{}
+}
+
+func (*jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *jsonCodec) Decode(b []byte) (interface{}, error) {
+	if c.DecodedVal != nil {
+		err := json.Unmarshal(b, c.DecodedVal)
+		return c.DecodedVal, err
+	}
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// getSnapshotables calls fn for every item concurrently and delivers the
+// results on the returned channels.
+func getSnapshotables(items []string, fn func(string) (Snapshotable, error)) (chan Snapshotable, chan error) {
+	ch := make(chan Snapshotable, len(items))
+	errch := make(chan error, len(items))
+
+	for _, item := range items {
+		go func(item string) {
+			s, err := fn(item)
+			if err != nil {
+				errch <- err
+			} else {
+				ch <- s
+			}
+		}(item)
+	}
+	return ch, errch
+}
+
+func verifySchema(version int, s Snapshot) (int, error) {
+	val, _, err := s.Get(schemaPath)
+	if err != nil {
+		return -1, err
+	}
+	v, err := strconv.Atoi(val)
+	if err != nil {
+		return -1, errorf(ErrInvalidFile, "invalid schema version: %s", val)
+	}
+	if v != version {
+		return v, errorf(ErrSchemaMism, "schema mismatch")
+	}
+	return v, nil
+}
+
+func setSchemaVersion(version int, s Snapshot) (Snapshot, error) {
+	return s.Set(schemaPath, strconv.Itoa(version))
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		c     codec
+		value interface{}
+		body  string
+	}{
+		{new(stringCodec), "10.0.0.1", "10.0.0.1"},
+		{new(intCodec), 8000, "8000"},
+		{new(listCodec), []string{"cat", "128af9", "web"}, "cat 128af9 web"},
+		{new(listIntCodec), []int{2, 4}, "2 4"},
+		{new(jsonCodec), map[string]interface{}{"stack": "whiskers"}, `{"stack":"whiskers"}`},
+	}
+
+	for _, test := range tests {
+		body, err := test.c.Encode(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.body {
+			t.Errorf("expected %T to encode %v as %q, got %q", test.c, test.value, test.body, body)
+		}
+		value, err := test.c.Decode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("expected %T to decode %q as %#v, got %#v", test.c, body, test.value, value)
+		}
+	}
+
+	value, err := new(listCodec).Decode([]byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value.([]string)) != 0 {
+		t.Errorf("expected empty list, got %#v", value)
+	}
+}
+
+func TestConnPaths(t *testing.T) {
+	c := &conn{root: "/visor"}
+
+	if p := c.path("apps"); p != "/visor/apps" {
+		t.Errorf("expected /visor/apps, got %s", p)
+	}
+	if p := c.path("/next-port"); p != "/visor/next-port" {
+		t.Errorf("expected /visor/next-port, got %s", p)
+	}
+	if p := c.relpath("/visor/instances/1/start"); p != "/instances/1/start" {
+		t.Errorf("expected /instances/1/start, got %s", p)
+	}
+
+	c = &conn{root: "/"}
+
+	if p := c.path("apps"); p != "/apps" {
+		t.Errorf("expected /apps, got %s", p)
+	}
+	if p := c.relpath("/apps/cat/registered"); p != "/apps/cat/registered" {
+		t.Errorf("expected /apps/cat/registered, got %s", p)
+	}
+}
+
+func TestDialBackendUnknownScheme(t *testing.T) {
+	_, err := DialBackend("zookeeper:localhost:2181")
+	if err == nil || !IsErrInvalidArgument(err) {
+		t.Errorf("expected invalid argument error, got %v", err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	s := visorSetup("/txn-test")
+	sp := s.GetSnapshot()
+
+	sp1, err := sp.Txn().
+		Set("apps/cat/attrs", "meow").
+		Set("apps/cat/registered", "stale").
+		Set("apps/cat/registered", "now").
+		Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, body := range map[string]string{"apps/cat/attrs": "meow", "apps/cat/registered": "now"} {
+		val, rev, err := sp1.Get(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != body || rev != sp1.Rev {
+			t.Errorf("expected %s to be %s@%d, got %s@%d", p, body, sp1.Rev, val, rev)
+		}
+	}
+
+	_, err = sp.Txn().Set("apps/cat/attrs", "purr").Set("apps/dog/attrs", "woof").Commit()
+	if !IsErrRevMismatch(err) {
+		t.Errorf("expected rev mismatch for stale txn, got %v", err)
+	}
+	sp1, err = sp1.FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _, err := sp1.Exists("apps/dog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("expected failed txn not to write anything")
+	}
+
+	sp2, err := sp1.Txn().Del("apps/cat").Set("apps/dog/attrs", "woof").Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := sp2.Getdir("apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"dog"}) {
+		t.Errorf("expected [dog], got %v", names)
+	}
+
+	sp3, err := sp2.Txn().Commit()
+	if err != nil || sp3.Rev != sp2.Rev {
+		t.Errorf("expected empty txn to be a no-op, got %d %v", sp3.Rev, err)
+	}
+}
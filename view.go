@@ -0,0 +1,496 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A View is an in-memory copy of the apps and instances of a Store. It's
+// loaded once at a single revision and then kept current by the events of
+// the Store, so that queries mostly don't touch the coordinator. Everything
+// a View returns is as of the revision it reports along with it, or later.
+//
+// Entities returned by a View are shared, they must not be changed.
+type View struct {
+	store *Store
+
+	mu        sync.RWMutex
+	rev       int64
+	apps      map[string]*viewApp
+	instances map[int64]*Instance
+	changed   chan struct{}
+}
+
+type viewApp struct {
+	app   *App
+	revs  map[string]*Revision
+	procs map[string]*Proc
+	envs  map[string]*Env
+}
+
+func newViewApp(app *App) *viewApp {
+	return &viewApp{app, map[string]*Revision{}, map[string]*Proc{}, map[string]*Env{}}
+}
+
+func (s *Store) NewView() *View {
+	return &View{
+		store:     s,
+		apps:      map[string]*viewApp{},
+		instances: map[int64]*Instance{},
+		changed:   make(chan struct{}),
+	}
+}
+
+// Load reads the whole registry at the latest revision, replacing what the
+// View held before.
+func (v *View) Load() error {
+	sp, err := v.store.GetSnapshot().FastForward()
+	if err != nil {
+		return err
+	}
+	apps, err := loadViewApps(sp)
+	if err != nil {
+		return err
+	}
+	instances, err := loadViewInstances(sp)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.rev = sp.Rev
+	v.apps = apps
+	v.instances = instances
+	v.notify()
+
+	return nil
+}
+
+func loadViewApps(sp Snapshot) (map[string]*viewApp, error) {
+	apps := map[string]*viewApp{}
+
+	names, err := getdirOptional(sp, appsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		app, err := getApp(name, sp)
+		if IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		va := newViewApp(app)
+
+		refs, err := getdirOptional(sp, app.dir.Prefix(revsPath))
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			rev, err := getRevision(app, ref, sp)
+			if IsErrNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			va.revs[ref] = rev
+		}
+		procs, err := getdirOptional(sp, app.dir.Prefix(procsPath))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range procs {
+			proc, err := getProc(app, name, sp)
+			if IsErrNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			va.procs[name] = proc
+		}
+		envs, err := getdirOptional(sp, app.dir.Prefix(envsPath))
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range envs {
+			env, err := getEnv(app, ref, sp)
+			if IsErrNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			va.envs[ref] = env
+		}
+		apps[name] = va
+	}
+	return apps, nil
+}
+
+func loadViewInstances(sp Snapshot) (map[int64]*Instance, error) {
+	instances := map[int64]*Instance{}
+
+	names, err := getdirOptional(sp, instancesPath)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, name := range names {
+		if _, err := parseInstanceId(name); err == nil {
+			ids = append(ids, name)
+		}
+	}
+	ch, errch := getSnapshotables(ids, func(idstr string) (Snapshotable, error) {
+		id, _ := parseInstanceId(idstr)
+		ins, err := getInstance(id, sp)
+		if IsErrNotFound(err) || IsErrNoEnt(err) {
+			// Being registered or removed without a transaction.
+			return (*Instance)(nil), nil
+		}
+		return ins, err
+	})
+	for range ids {
+		select {
+		case s := <-ch:
+			if ins := s.(*Instance); ins != nil {
+				instances[ins.Id] = ins
+			}
+		case err := <-errch:
+			return nil, err
+		}
+	}
+	return instances, nil
+}
+
+func getdirOptional(sp Snapshot, p string) ([]string, error) {
+	names, err := sp.Getdir(p)
+	if IsErrNoEnt(err) {
+		return []string{}, nil
+	}
+	return names, err
+}
+
+// Run loads the View and keeps it current until ctx is done or the watch
+// fails. It applies the same events as WatchEventRaw, but all events of a
+// revision at once, so that the View never reports a revision it only
+// applied partially. Events which can't be applied fail the watch as
+// well; run it again to reload the View.
+func (v *View) Run(ctx context.Context) error {
+	if err := v.Load(); err != nil {
+		return err
+	}
+	sp := Snapshot{v.Rev(), v.store.GetSnapshot().conn}
+
+	for {
+		evs, err := sp.waitAll(ctx, globPlural)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i := range evs {
+			src := &evs[i]
+			etype, data, err := classifyEvent(src)
+			if err != nil {
+				return err
+			}
+			ev, err := newEvent(src, etype, data, src)
+			if err != nil {
+				return err
+			}
+			if err := v.apply(ev); err != nil {
+				return err
+			}
+		}
+		sp = sp.Join(evs[0])
+
+		v.mu.Lock()
+		v.rev = sp.Rev
+		v.notify()
+		v.mu.Unlock()
+	}
+}
+
+// apply updates the View with ev. Sources of events are read at the
+// revision of the event already; entities whose files don't classify as
+// an event, like the head of an app or the attrs of a proc, are reread.
+func (v *View) apply(ev *Event) error {
+	var reload func() error
+
+	if (ev.Type == EvUnknown || ev.Type == EvInsUnlock) && ev.raw != nil {
+		reload = v.reloader(ev.raw)
+	}
+	if reload != nil {
+		if err := reload(); err != nil {
+			return err
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch src := ev.Source.(type) {
+	case *App:
+		v.apps[src.Name] = newViewApp(src)
+	case *Revision:
+		if va := v.apps[src.App.Name]; va != nil {
+			va.revs[src.Ref] = src
+		}
+	case *Proc:
+		if va := v.apps[src.App.Name]; va != nil {
+			va.procs[src.Name] = src
+		}
+	case *Env:
+		if va := v.apps[src.App.Name]; va != nil && ev.Type == EvEnvReg {
+			va.envs[src.Ref] = src
+		}
+	case *Instance:
+		// The source of an unlock is the instance before it, which is
+		// reread instead.
+		if ev.Type != EvInsUnlock {
+			v.instances[src.Id] = src
+		}
+	}
+
+	data := ev.Path
+	switch ev.Type {
+	case EvAppUnreg:
+		delete(v.apps, *data.App)
+	case EvRevUnreg:
+		if va := v.apps[*data.App]; va != nil {
+			delete(va.revs, *data.Revision)
+		}
+	case EvProcUnreg:
+		if va := v.apps[*data.App]; va != nil {
+			delete(va.procs, *data.Proc)
+		}
+	case EvEnvUnreg:
+		if va := v.apps[*data.App]; va != nil {
+			delete(va.envs, *data.Env)
+		}
+	case EvInsUnreg:
+		if id, err := parseInstanceId(*data.Instance); err == nil {
+			delete(v.instances, id)
+		}
+	}
+	return nil
+}
+
+// reloader returns a function which rereads the entity the file of src
+// belongs to, or nil if the View doesn't keep it.
+func (v *View) reloader(src *RawEvent) func() error {
+	parts := strings.Split(strings.TrimPrefix(src.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 5 && parts[0] == appsPath && parts[2] == procsPath &&
+		(parts[4] == procsPortPath || parts[4] == procsAttrsPath):
+		return func() error {
+			v.mu.RLock()
+			va := v.apps[parts[1]]
+			v.mu.RUnlock()
+			if va == nil {
+				return nil
+			}
+			proc, err := getProc(va.app, parts[3], src)
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			switch {
+			case IsErrNotFound(err) || IsErrNoEnt(err):
+				delete(va.procs, parts[3])
+			case err != nil:
+				return err
+			default:
+				va.procs[parts[3]] = proc
+			}
+			return nil
+		}
+	case len(parts) >= 3 && parts[0] == appsPath &&
+		parts[2] != revsPath && parts[2] != procsPath && parts[2] != envsPath:
+		return func() error {
+			app, err := getApp(parts[1], src)
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			switch {
+			case IsErrNotFound(err) || IsErrNoEnt(err):
+				delete(v.apps, parts[1])
+			case err != nil:
+				return err
+			default:
+				if va := v.apps[app.Name]; va != nil {
+					va.app = app
+				}
+			}
+			return nil
+		}
+	case len(parts) >= 3 && parts[0] == instancesPath:
+		id, err := parseInstanceId(parts[1])
+		if err != nil {
+			return nil
+		}
+		return func() error {
+			ins, err := getInstance(id, src)
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			switch {
+			case IsErrNotFound(err) || IsErrNoEnt(err):
+				delete(v.instances, id)
+			case err != nil:
+				return err
+			default:
+				v.instances[id] = ins
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// notify wakes up everyone waiting for a change. It's called with the
+// lock held.
+func (v *View) notify() {
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// Rev returns the revision the View is current with.
+func (v *View) Rev() int64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.rev
+}
+
+// Wait blocks until the View is current with rev, e.g. the revision of a
+// write which should be visible in the View.
+func (v *View) Wait(ctx context.Context, rev int64) error {
+	for {
+		v.mu.RLock()
+		current, changed := v.rev, v.changed
+		v.mu.RUnlock()
+
+		if current >= rev {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// GetApps returns all apps ordered by name, and the revision of the View.
+func (v *View) GetApps() ([]*App, int64) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	apps := []*App{}
+	for _, va := range v.apps {
+		apps = append(apps, va.app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	return apps, v.rev
+}
+
+func (v *View) GetApp(name string) (*App, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	va := v.apps[name]
+	if va == nil {
+		return nil, errorf(ErrNotFound, `app "%s" not found`, name)
+	}
+	return va.app, nil
+}
+
+// GetRevisions returns the revisions of app ordered by ref.
+func (v *View) GetRevisions(app string) ([]*Revision, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	va := v.apps[app]
+	if va == nil {
+		return nil, errorf(ErrNotFound, `app "%s" not found`, app)
+	}
+	revs := []*Revision{}
+	for _, rev := range va.revs {
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Ref < revs[j].Ref })
+	return revs, nil
+}
+
+// GetProcs returns the procs of app ordered by name.
+func (v *View) GetProcs(app string) ([]*Proc, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	va := v.apps[app]
+	if va == nil {
+		return nil, errorf(ErrNotFound, `app "%s" not found`, app)
+	}
+	procs := []*Proc{}
+	for _, proc := range va.procs {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Name < procs[j].Name })
+	return procs, nil
+}
+
+// GetEnvs returns the envs of app ordered by ref.
+func (v *View) GetEnvs(app string) ([]*Env, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	va := v.apps[app]
+	if va == nil {
+		return nil, errorf(ErrNotFound, `app "%s" not found`, app)
+	}
+	envs := []*Env{}
+	for _, env := range va.envs {
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool { return envs[i].Ref < envs[j].Ref })
+	return envs, nil
+}
+
+func (v *View) GetInstance(id int64) (*Instance, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	ins := v.instances[id]
+	if ins == nil {
+		return nil, errorf(ErrNotFound, `instance '%d' not found`, id)
+	}
+	return ins, nil
+}
+
+// FindInstances returns the instances matching q, and the revision of the
+// View. Only the Claimer and Locked fields of q are read from the
+// coordinator, at the revision of each instance.
+func (v *View) FindInstances(q Query) ([]*Instance, int64, error) {
+	if err := q.validate(); err != nil {
+		return nil, 0, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	instances := make([]*Instance, 0, len(v.instances))
+	for _, ins := range v.instances {
+		instances = append(instances, ins)
+	}
+	found, err := q.find(instances)
+	return found, v.rev, err
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// viewSync waits for v to catch up with the latest revision of s.
+func viewSync(t *testing.T, v *View, s *Store) {
+	sp, err := s.GetSnapshot().FastForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := v.Wait(ctx, sp.Rev); err != nil {
+		t.Fatalf("expected view to reach %d, got %s at %d", sp.Rev, err, v.Rev())
+	}
+}
+
+func expectViewInstances(t *testing.T, v *View, q Query, ids ...int64) {
+	instances, _, err := v.FindInstances(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []int64{}
+	for _, ins := range instances {
+		got = append(got, ins.Id)
+	}
+	if len(got) != len(ids) {
+		t.Fatalf("expected %+v to find %v, got %v", q, ids, got)
+	}
+	for i := range ids {
+		if got[i] != ids[i] {
+			t.Fatalf("expected %+v to find %v, got %v", q, ids, got)
+		}
+	}
+}
+
+func TestView(t *testing.T) {
+	s, _ := eventSetup()
+
+	app, err := eventAppSetup(s, "viewcat").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.NewRevision(app, "128af9", "").Register(); err != nil {
+		t.Fatal(err)
+	}
+	proc, err := s.NewProc(app, "web").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := s.RegisterInstance("viewcat", "128af9", "web", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err = web.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err = web.Started("10.0.0.1", "box", 9000, 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := s.NewView()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- v.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	viewSync(t, v, s)
+
+	// Loaded from the registry.
+	apps, rev := v.GetApps()
+	if len(apps) != 1 || apps[0].Name != "viewcat" || rev == 0 {
+		t.Errorf("expected app viewcat at a revision, got %v at %d", apps, rev)
+	}
+	revs, err := v.GetRevisions("viewcat")
+	if err != nil || len(revs) != 1 || revs[0].Ref != "128af9" {
+		t.Errorf("expected revision 128af9, got %v (%v)", revs, err)
+	}
+	expectViewInstances(t, v, Query{App: "viewcat", Status: []InsStatus{InsStatusRunning}, Host: "box"}, web.Id)
+
+	// Kept current by events.
+	worker, err := s.RegisterInstance("viewcat", "128af9", "worker", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.NewEnv("prod", map[string]string{"PORT": "80"}).Register(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.SetHead("128af9"); err != nil {
+		t.Fatal(err)
+	}
+	limit := 512
+	proc.Attrs.Limits.MemoryLimitMb = &limit
+	if _, err = proc.StoreAttrs(); err != nil {
+		t.Fatal(err)
+	}
+	viewSync(t, v, s)
+
+	expectViewInstances(t, v, Query{App: "viewcat"}, web.Id, worker.Id)
+	expectViewInstances(t, v, Query{Env: "dev", Status: []InsStatus{InsStatusPending}}, worker.Id)
+
+	envs, err := v.GetEnvs("viewcat")
+	if err != nil || len(envs) != 1 || envs[0].Vars["PORT"] != "80" {
+		t.Errorf("expected env prod, got %v (%v)", envs, err)
+	}
+	got, err := v.GetApp("viewcat")
+	if err != nil || got.Head != "128af9" {
+		t.Errorf("expected app head to be reread, got %v (%v)", got, err)
+	}
+	procs, err := v.GetProcs("viewcat")
+	if err != nil || len(procs) != 1 || procs[0].Attrs.Limits.MemoryLimitMb == nil {
+		t.Errorf("expected proc attrs to be reread, got %v (%v)", procs, err)
+	}
+
+	if _, err = web.Lock("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = web.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = worker.Unregister("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	viewSync(t, v, s)
+
+	expectViewInstances(t, v, Query{App: "viewcat"}, web.Id)
+	if _, err := v.GetInstance(worker.Id); !IsErrNotFound(err) {
+		t.Errorf("expected unregistered instance to be gone, got %v", err)
+	}
+	ins, err := v.GetInstance(web.Id)
+	if err != nil || ins.Status != InsStatusRunning {
+		t.Errorf("expected instance to be running after the unlock, got %v (%v)", ins, err)
+	}
+
+	if err = app.Unregister(); err != nil {
+		t.Fatal(err)
+	}
+	viewSync(t, v, s)
+
+	if _, err := v.GetApp("viewcat"); !IsErrNotFound(err) {
+		t.Errorf("expected unregistered app to be gone, got %v", err)
+	}
+}
@@ -8,7 +8,6 @@ package visor
 import (
 	"errors"
 	"fmt"
-	cp "github.com/soundcloud/cotterpin"
 	"net"
 	"path"
 	"regexp"
@@ -17,10 +16,12 @@ import (
 	"time"
 )
 
-const SchemaVersion = 3
+const SchemaVersion = 4
+
+// DefaultUri is the coordinator uri used by tools which aren't given one.
+var DefaultUri = "doozer:?ca=localhost:8046"
 
 const (
-	DefaultUri     = "doozer:?ca=localhost:8046"
 	DefaultRoot    = "/visor"
 	startPort      = 8000
 	nextPortPath   = "/next-port"
@@ -35,18 +36,47 @@ const (
 var Version string
 
 type Store struct {
-	snapshot cp.Snapshot
+	snapshot Snapshot
 }
 
+// ServiceType is the kind of a Service.
+type ServiceType string
+
+const (
+	ServiceLogger ServiceType = "logger"
+	ServiceProxy  ServiceType = "proxy"
+	ServicePm     ServiceType = "pm"
+)
+
+// A Service is a logger, proxy or pm registered with the coordinator.
+type Service struct {
+	snapshot   Snapshot
+	Type       ServiceType
+	Addr       string
+	Version    string
+	Registered time.Time
+}
+
+// DialUri connects to the coordinator at uri and returns a Store rooted
+// at root. The uri scheme selects the Backend, see RegisterBackend.
 func DialUri(uri, root string) (*Store, error) {
-	sp, err := cp.DialUri(uri, root)
+	sp, err := dialUri(uri, root)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{sp}, nil
+}
+
+// NewStore returns a Store rooted at root on top of the given Backend.
+func NewStore(b Backend, root string) (*Store, error) {
+	sp, err := newSnapshot(b, root)
 	if err != nil {
 		return nil, err
 	}
 	return &Store{sp}, nil
 }
 
-func (s *Store) GetSnapshot() cp.Snapshot {
+func (s *Store) GetSnapshot() Snapshot {
 	return s.snapshot
 }
 
@@ -76,14 +106,14 @@ func (s *Store) Init() (*Store, error) {
 		}
 	}
 
-	v, err := cp.VerifySchema(SchemaVersion, sp)
-	if cp.IsErrNoEnt(err) {
-		sp, err = cp.SetSchemaVersion(SchemaVersion, sp)
+	v, err := verifySchema(SchemaVersion, sp)
+	if IsErrNoEnt(err) {
+		sp, err = setSchemaVersion(SchemaVersion, sp)
 		if err != nil {
 			return nil, err
 		}
 	} else if err != nil {
-		if cp.IsErrSchemaMism(err) {
+		if IsErrSchemaMism(err) {
 			err = fmt.Errorf("%s (%d != %d)", err, SchemaVersion, v)
 		}
 		return nil, err
@@ -133,26 +163,12 @@ func (s *Store) Scale(app, rev, proc, env string, factor int) (tickets []*Instan
 
 	s.snapshot = sp
 
-	ids, err := getInstanceIds(app, rev, proc, sp)
+	live := []InsStatus{InsStatusPending, InsStatusClaimed, InsStatusRunning, InsStatusStopping}
+	is, err := findInstances(Query{App: app, Revision: rev, Proc: proc, Env: env, Status: live}, sp)
 	if err != nil {
 		return nil, -1, err
 	}
 
-	is := []*Instance{}
-	for _, id := range ids {
-		// TODO parallelize the instance retrieval and order after (xla)
-		i, err := getInstance(id, s)
-		if err != nil {
-			return nil, -1, err
-		}
-
-		if i.Env != env {
-			continue
-		}
-
-		is = append(is, i)
-	}
-
 	current = len(is)
 
 	if factor > current {
@@ -176,9 +192,6 @@ func (s *Store) Scale(app, rev, proc, env string, factor int) (tickets []*Instan
 
 			err = ins.Stop()
 			if err != nil {
-				if IsErrInvalidState(err) {
-					err = errorf(ErrInvalidState, "instance '%d' isn't running", ins.Id)
-				}
 				return nil, -1, err
 			}
 
@@ -199,7 +212,7 @@ func (s *Store) GetScale(app string, revid string, proc string) (scale int, rev
 	count, rev, err := sp.Stat(path, &s.snapshot.Rev)
 
 	// File doesn't exist, assume scale = 0
-	if cp.IsErrNoEnt(err) {
+	if IsErrNoEnt(err) {
 		return 0, rev, nil
 	}
 	if err != nil {
@@ -220,7 +233,7 @@ func (s *Store) GetLoggers() ([]string, error) {
 		return nil, err
 	}
 	for i, name := range names {
-		names[i] = strings.Replace(name, "-", ":", 1)
+		names[i] = serviceAddr(ServiceLogger, name)
 	}
 	return names, nil
 }
@@ -299,7 +312,7 @@ func (s *Store) SetSchemaVersion(version int) error {
 	if err != nil {
 		return err
 	}
-	_, err = cp.SetSchemaVersion(version, sp)
+	_, err = setSchemaVersion(version, sp)
 	if err != nil {
 		return err
 	}
@@ -311,9 +324,9 @@ func (s *Store) VerifySchema() (int, error) {
 	if err != nil {
 		return -1, err
 	}
-	v, err := cp.VerifySchema(SchemaVersion, sp)
+	v, err := verifySchema(SchemaVersion, sp)
 	if err != nil {
-		if cp.IsErrSchemaMism(err) {
+		if IsErrSchemaMism(err) {
 			err = fmt.Errorf("%s (%d != %d)", err, SchemaVersion, v)
 		}
 		return v, err
@@ -325,11 +338,67 @@ func (s *Store) UnregisterProxy(host string) error {
 	return s.GetSnapshot().Del(path.Join(proxyDir, host))
 }
 
+func (s *Service) GetSnapshot() Snapshot {
+	return s.snapshot
+}
+
+func (s *Service) String() string {
+	return fmt.Sprintf("Service{type=%s, addr=%s, version=%s}", s.Type, s.Addr, s.Version)
+}
+
+// getService returns the Service of the given type stored under name,
+// which is the host, or host-port for loggers.
+func getService(t ServiceType, name string, s Snapshotable) (*Service, error) {
+	var dir string
+
+	switch t {
+	case ServiceLogger:
+		dir = loggerDir
+	case ServiceProxy:
+		dir = proxyDir
+	case ServicePm:
+		dir = pmDir
+	default:
+		return nil, errorf(ErrInvalidArgument, "unknown service type %s", t)
+	}
+	sp := s.GetSnapshot()
+
+	f, err := sp.getFile(path.Join(dir, name), new(listCodec))
+	if err != nil {
+		if IsErrNoEnt(err) {
+			err = errorf(ErrNotFound, "%s '%s' not found", t, name)
+		}
+		return nil, err
+	}
+	svc := &Service{snapshot: sp, Type: t, Addr: serviceAddr(t, name)}
+
+	fields := f.Value.([]string)
+	if len(fields) > 0 {
+		svc.Registered, err = parseTime(fields[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) > 1 {
+		svc.Version = fields[1]
+	}
+	return svc, nil
+}
+
+// serviceAddr returns the address of the service registered under name.
+// Loggers are registered as <host>-<port>.
+func serviceAddr(t ServiceType, name string) string {
+	if t == ServiceLogger {
+		return strings.Replace(name, "-", ":", 1)
+	}
+	return name
+}
+
 func (s *Store) reset() error {
-	return s.GetSnapshot().Reset()
+	return s.GetSnapshot().reset()
 }
 
-func storeFromSnapshotable(sp cp.Snapshotable) *Store {
+func storeFromSnapshotable(sp Snapshotable) *Store {
 	return &Store{sp.GetSnapshot()}
 }
 
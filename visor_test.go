@@ -6,9 +6,20 @@
 package visor
 
 import (
+	"os"
 	"testing"
 )
 
+// TestMain runs the suite against the in-memory backend, unless
+// VISOR_TEST_URI points it at a real coordinator.
+func TestMain(m *testing.M) {
+	DefaultUri = "mem:"
+	if uri := os.Getenv("VISOR_TEST_URI"); uri != "" {
+		DefaultUri = uri
+	}
+	os.Exit(m.Run())
+}
+
 func visorSetup(root string) *Store {
 	s, err := DialUri(DefaultUri, root)
 	if err != nil {
@@ -0,0 +1,338 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultWebhookRetries    = 5
+	DefaultWebhookBackoff    = time.Second
+	DefaultWebhookMaxBackoff = time.Minute
+	DefaultWebhookSpoolSize  = 1000
+
+	spoolRevFile = "rev"
+)
+
+var reWebhookName = regexp.MustCompile("^[-_.[:alnum:]]+$")
+
+// A Webhook is an HTTP endpoint events are POSTed to by a Forwarder. The
+// Name identifies the spool of the endpoint, it has to stay the same
+// across restarts. Only events of the listed Types are forwarded, or all
+// events if there are none.
+type Webhook struct {
+	Name  string
+	Url   string
+	Types []EventType
+}
+
+// A Forwarder POSTs the JSON encoding of the events of a Store to a set
+// of Webhooks.
+//
+// Events are written to a spool directory per webhook before they are
+// delivered, and removed once the endpoint accepted them with a 2xx
+// status. Failed deliveries are retried with an exponential backoff
+// between Backoff and MaxBackoff, up to Retries times, after which the
+// event is dropped. Client errors other than 429 aren't retried. Each
+// spool holds up to SpoolSize events, the oldest ones are dropped to make
+// room for new ones.
+//
+// The revision up to which events have been spooled is kept in the spool
+// directory as well, a restarted Forwarder resumes from there and delivers
+// what was left in the spools. Delivery is at least once, an endpoint may
+// see an event again if the Forwarder stopped while posting it.
+type Forwarder struct {
+	store *Store
+	dir   string
+	hooks []*Webhook
+
+	Client     *http.Client
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	SpoolSize  int
+
+	// Errors receives failed deliveries and dropped events, if set. Errors
+	// are discarded while the channel is full.
+	Errors chan error
+}
+
+func (s *Store) NewForwarder(spoolDir string, hooks ...*Webhook) *Forwarder {
+	return &Forwarder{
+		store:      s,
+		dir:        spoolDir,
+		hooks:      hooks,
+		Client:     http.DefaultClient,
+		Retries:    DefaultWebhookRetries,
+		Backoff:    DefaultWebhookBackoff,
+		MaxBackoff: DefaultWebhookMaxBackoff,
+		SpoolSize:  DefaultWebhookSpoolSize,
+	}
+}
+
+// Run forwards events until ctx is done or the watch fails. If the
+// revision to resume from has been compacted, Run fails with
+// ErrCompacted; remove the rev file from the spool directory to start
+// over from the current revision.
+func (f *Forwarder) Run(ctx context.Context) error {
+	for _, h := range f.hooks {
+		if !reWebhookName.MatchString(h.Name) {
+			return errorf(ErrInvalidArgument, "invalid webhook name '%s'", h.Name)
+		}
+		if err := os.MkdirAll(f.spoolDir(h), 0755); err != nil {
+			return err
+		}
+	}
+	rev, err := f.readRev()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan bool)
+	notify := make([]chan bool, len(f.hooks))
+	for i, h := range f.hooks {
+		notify[i] = make(chan bool, 1)
+		go func(h *Webhook, n chan bool) {
+			f.deliver(ctx, h, n)
+			done <- true
+		}(h, notify[i])
+	}
+	defer func() {
+		cancel()
+		for range f.hooks {
+			<-done
+		}
+	}()
+
+	l := make(chan *Event)
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		rev, err = f.store.WatchEventSince(ctx, rev, l)
+		errc <- err
+	}()
+
+	var last int64
+	seq := 0
+
+	for ev := range l {
+		if ev.Rev != last {
+			// All events before ev.Rev are spooled.
+			if last != 0 {
+				if err := f.writeRev(last); err != nil {
+					return err
+				}
+			}
+			last, seq = ev.Rev, 0
+		}
+		body, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		for i, h := range f.hooks {
+			if len(h.Types) > 0 && !containsEventType(h.Types, ev.Type) {
+				continue
+			}
+			if err := f.spool(h, ev.Rev, seq, body); err != nil {
+				return err
+			}
+			select {
+			case notify[i] <- true:
+			default:
+			}
+		}
+		seq++
+	}
+
+	err = <-errc
+	if werr := f.writeRev(rev); werr != nil {
+		return werr
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
+
+// deliver sends the spooled events of h in order until ctx is done.
+func (f *Forwarder) deliver(ctx context.Context, h *Webhook, notify chan bool) {
+	attempts := 0
+
+	for {
+		names, err := f.spooled(h)
+		if err != nil {
+			f.error(err)
+		}
+		if len(names) == 0 {
+			select {
+			case <-notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		p := filepath.Join(f.spoolDir(h), names[0])
+
+		retry, err := f.post(ctx, h, p)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil || !retry || attempts >= f.Retries {
+			if err != nil {
+				f.error(fmt.Errorf("webhook %s: dropping %s: %s", h.Name, names[0], err))
+			}
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				f.error(err)
+			}
+			attempts = 0
+			continue
+		}
+		f.error(fmt.Errorf("webhook %s: delivering %s: %s", h.Name, names[0], err))
+		attempts++
+
+		select {
+		case <-time.After(f.backoff(attempts)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// post sends the spooled event at p to h and reports whether a failed
+// delivery should be retried.
+func (f *Forwarder) post(ctx context.Context, h *Webhook, p string) (bool, error) {
+	body, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		// Dropped to make room for newer events in the meantime.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", h.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return false, fmt.Errorf("%s responded %s", h.Url, resp.Status)
+	}
+	return true, fmt.Errorf("%s responded %s", h.Url, resp.Status)
+}
+
+func (f *Forwarder) backoff(attempts int) time.Duration {
+	d := f.Backoff
+	for i := 1; i < attempts && d < f.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > f.MaxBackoff {
+		d = f.MaxBackoff
+	}
+	return d
+}
+
+// spool writes an event for h, dropping the oldest spooled events if the
+// spool is full. Events are named after their revision and their position
+// in it, so that spooling an event again replaces it.
+func (f *Forwarder) spool(h *Webhook, rev int64, seq int, body []byte) error {
+	names, err := f.spooled(h)
+	if err != nil {
+		return err
+	}
+	for i := 0; i <= len(names)-f.SpoolSize; i++ {
+		if err := os.Remove(filepath.Join(f.spoolDir(h), names[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		f.error(fmt.Errorf("webhook %s: spool full, dropping %s", h.Name, names[i]))
+	}
+
+	name := fmt.Sprintf("%020d-%06d.json", rev, seq)
+	return writeFileAtomic(filepath.Join(f.spoolDir(h), name), body)
+}
+
+// spooled returns the names of the events spooled for h, oldest first.
+func (f *Forwarder) spooled(h *Webhook) ([]string, error) {
+	entries, err := ioutil.ReadDir(f.spoolDir(h))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *Forwarder) spoolDir(h *Webhook) string {
+	return filepath.Join(f.dir, h.Name)
+}
+
+// readRev returns the revision to resume from, or the revision of the
+// Store if there is none.
+func (f *Forwarder) readRev() (int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(f.dir, spoolRevFile))
+	if os.IsNotExist(err) {
+		return f.store.GetSnapshot().Rev, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (f *Forwarder) writeRev(rev int64) error {
+	return writeFileAtomic(filepath.Join(f.dir, spoolRevFile), []byte(strconv.FormatInt(rev, 10)))
+}
+
+func (f *Forwarder) error(err error) {
+	if f.Errors == nil {
+		return
+	}
+	select {
+	case f.Errors <- err:
+	default:
+	}
+}
+
+func writeFileAtomic(p string, body []byte) error {
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
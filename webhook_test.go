@@ -0,0 +1,245 @@
+// Copyright (c) 2013, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRecorder struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	events   chan *Event
+}
+
+func newWebhookServer(failures int) (*httptest.Server, *webhookRecorder) {
+	rec := &webhookRecorder{failures: failures, status: http.StatusOK, events: make(chan *Event, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		if rec.failures > 0 {
+			rec.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ev := &Event{}
+		if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(rec.status)
+		rec.events <- ev
+	}))
+	return srv, rec
+}
+
+func forwarderSetup(s *Store, spool string, hooks ...*Webhook) *Forwarder {
+	f := s.NewForwarder(spool, hooks...)
+	f.Backoff = 10 * time.Millisecond
+	f.MaxBackoff = 40 * time.Millisecond
+	return f
+}
+
+func startForwarder(t *testing.T, f *Forwarder) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func expectWebhookEvent(t *testing.T, rec *webhookRecorder, etype EventType) *Event {
+	select {
+	case ev := <-rec.events:
+		if ev.Type != etype {
+			t.Errorf("expected %s to be posted, got %s", etype, ev.Type)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected %s to be posted, got timeout", etype)
+	}
+	return nil
+}
+
+func TestForwarder(t *testing.T) {
+	s, _ := eventSetup()
+	spool, err := ioutil.TempDir("", "visor-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	flaky, flakyRec := newWebhookServer(2)
+	defer flaky.Close()
+	all, allRec := newWebhookServer(0)
+	defer all.Close()
+
+	f := forwarderSetup(s, spool,
+		&Webhook{Name: "paging", Url: flaky.URL, Types: []EventType{EvInsFail, EvInsLost}},
+		&Webhook{Name: "tracker", Url: all.URL},
+	)
+	defer startForwarder(t, f)()
+
+	ins, err := s.RegisterInstance("hookcat", "128af9", "web", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Failed("10.0.0.1", errors.New("no space left"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectWebhookEvent(t, allRec, EvInsReg)
+	expectWebhookEvent(t, allRec, EvInsClaim)
+	expectWebhookEvent(t, allRec, EvInsFail)
+
+	ev := expectWebhookEvent(t, flakyRec, EvInsFail)
+	if src, ok := ev.Source.(*Instance); !ok || src.Id != ins.Id || src.Status != InsStatusFailed {
+		t.Errorf("expected failed instance %d to be posted, got %#v", ins.Id, ev.Source)
+	}
+	select {
+	case ev := <-flakyRec.events:
+		t.Errorf("expected only failures to be posted, got %s", ev.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestForwarderSpool(t *testing.T) {
+	s, _ := eventSetup()
+	spool, err := ioutil.TempDir("", "visor-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	srv, rec := newWebhookServer(1 << 20)
+	defer srv.Close()
+	hook := &Webhook{Name: "tracker", Url: srv.URL, Types: []EventType{EvAppReg}}
+
+	f := forwarderSetup(s, spool, hook)
+	f.Retries = 1 << 20
+	stop := startForwarder(t, f)
+
+	for _, name := range []string{"spoolcat", "spooldog"} {
+		_, err := eventAppSetup(s, name).Register()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		// The spool is created by Run.
+		names, _ := f.spooled(hook)
+		if len(names) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// Events survive the restart and are delivered in order, along with
+	// the ones written while the forwarder was down.
+	_, err = eventAppSetup(s, "spoolbird").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	rec.failures = 0
+	rec.mu.Unlock()
+
+	defer startForwarder(t, forwarderSetup(s, spool, hook))()
+
+	// A post cancelled by the stopped forwarder may still reach the
+	// server, delivery is at least once.
+	var last int64
+	for _, name := range []string{"spoolcat", "spooldog", "spoolbird"} {
+		ev := expectWebhookEvent(t, rec, EvAppReg)
+		for ev.Rev == last {
+			ev = expectWebhookEvent(t, rec, EvAppReg)
+		}
+		last = ev.Rev
+		if ev.Path.App == nil || *ev.Path.App != name {
+			t.Errorf("expected registration of %s, got %s", name, ev.Path)
+		}
+	}
+}
+
+func TestForwarderDrop(t *testing.T) {
+	s, _ := eventSetup()
+	spool, err := ioutil.TempDir("", "visor-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	srv, rec := newWebhookServer(0)
+	defer srv.Close()
+	rec.status = http.StatusBadRequest
+	hook := &Webhook{Name: "tracker", Url: srv.URL, Types: []EventType{EvAppReg}}
+
+	f := forwarderSetup(s, spool, hook)
+	f.SpoolSize = 2
+	if err := os.MkdirAll(f.spoolDir(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, body := range []string{"a", "b", "c"} {
+		if err := f.spool(hook, int64(i+1), 0, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := f.spooled(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "00000000000000000002-000000.json" {
+		t.Errorf("expected the oldest event to be dropped, got %v", names)
+	}
+
+	// Client errors aren't retried.
+	f.Errors = make(chan error, 16)
+	stop := startForwarder(t, f)
+	_, err = eventAppSetup(s, "dropcat").Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWebhookEvent(t, rec, EvAppReg)
+
+	for {
+		names, err := f.spooled(hook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if _, err := os.Stat(filepath.Join(spool, spoolRevFile)); err != nil {
+		t.Errorf("expected revision to be kept, got %s", err)
+	}
+}